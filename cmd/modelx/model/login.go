@@ -20,14 +20,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 	"kubegems.io/modelx/cmd/modelx/repo"
 	"kubegems.io/modelx/pkg/client"
 )
 
 func NewLoginCmd() *cobra.Command {
-	token := ""
+	token, username, password := "", "", ""
 	cmd := &cobra.Command{
 		Use:   "login",
 		Short: "login to a modelx repository",
@@ -40,6 +42,10 @@ func NewLoginCmd() *cobra.Command {
 
   		modelx login myrepo --token <token>
 
+	3. Login to myrepo with username and password
+
+  		modelx login myrepo --username <username> --password <password>
+
 		`,
 		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 			if len(args) == 0 {
@@ -53,23 +59,36 @@ func NewLoginCmd() *cobra.Command {
 			if len(args) == 0 {
 				return errors.New("at least one argument is required")
 			}
-			if token == "" {
+			if username != "" {
+				if password == "" {
+					fmt.Print("Password: ")
+					raw, err := term.ReadPassword(int(os.Stdin.Fd()))
+					fmt.Println()
+					if err != nil {
+						return err
+					}
+					password = string(raw)
+				}
+			} else if token == "" {
 				fmt.Print("Token: ")
 				_, _ = fmt.Scanln(&token)
 			}
-			return LoginModelx(ctx, args[0], token)
+			return LoginModelx(ctx, args[0], token, username, password)
 		},
 	}
 	cmd.Flags().StringVarP(&token, "token", "t", "", "token")
+	cmd.Flags().StringVarP(&username, "username", "u", "", "username of basic auth")
+	cmd.Flags().StringVarP(&password, "password", "p", "", "password of basic auth, prompted if not set")
+	cmd.MarkFlagsMutuallyExclusive("token", "username")
 	return cmd
 }
 
-func LoginModelx(ctx context.Context, reponame string, token string) error {
+func LoginModelx(ctx context.Context, reponame string, token, username, password string) error {
 	repoDetails, err := repo.DefaultRepoManager.Get(reponame)
 	if err != nil {
 		return err
 	}
-	repoDetails.Token = token
+	repoDetails.Token, repoDetails.Username, repoDetails.Password = token, username, password
 	if err := repoDetails.Client().Ping(ctx); err != nil {
 		return err
 	}
@@ -66,7 +66,7 @@ func ParseReference(raw string) (Reference, error) {
 			return Reference{}, err
 		}
 		if auth == "" {
-			auth = "Bearer " + details.Token
+			auth = details.Authorization()
 		}
 		if len(splits) == 2 {
 			raw = details.URL + "/" + splits[1]
@@ -48,10 +48,18 @@ type RepoDetails struct {
 	Name  string `json:"name,omitempty"`
 	URL   string `json:"url,omitempty"`
 	Token string `json:"token,omitempty"`
+	// Username and Password are used for basic auth if there is no token.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
 func (r RepoDetails) Client() *client.Client {
-	return client.NewClient(r.URL, "Bearer "+r.Token)
+	return client.NewClient(r.URL, r.Authorization())
+}
+
+// Authorization returns the Authorization header of the token, or of the username and password.
+func (r RepoDetails) Authorization() string {
+	return client.Authorization(r.Token, r.Username, r.Password)
 }
 
 var DefaultRepoManager = Repomanager{
@@ -0,0 +1,239 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	logging "github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap/zapcore"
+
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/middleware"
+	"kubegems.io/modelx/pkg/model"
+)
+
+// how often the config file is checked for modification
+const configPollInterval = 10 * time.Second
+
+var configFile string
+
+// LoadOptions returns the default options overridden by the config file, then by the MODELXD_*
+// environment variables, then by the flags set on the command line.
+func LoadOptions(flags *pflag.FlagSet) (*config.Options, error) {
+	opts := config.DefaultOptions()
+	if configFile != "" {
+		if err := config.LoadOptionsFile(configFile, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.LoadOptionsEnv(opts, os.Environ()); err != nil {
+		return nil, err
+	}
+	// replay the flags set onto opts
+	overrides := pflag.NewFlagSet(ServerName, pflag.ContinueOnError)
+	AddFlags(overrides, opts)
+	var err error
+	flags.Visit(func(flag *pflag.Flag) {
+		override := overrides.Lookup(flag.Name)
+		if override == nil || err != nil {
+			return
+		}
+		switch value := flag.Value.(type) {
+		case pflag.SliceValue:
+			err = override.Value.(pflag.SliceValue).Replace(value.GetSlice())
+		default:
+			raw := value.String()
+			if value.Type() == "stringToString" {
+				raw = strings.TrimSuffix(strings.TrimPrefix(raw, "["), "]")
+			}
+			if raw != "" {
+				err = override.Value.Set(raw)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// ApplyRuntimeOptions applies the settings safe to change at runtime: the log level, the authentication
+// by htpasswd, static tokens and webhook, the anonymous projects, the role bindings, the rate limits and
+// the retention rules. Nothing is applied if any of them is invalid. The OIDC settings are only read on start.
+func ApplyRuntimeOptions(opts *config.Options) error {
+	level, err := zapcore.ParseLevel(opts.LogLevel)
+	if err != nil {
+		return fmt.Errorf("log level: %w", err)
+	}
+	var authenticators *middleware.Authenticators
+	if opts.Auth.Enabled() {
+		if authenticators, err = middleware.NewAuthenticators(opts.Auth); err != nil {
+			return err
+		}
+	}
+	var policy *config.RBACConfig
+	if opts.RBAC.ConfigFile != "" {
+		if policy, err = config.LoadRBACConfig(opts.RBAC.ConfigFile); err != nil {
+			return err
+		}
+		mainLogger.Info("authorize with role bindings", logging.Any("file", opts.RBAC.ConfigFile), logging.Any("bindings", len(policy.Bindings)))
+	}
+	var limits *config.RateLimitConfig
+	if opts.RateLimit.ConfigFile != "" {
+		if limits, err = config.LoadRateLimitConfig(opts.RateLimit.ConfigFile); err != nil {
+			return err
+		}
+		mainLogger.Info("limit request rates", logging.Any("file", opts.RateLimit.ConfigFile), logging.Any("limits", limits))
+	}
+	var rules []config.RetentionRule
+	if opts.Retention.ConfigFile != "" {
+		retention, err := config.LoadRetentionConfig(opts.Retention.ConfigFile)
+		if err != nil {
+			return err
+		}
+		rules = retention.Rules
+	}
+
+	logging.RunningAtomicLevel.SetLevel(level)
+	middleware.SetAuthenticators(authenticators)
+	middleware.SetAnonymousProjects(opts.Auth.AnonymousProjects)
+	middleware.SetRBACPolicy(policy)
+	middleware.SetRateLimits(limits)
+	model.GlobalRegistry.Retention.SetRules(rules)
+	return nil
+}
+
+// ReloadOptions loads the options again on SIGHUP or once the config file or one of the rbac, rate limit
+// and retention files it refers to is modified, and applies their runtime settings.
+// The other settings take effect after a restart.
+func ReloadOptions(ctx context.Context, flags *pflag.FlagSet, opts *config.Options) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	files := runtimeConfigFiles(opts)
+	modtimes := configModTimes(files)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			mainLogger.Info("Received SIGHUP, reloading config")
+		case <-ticker.C:
+			latest := configModTimes(files)
+			modified := modifiedConfigFile(files, modtimes, latest)
+			if modified == "" {
+				continue
+			}
+			modtimes = latest
+			mainLogger.Info("config file modified, reloading config", logging.Any("file", modified))
+		}
+		reloaded, err := LoadOptions(flags)
+		if err == nil {
+			err = ApplyRuntimeOptions(reloaded)
+		}
+		if err != nil {
+			mainLogger.Error("reload config, keeping the current settings", logging.Error(err))
+			continue
+		}
+		// the config file may now refer to other files
+		files = runtimeConfigFiles(reloaded)
+		modtimes = configModTimes(files)
+		mainLogger.Info("config reloaded")
+	}
+}
+
+// runtimeConfigFiles returns the config file and the files it refers to whose settings are applied at runtime.
+func runtimeConfigFiles(opts *config.Options) []string {
+	files := []string{configFile}
+	if opts.RBAC != nil {
+		files = append(files, opts.RBAC.ConfigFile)
+	}
+	if opts.RateLimit != nil {
+		files = append(files, opts.RateLimit.ConfigFile)
+	}
+	if opts.Retention != nil {
+		files = append(files, opts.Retention.ConfigFile)
+	}
+	return files
+}
+
+func configModTimes(files []string) []time.Time {
+	modtimes := make([]time.Time, len(files))
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modtimes[i] = info.ModTime()
+		}
+	}
+	return modtimes
+}
+
+// modifiedConfigFile returns the first file whose modification time changed, or empty if none did.
+func modifiedConfigFile(files []string, previous, latest []time.Time) string {
+	for i := range files {
+		if !latest[i].Equal(previous[i]) {
+			return files[i]
+		}
+	}
+	return ""
+}
+
+func NewConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "manage the modelxd config file",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "validate FILE",
+		Short: "validate a config file with the MODELXD_* environment variables and the config files it refers to",
+		Args:  cobra.ExactArgs(1),
+		// the errors are of the file, not of the usage
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := config.DefaultOptions()
+			if err := config.LoadOptionsFile(args[0], opts); err != nil {
+				return err
+			}
+			if err := config.LoadOptionsEnv(opts, os.Environ()); err != nil {
+				return err
+			}
+			if err := opts.Validate(); err != nil {
+				return err
+			}
+			if _, err := middleware.NewAuthenticators(opts.Auth); err != nil {
+				return err
+			}
+			fmt.Printf("%s is valid\n", args[0])
+			return nil
+		},
+	})
+	return cmd
+}
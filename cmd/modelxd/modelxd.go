@@ -18,10 +18,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -29,12 +31,18 @@ import (
 	logging "github.com/kubeservice-stack/common/pkg/logger"
 	"github.com/oklog/run"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"kubegems.io/modelx/internal/goruntime"
+	"kubegems.io/modelx/pkg/audit"
+	"kubegems.io/modelx/pkg/auth"
+	"kubegems.io/modelx/pkg/client"
 	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/event"
 	_ "kubegems.io/modelx/pkg/favicon"
 	_ "kubegems.io/modelx/pkg/health"
 	_ "kubegems.io/modelx/pkg/metrics"
+	"kubegems.io/modelx/pkg/middleware"
 	"kubegems.io/modelx/pkg/model"
 	"kubegems.io/modelx/pkg/registry"
 	"kubegems.io/modelx/pkg/routers"
@@ -67,45 +75,108 @@ func NewRegistryCmd() *cobra.Command {
 		Short:   "modelxd",
 		Version: version.Get().String(),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			opts, err := LoadOptions(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			config.GlobalModelxdOptions = opts
+
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
 			var g run.Group
 			term := make(chan os.Signal, 1)
 			signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+			termctx, termcancel := context.WithCancel(ctx)
 			g.Add(func() error {
+				defer signal.Stop(term)
 				select {
 				case <-term:
 					mainLogger.Info("Received SIGTERM, exiting gracefully...")
-				case <-ctx.Done():
+				case <-termctx.Done():
 				}
 
 				return nil
-			}, func(error) {})
+			}, func(error) {
+				// stop waiting for a signal once another actor returned
+				termcancel()
+			})
+			reloadctx, reloadcancel := context.WithCancel(ctx)
+			g.Add(func() error {
+				return ReloadOptions(reloadctx, cmd.Flags(), opts)
+			}, func(error) {
+				reloadcancel()
+			})
 
-			return Run(ctx, g, config.GlobalModelxdOptions)
+			return Run(ctx, g, opts)
 		},
 	}
 
-	flags := cmd.Flags()
-	flags.StringVar(&config.GlobalModelxdOptions.Listen, "listen", config.GlobalModelxdOptions.Listen, "listen address.")
-	flags.StringVar(&config.GlobalModelxdOptions.TLS.CAFile, "tls-ca", config.GlobalModelxdOptions.TLS.CAFile, "tls ca file.")
-	flags.StringVar(&config.GlobalModelxdOptions.TLS.CertFile, "tls-cert", config.GlobalModelxdOptions.TLS.CertFile, "tls cert file.")
-	flags.StringVar(&config.GlobalModelxdOptions.TLS.KeyFile, "tls-key", config.GlobalModelxdOptions.TLS.KeyFile, "tls key file.")
-	flags.StringVar(&config.GlobalModelxdOptions.S3.Buket, "s3-bucket", config.GlobalModelxdOptions.S3.Buket, "s3 bucket.")
-	flags.StringVar(&config.GlobalModelxdOptions.S3.URL, "s3-url", config.GlobalModelxdOptions.S3.URL, "s3 url.")
-	flags.StringVar(&config.GlobalModelxdOptions.S3.AccessKey, "s3-access-key", config.GlobalModelxdOptions.S3.AccessKey, "s3 access key.")
-	flags.StringVar(&config.GlobalModelxdOptions.S3.SecretKey, "s3-secret-key", config.GlobalModelxdOptions.S3.SecretKey, "s3 secret key.")
-	flags.DurationVar(&config.GlobalModelxdOptions.S3.PresignExpire, "s3-presign-expire", config.GlobalModelxdOptions.S3.PresignExpire, "s3 presign expire.")
-	flags.StringVar(&config.GlobalModelxdOptions.S3.Region, "s3-region", config.GlobalModelxdOptions.S3.Region, "s3 region.")
-	flags.StringVar(&config.GlobalModelxdOptions.OIDC.Issuer, "oidc-issuer", config.GlobalModelxdOptions.OIDC.Issuer, "oidc issuer.")
-	flags.StringVar(&config.GlobalModelxdOptions.Local.Basepath, "path", config.GlobalModelxdOptions.Local.Basepath, "local metadate store path.")
-	flags.BoolVar(&config.GlobalModelxdOptions.EnableRedirect, "enable-redirect", false, "enable blob storage redirect.")
-	flags.BoolVar(&config.GlobalModelxdOptions.EnableMetrics, "enable-metrics", true, "enable metrics api.")
-
+	cmd.Flags().StringVar(&configFile, "config", "", "yaml file of the options, overridden by the MODELXD_* environment variables and the flags.")
+	AddFlags(cmd.Flags(), config.GlobalModelxdOptions)
+	cmd.AddCommand(NewConfigCmd())
 	return cmd
 }
 
+// AddFlags binds the flags to opts, the current values of opts are the defaults.
+func AddFlags(flags *pflag.FlagSet, opts *config.Options) {
+	flags.StringVar(&opts.Listen, "listen", opts.Listen, "listen address.")
+	flags.StringVar(&opts.TLS.CAFile, "tls-ca", opts.TLS.CAFile, "tls ca file.")
+	flags.StringVar(&opts.TLS.CertFile, "tls-cert", opts.TLS.CertFile, "tls cert file.")
+	flags.StringVar(&opts.TLS.KeyFile, "tls-key", opts.TLS.KeyFile, "tls key file.")
+	flags.StringVar(&opts.TLS.ClientAuth, "tls-client-auth", opts.TLS.ClientAuth, "tls client auth, one of none, request, require, verify-if-given and require-and-verify, require-and-verify if tls-ca is set by default.")
+	flags.StringVar(&opts.TLS.ClientUsername, "tls-client-username", opts.TLS.ClientUsername, "field of the verified client certificate used as the username, one of cn, dns, email and uri.")
+	flags.StringVar(&opts.S3.Buket, "s3-bucket", opts.S3.Buket, "s3 bucket.")
+	flags.StringVar(&opts.S3.URL, "s3-url", opts.S3.URL, "s3 url.")
+	flags.StringVar(&opts.S3.AccessKey, "s3-access-key", opts.S3.AccessKey, "s3 access key.")
+	flags.StringVar(&opts.S3.SecretKey, "s3-secret-key", opts.S3.SecretKey, "s3 secret key.")
+	flags.DurationVar(&opts.S3.PresignExpire, "s3-presign-expire", opts.S3.PresignExpire, "s3 presign expire.")
+	flags.StringVar(&opts.S3.Region, "s3-region", opts.S3.Region, "s3 region.")
+	flags.StringVar(&opts.OIDC.Issuer, "oidc-issuer", opts.OIDC.Issuer, "oidc issuer.")
+	flags.StringSliceVar(&opts.OIDC.ExtraIssuers, "oidc-extra-issuers", opts.OIDC.ExtraIssuers, "more trusted oidc issuers, a token is verified by the issuer in its iss claim.")
+	flags.StringSliceVar(&opts.OIDC.Audiences, "oidc-audiences", opts.OIDC.Audiences, "audiences accepted in the id tokens, any audience is accepted if empty.")
+	flags.StringToStringVar(&opts.OIDC.RequiredClaims, "oidc-required-claims", opts.OIDC.RequiredClaims, "claims the id tokens must have with the value, such as email_verified=true.")
+	flags.DurationVar(&opts.OIDC.RefreshInterval, "oidc-refresh-interval", opts.OIDC.RefreshInterval, "how often the discovery and the key set of the oidc issuers are refreshed.")
+	flags.StringVar(&opts.OIDC.GroupsClaim, "oidc-groups-claim", opts.OIDC.GroupsClaim, "claim of the id token listing the groups of the user.")
+	flags.StringVar(&opts.RBAC.ConfigFile, "rbac-config", opts.RBAC.ConfigFile, "yaml file of the role bindings authorizing the users per project and repository.")
+	flags.StringVar(&opts.Auth.WebhookURL, "auth-webhook-url", opts.Auth.WebhookURL, "url reviewing the bearer tokens, enables the token authentication webhook.")
+	flags.DurationVar(&opts.Auth.WebhookTimeout, "auth-webhook-timeout", opts.Auth.WebhookTimeout, "timeout of a token review.")
+	flags.DurationVar(&opts.Auth.WebhookCacheTTL, "auth-webhook-cache-ttl", opts.Auth.WebhookCacheTTL, "how long a token review is cached.")
+	flags.StringVar(&opts.Auth.HtpasswdFile, "auth-htpasswd-file", opts.Auth.HtpasswdFile, "htpasswd file of bcrypt passwords authenticating basic auth, reloaded once modified.")
+	flags.StringVar(&opts.Auth.TokenFile, "auth-token-file", opts.Auth.TokenFile, "yaml file of static bearer tokens, reloaded once modified.")
+	flags.StringSliceVar(&opts.Auth.AnonymousProjects, "anonymous-pull-projects", opts.Auth.AnonymousProjects, "globs of the projects anyone may pull from without credentials.")
+	flags.StringVar(&opts.RateLimit.ConfigFile, "ratelimit-config", opts.RateLimit.ConfigFile, "yaml file of the request rate limits per user, client ip and route class.")
+	flags.StringVar(&opts.Audit.File, "audit-log-file", opts.Audit.File, "JSONL file the audit records of the mutating requests are appended to, enables the audit.")
+	flags.IntVar(&opts.Audit.MaxSizeMB, "audit-log-max-size", opts.Audit.MaxSizeMB, "size in megabytes the audit log is rotated at.")
+	flags.IntVar(&opts.Audit.MaxBackups, "audit-log-max-backups", opts.Audit.MaxBackups, "number of the rotated audit logs kept.")
+	flags.StringVar(&opts.LogLevel, "log-level", opts.LogLevel, "log level, one of debug, info, warn and error.")
+	flags.StringVar(&opts.Local.Basepath, "path", opts.Local.Basepath, "local metadate store path.")
+	flags.BoolVar(&opts.EnableRedirect, "enable-redirect", opts.EnableRedirect, "enable blob storage redirect.")
+	flags.BoolVar(&opts.EnableMetrics, "enable-metrics", opts.EnableMetrics, "enable metrics api.")
+	flags.DurationVar(&opts.GC.Interval, "gc-interval", opts.GC.Interval, "interval of scheduled garbage collect, 0 disables it.")
+	flags.DurationVar(&opts.GC.MinBlobAge, "gc-min-blob-age", opts.GC.MinBlobAge, "minimum age of an unreferenced blob before garbage collect removes it.")
+	flags.BoolVar(&opts.GC.DryRun, "gc-dry-run", opts.GC.DryRun, "scheduled garbage collect only reports what it would remove.")
+	flags.DurationVar(&opts.GC.UploadTTL, "gc-upload-ttl", opts.GC.UploadTTL, "idle time after which garbage collect removes an upload session, 0 keeps them.")
+	flags.StringVar(&opts.Retention.ConfigFile, "retention-config", opts.Retention.ConfigFile, "yaml file of version retention rules.")
+	flags.DurationVar(&opts.Retention.Interval, "retention-interval", opts.Retention.Interval, "interval of scheduled retention, 0 disables it.")
+	flags.BoolVar(&opts.Retention.DryRun, "retention-dry-run", opts.Retention.DryRun, "scheduled retention only reports the versions it would prune.")
+	flags.StringVar(&opts.Quota.ConfigFile, "quota-config", opts.Quota.ConfigFile, "yaml file of project and repository quotas.")
+	flags.StringVar(&opts.Replication.ConfigFile, "replication-config", opts.Replication.ConfigFile, "yaml file of replication rules to other registries.")
+	flags.StringVar(&opts.Webhook.ConfigFile, "webhook-config", opts.Webhook.ConfigFile, "yaml file of webhook endpoints receiving the registry events.")
+	flags.StringVar(&opts.Webhook.QueueDir, "webhook-queue-dir", opts.Webhook.QueueDir, "directory keeping the events not delivered to the webhooks yet.")
+	flags.StringVar(&opts.Proxy.Upstream, "proxy-upstream", opts.Proxy.Upstream, "url of an upstream modelxd to pull through, enables the proxy mode.")
+	flags.StringVar(&opts.Proxy.Username, "proxy-username", opts.Proxy.Username, "basic auth username of the upstream.")
+	flags.StringVar(&opts.Proxy.Password, "proxy-password", opts.Proxy.Password, "basic auth password of the upstream.")
+	flags.StringVar(&opts.Proxy.Token, "proxy-token", opts.Proxy.Token, "bearer token of the upstream.")
+	flags.DurationVar(&opts.Proxy.ManifestTTL, "proxy-manifest-ttl", opts.Proxy.ManifestTTL, "how long a cached manifest is served before it is fetched from the upstream again.")
+	flags.DurationVar(&opts.Shutdown.Delay, "shutdown-delay", opts.Shutdown.Delay, "delay between failing the readiness check and closing the listener on shutdown.")
+	flags.DurationVar(&opts.Shutdown.Timeout, "shutdown-timeout", opts.Shutdown.Timeout, "how long the requests and the scheduled runs in progress have to finish on shutdown.")
+	flags.BoolVar(&opts.Readiness.WriteProbe, "readiness-write-probe", opts.Readiness.WriteProbe, "readiness check also writes and removes a probe object in the storage.")
+	flags.DurationVar(&opts.Readiness.CacheTTL, "readiness-cache-ttl", opts.Readiness.CacheTTL, "how long a readiness check result is served before the storage is checked again.")
+	flags.DurationVar(&opts.Readiness.Timeout, "readiness-timeout", opts.Readiness.Timeout, "timeout of a storage readiness check.")
+	flags.BoolVar(&opts.EnableGlobalBlobs, "enable-global-blobs", opts.EnableGlobalBlobs, "store blobs once in a global pool shared by all repositories.")
+}
+
 func Run(ctx context.Context, g run.Group, opts *config.Options) error {
 	var err error
 	model.GlobalRegistry, err = NewRegistryConfig(ctx, opts)
@@ -113,6 +184,14 @@ func Run(ctx context.Context, g run.Group, opts *config.Options) error {
 		return err
 	}
 
+	if model.GlobalRegistry.Audit != nil {
+		middleware.SetAuditLog(model.GlobalRegistry.Audit)
+	}
+	if err := ApplyRuntimeOptions(opts); err != nil {
+		return err
+	}
+	SetReadinessChecks(model.GlobalRegistry.Storage, opts.Readiness)
+
 	mainLogger.Info("Starting server")
 
 	goruntime.SetMaxProcs(mainLogger)
@@ -121,29 +200,85 @@ func Run(ctx context.Context, g run.Group, opts *config.Options) error {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	router.Router(r)
+	inflight := &inflightHandler{handler: r}
 	srv := http.Server{
 		Addr:              config.GlobalModelxdOptions.Listen,
 		WriteTimeout:      time.Second * 1500,
 		ReadHeaderTimeout: time.Second * 60,
 		ReadTimeout:       time.Second * 1500,
 		IdleTimeout:       time.Second * 60,
-		Handler:           r,
+		Handler:           inflight,
 		MaxHeaderBytes:    1 << 20,
 	}
 
+	usetls := opts.TLS.CertFile != "" && opts.TLS.KeyFile != ""
+	if usetls {
+		if srv.TLSConfig, err = auth.NewServerTLSConfig(opts.TLS); err != nil {
+			return err
+		}
+	}
+
+	drained := make(chan struct{})
 	g.Add(func() error {
 		mainLogger.Info("Starting web server", logging.Any("listenAddress", config.GlobalModelxdOptions.Listen))
-		if config.GlobalModelxdOptions.TLS.CertFile != "" && config.GlobalModelxdOptions.TLS.KeyFile != "" {
-			mainLogger.Info("registry listening", logging.Any("https", config.GlobalModelxdOptions.Listen))
-			return srv.ListenAndServeTLS(config.GlobalModelxdOptions.TLS.CertFile, config.GlobalModelxdOptions.TLS.KeyFile)
+		var err error
+		if usetls {
+			mainLogger.Info("registry listening", logging.Any("https", config.GlobalModelxdOptions.Listen), logging.Any("clientCA", opts.TLS.CAFile))
+			// the certificates are in srv.TLSConfig
+			err = srv.ListenAndServeTLS("", "")
 		} else {
 			mainLogger.Info("registry listening", logging.Any("http", opts.Listen))
-			return srv.ListenAndServe()
+			err = srv.ListenAndServe()
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			<-drained
+			return nil
+		}
+		return err
+	}, func(err error) {
+		defer close(drained)
+		// drain only when stopped, not when another actor failed
+		if err != nil {
+			srv.Close()
+			return
 		}
-	}, func(error) {
-		srv.Close()
+		GracefulShutdown(&srv, inflight, opts.Shutdown)
 	})
 
+	if model.GlobalRegistry.GC.Interval > 0 {
+		gcctx, gccancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			return model.GlobalRegistry.GC.Run(gcctx)
+		}, func(error) {
+			gccancel()
+		})
+	}
+	// the rules may be set by a reload later
+	if model.GlobalRegistry.Retention.Interval > 0 {
+		retentionctx, retentioncancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			return model.GlobalRegistry.Retention.Run(retentionctx)
+		}, func(error) {
+			retentioncancel()
+		})
+	}
+	if len(model.GlobalRegistry.Replication.Rules) > 0 {
+		replicationctx, replicationcancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			return model.GlobalRegistry.Replication.Run(replicationctx)
+		}, func(error) {
+			replicationcancel()
+		})
+	}
+	for _, webhook := range model.GlobalRegistry.Webhooks {
+		webhookctx, webhookcancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			return webhook.Run(webhookctx)
+		}, func(error) {
+			webhookcancel()
+		})
+	}
+
 	if err := g.Run(); err != nil {
 		mainLogger.Error("Failed to run", logging.Error(err))
 		os.Exit(1)
@@ -153,15 +288,16 @@ func Run(ctx context.Context, g run.Group, opts *config.Options) error {
 }
 
 func NewRegistryConfig(ctx context.Context, opt *config.Options) (*model.Registry, error) {
-	mainLogger.Info("prepare registry", logging.Any("options", opt))
+	mainLogger.Info("prepare registry", logging.Any("options", opt.Redacted()))
 	var registryStore registry.RegistryInterface
+	var storage registry.FSProvider
 	if registryStore == nil && opt.S3 != nil && opt.S3.URL != "" {
 		mainLogger.Info("start modelx registry with S3 type")
 		s3store, err := registry.NewS3RegistryStore(ctx, opt)
 		if err != nil {
 			return nil, err
 		}
-		registryStore = s3store
+		registryStore, storage = s3store, s3store.FS()
 	}
 	if registryStore == nil {
 		mainLogger.Info("start modelx registry with LocalFS type")
@@ -169,10 +305,74 @@ func NewRegistryConfig(ctx context.Context, opt *config.Options) (*model.Registr
 		if err != nil {
 			return nil, err
 		}
-		registryStore = fsstore
+		registryStore, storage = fsstore, fsstore.FS
 	}
 	if registryStore == nil {
 		return nil, fmt.Errorf("no storage backend set")
 	}
-	return &model.Registry{Store: registryStore}, nil
+	// the upstream cache is written under the quotas and the events
+	cacheStore := registryStore
+	if opt.Quota.ConfigFile != "" {
+		quotas, err := config.LoadQuotaConfig(opt.Quota.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		mainLogger.Info("enforce storage quotas", logging.Any("file", opt.Quota.ConfigFile))
+		registryStore = registry.NewQuotaStore(registryStore, quotas)
+	}
+	bus := event.NewBus()
+	webhooks := []*event.WebhookSink{}
+	if opt.Webhook.ConfigFile != "" {
+		webhookconfig, err := config.LoadWebhookConfig(opt.Webhook.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, endpoint := range webhookconfig.Webhooks {
+			sink, err := event.NewWebhookSink(endpoint, opt.Webhook.QueueDir)
+			if err != nil {
+				return nil, err
+			}
+			bus.Subscribe(sink.Handle)
+			webhooks = append(webhooks, sink)
+		}
+		mainLogger.Info("send events to webhooks", logging.Any("file", opt.Webhook.ConfigFile), logging.Any("webhooks", len(webhooks)))
+	}
+	replicator := registry.NewReplicator(registryStore, nil)
+	if opt.Replication.ConfigFile != "" {
+		rules, err := config.LoadReplicationConfig(opt.Replication.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		mainLogger.Info("replicate to other registries", logging.Any("file", opt.Replication.ConfigFile), logging.Any("rules", len(rules.Rules)))
+		replicator = registry.NewReplicator(registryStore, rules.Rules)
+		bus.Subscribe(replicator.HandleEvent)
+	}
+	registryStore = registry.NewEventStore(registryStore, bus)
+	// maintenance only works on the local store
+	localStore := registryStore
+	if opt.Proxy.Upstream != "" {
+		mainLogger.Info("pull through upstream registry", logging.Any("upstream", opt.Proxy.Upstream), logging.Any("manifestTTL", opt.Proxy.ManifestTTL))
+		upstream := client.NewRegistryClient(strings.TrimSuffix(opt.Proxy.Upstream, "/"), client.Authorization(opt.Proxy.Token, opt.Proxy.Username, opt.Proxy.Password))
+		registryStore = registry.NewProxyStore(registryStore, cacheStore, upstream, opt.Proxy.ManifestTTL)
+	}
+	gc := &registry.GCScheduler{
+		Store:    localStore,
+		Interval: opt.GC.Interval,
+		Options:  registry.GCOptions{MinBlobAge: opt.GC.MinBlobAge, DryRun: opt.GC.DryRun, UploadTTL: opt.GC.UploadTTL},
+	}
+	retention := &registry.RetentionScheduler{
+		Store:    localStore,
+		Interval: opt.Retention.Interval,
+		Options:  registry.RetentionOptions{DryRun: opt.Retention.DryRun, GC: registry.GCOptions{MinBlobAge: opt.GC.MinBlobAge, UploadTTL: opt.GC.UploadTTL}},
+	}
+	var auditlog *audit.FileLog
+	if opt.Audit.File != "" {
+		l, err := audit.NewFileLog(opt.Audit.File, int64(opt.Audit.MaxSizeMB)<<20, opt.Audit.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		mainLogger.Info("audit mutating requests", logging.Any("file", opt.Audit.File))
+		auditlog = l
+	}
+	return &model.Registry{Store: registryStore, Storage: storage, GC: gc, Retention: retention, Replication: replicator, Webhooks: webhooks, Audit: auditlog}, nil
 }
@@ -0,0 +1,44 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+
+	logging "github.com/kubeservice-stack/common/pkg/logger"
+
+	"kubegems.io/modelx/pkg/config"
+	healthz "kubegems.io/modelx/pkg/health"
+	"kubegems.io/modelx/pkg/registry"
+)
+
+// SetReadinessChecks makes the readiness check fail while the storage can not be reached, so no pulls are routed to the server.
+func SetReadinessChecks(storage registry.FSProvider, opts *config.ReadinessOptions) {
+	checks := []healthz.ReadinessCheck{
+		{Name: "storage-stat", Check: registry.StorageStatCheck(storage)},
+	}
+	if opts.WriteProbe {
+		// the replicas sharing the storage write their own probe objects
+		name, err := os.Hostname()
+		if err != nil {
+			name = registry.NewUploadID()
+		}
+		checks = append(checks, healthz.ReadinessCheck{Name: "storage-write", Check: registry.StorageWriteCheck(storage, name)})
+	}
+	mainLogger.Info("check the storage on readiness", logging.Any("writeProbe", opts.WriteProbe), logging.Any("cacheTTL", opts.CacheTTL.String()))
+	healthz.SetReadinessChecks(checks, opts.CacheTTL, opts.Timeout)
+}
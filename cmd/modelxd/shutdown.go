@@ -0,0 +1,104 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	logging "github.com/kubeservice-stack/common/pkg/logger"
+
+	"kubegems.io/modelx/pkg/config"
+	healthz "kubegems.io/modelx/pkg/health"
+	"kubegems.io/modelx/pkg/model"
+)
+
+// how long the handlers cut off at the shutdown deadline have to roll back their writes
+const shutdownRollbackTimeout = 10 * time.Second
+
+// inflightHandler counts the requests in progress, including the ones whose connection is closed.
+type inflightHandler struct {
+	handler http.Handler
+	wg      sync.WaitGroup
+}
+
+func (h *inflightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.wg.Add(1)
+	defer h.wg.Done()
+	h.handler.ServeHTTP(w, r)
+}
+
+// wait waits for the requests in progress to return, or for ctx to be done.
+func (h *inflightHandler) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GracefulShutdown fails the readiness check, waits for the load balancers to notice, then stops accepting
+// connections and lets the requests and the scheduled runs in progress finish until the timeout.
+// The requests still in progress are then cut off, they roll back their partial writes before it returns.
+func GracefulShutdown(srv *http.Server, inflight *inflightHandler, opts *config.ShutdownOptions) {
+	mainLogger.Info("shutting down, draining requests", logging.Any("delay", opts.Delay.String()), logging.Any("timeout", opts.Timeout.String()))
+	healthz.SetDraining(true)
+	time.Sleep(opts.Delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	wg := sync.WaitGroup{}
+	shutdown := func(name string, fn func(ctx context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(ctx); err != nil {
+				mainLogger.Warn("shutdown timed out", logging.String("name", name), logging.Error(err))
+			}
+		}()
+	}
+	shutdown("server", srv.Shutdown)
+	// the schedulers Run started
+	if model.GlobalRegistry.GC.Interval > 0 {
+		shutdown("garbage collect scheduler", model.GlobalRegistry.GC.Shutdown)
+	}
+	if model.GlobalRegistry.Retention.Interval > 0 {
+		shutdown("retention scheduler", model.GlobalRegistry.Retention.Shutdown)
+	}
+	wg.Wait()
+
+	if ctx.Err() == nil {
+		mainLogger.Info("requests drained")
+		return
+	}
+	// cut off the requests left, their handlers fail on the closed connections
+	_ = srv.Close()
+	rollbackctx, rollbackcancel := context.WithTimeout(context.Background(), shutdownRollbackTimeout)
+	defer rollbackcancel()
+	if err := inflight.wait(rollbackctx); errors.Is(err, context.DeadlineExceeded) {
+		mainLogger.Warn("requests still in progress after the shutdown", logging.Error(err))
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+
+	// usernames of the records of the deletions modelxd makes on its own
+	UsernameRetention   = "system:retention"
+	UsernameGC          = "system:gc"
+	UsernameReplication = "system:replication"
+
+	DefaultQueryLimit = 100
+	MaxQueryLimit     = 1000
+
+	// rotated files are named by the time of the rotation, so they sort in order.
+	rotatedTimeFormat = "20060102T150405.000000000"
+)
+
+// Record is a mutating request to the registry, or a deletion modelxd made on its own
+// such as a scheduled retention, which has no client, request or status.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	// Username is empty for anonymous requests.
+	Username  string `json:"username,omitempty"`
+	ClientIP  string `json:"clientIP,omitempty"`
+	RequestID string `json:"requestID,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+	// Repository is the target, empty for global operations such as garbage collect of all repositories.
+	Repository string `json:"repository,omitempty"`
+	Reference  string `json:"reference,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	// Source is the repository the blobs were copied from.
+	Source string `json:"source,omitempty"`
+	// Target is the registry a replicated deletion was sent to.
+	Target string `json:"target,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Result string `json:"result"`
+}
+
+// Query filters the records, the zero value matches all.
+type Query struct {
+	Repository string
+	Username   string
+	Since      time.Time
+	Until      time.Time
+	// Limit is the number of the most recent records returned.
+	Limit int
+}
+
+func (q Query) Match(r Record) bool {
+	if q.Repository != "" && r.Repository != q.Repository && r.Source != q.Repository {
+		return false
+	}
+	if q.Username != "" && r.Username != q.Username {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// FileLog appends the records to a JSONL file, the file is rotated once it reaches MaxSize
+// and only MaxBackups rotated files are kept.
+type FileLog struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewFileLog(path string, maxSize int64, maxBackups int) (*FileLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	l := &FileLog{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *FileLog) Append(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Query returns the matching records, the most recent first.
+func (l *FileLog) Query(q Query) ([]Record, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultQueryLimit
+	}
+	q.Limit = min(q.Limit, MaxQueryLimit)
+	l.mu.Lock()
+	files, err := l.backups()
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, l.Path)
+	records := []Record{}
+	// from the most recent file, until there are enough records
+	for i := len(files) - 1; i >= 0 && len(records) < q.Limit; i-- {
+		matched, err := readRecords(files[i], q, q.Limit-len(records))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		slices.Reverse(matched)
+		records = append(records, matched...)
+	}
+	if len(records) > q.Limit {
+		records = records[:q.Limit]
+	}
+	return records, nil
+}
+
+func (l *FileLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *FileLog) open() error {
+	file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *FileLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	rotated := l.Path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(l.Path, rotated); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	backups, err := l.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > l.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backups returns the rotated files, the oldest first.
+func (l *FileLog) backups() ([]string, error) {
+	backups, err := filepath.Glob(l.Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// readRecords returns the last limit matching records of the file.
+func readRecords(file string, q Query, limit int) ([]Record, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := []Record{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		record := Record{}
+		// a line cut by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if q.Match(record) {
+			records = append(records, record)
+		}
+		// only the most recent ones are kept
+		if len(records) >= 2*limit {
+			records = slices.Delete(records, 0, len(records)-limit)
+		}
+	}
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", file, err)
+	}
+	return records, nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLog(t *testing.T) {
+	assert := assert.New(t)
+	file := filepath.Join(t.TempDir(), "audit", "audit.log")
+	// about three records per file
+	l, err := NewFileLog(file, 600, 2)
+	assert.NoError(err)
+	defer l.Close()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		record := Record{
+			Time:       start.Add(time.Duration(i) * time.Hour),
+			Operation:  "PutManifest",
+			Username:   []string{"alice", "bob"}[i%2],
+			ClientIP:   "10.0.0.1",
+			Repository: "library/m",
+			Reference:  "v1",
+			Status:     201,
+			Result:     ResultSuccess,
+		}
+		if i%3 == 0 {
+			record.Operation, record.Repository = "DeleteIndex", "prod/ranker"
+		}
+		assert.NoError(l.Append(record))
+	}
+	backups, err := l.backups()
+	assert.NoError(err)
+	assert.Len(backups, 2)
+
+	records, err := l.Query(Query{})
+	assert.NoError(err)
+	assert.NotEmpty(records)
+	assert.Less(len(records), 12)
+	// the most recent first
+	assert.Equal(start.Add(11*time.Hour), records[0].Time)
+
+	records, err = l.Query(Query{Repository: "prod/ranker", Username: "bob"})
+	assert.NoError(err)
+	for _, record := range records {
+		assert.Equal("prod/ranker", record.Repository)
+		assert.Equal("bob", record.Username)
+	}
+	assert.Equal(start.Add(9*time.Hour), records[0].Time)
+
+	records, err = l.Query(Query{Since: start.Add(8 * time.Hour), Until: start.Add(10 * time.Hour), Limit: 1})
+	assert.NoError(err)
+	assert.Len(records, 1)
+	assert.Equal(start.Add(9*time.Hour), records[0].Time)
+}
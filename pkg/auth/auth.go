@@ -0,0 +1,78 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+const (
+	// ScopePull allows reading, GET and HEAD requests.
+	ScopePull = "pull"
+	// ScopePush allows writing.
+	ScopePush = "push"
+	// ScopeDelete allows deleting.
+	ScopeDelete = "delete"
+)
+
+// ErrInvalidToken is returned when an authenticator rejects the credentials.
+var ErrInvalidToken = errors.New("invalid token")
+
+// UserInfo is the identity of an authenticated request.
+type UserInfo struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+	// Scopes limits what the credentials allow, empty allows everything.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// HasScope reports whether the credentials allow scope.
+func (u *UserInfo) HasScope(scope string) bool {
+	return len(u.Scopes) == 0 || slices.Contains(u.Scopes, scope)
+}
+
+// TokenAuthenticator authenticates a bearer token, ErrInvalidToken is returned if it is rejected.
+type TokenAuthenticator interface {
+	AuthenticateToken(ctx context.Context, token string) (*UserInfo, error)
+}
+
+// BasicAuthenticator authenticates HTTP basic auth, ErrInvalidToken is returned if it is rejected.
+type BasicAuthenticator interface {
+	AuthenticateBasic(ctx context.Context, username, password string) (*UserInfo, error)
+}
+
+// TokenAuthenticators tries each authenticator in order, the first one accepting the token wins.
+type TokenAuthenticators []TokenAuthenticator
+
+func (a TokenAuthenticators) AuthenticateToken(ctx context.Context, token string) (*UserInfo, error) {
+	var errs []error
+	for _, authenticator := range a {
+		user, err := authenticator.AuthenticateToken(ctx, token)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, ErrInvalidToken) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrInvalidToken
+}
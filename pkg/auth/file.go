@@ -0,0 +1,79 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	logging "github.com/kubeservice-stack/common/pkg/logger"
+)
+
+var authLogger = logging.GetLogger("pkg/auth", "auth")
+
+// reloadingFile keeps the content parsed from a file, it is parsed again once the file is modified.
+// A modification failing to parse is logged and the previous content kept.
+type reloadingFile[T any] struct {
+	path  string
+	parse func(raw []byte) (T, error)
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	value   T
+}
+
+func newReloadingFile[T any](path string, parse func(raw []byte) (T, error)) (*reloadingFile[T], error) {
+	f := &reloadingFile[T]{path: path, parse: parse}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Get returns the content of the file.
+func (f *reloadingFile[T]) Get() T {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		authLogger.Error("reload file, keep the previous content", logging.Any("file", f.path), logging.Error(err))
+	}
+	return f.value
+}
+
+func (f *reloadingFile[T]) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	raw, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	value, err := f.parse(raw)
+	// a broken file is only parsed again once modified
+	f.modTime, f.size = info.ModTime(), info.Size()
+	if err != nil {
+		return err
+	}
+	f.value = value
+	return nil
+}
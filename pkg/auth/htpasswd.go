@@ -0,0 +1,76 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAuthenticator authenticates HTTP basic auth with an htpasswd file of bcrypt passwords,
+// as created by "htpasswd -B". The file is reloaded once modified.
+type HtpasswdAuthenticator struct {
+	file *reloadingFile[map[string][]byte]
+}
+
+var _ BasicAuthenticator = &HtpasswdAuthenticator{}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	file, err := newReloadingFile(path, ParseHtpasswd)
+	if err != nil {
+		return nil, fmt.Errorf("htpasswd %s: %w", path, err)
+	}
+	return &HtpasswdAuthenticator{file: file}, nil
+}
+
+func (a *HtpasswdAuthenticator) AuthenticateBasic(ctx context.Context, username, password string) (*UserInfo, error) {
+	hash, ok := a.file.Get()[username]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, ErrInvalidToken
+	}
+	return &UserInfo{Username: username}, nil
+}
+
+// ParseHtpasswd returns the bcrypt hashes keyed by the users,
+// blank lines and lines starting with "#" are skipped.
+func ParseHtpasswd(raw []byte) (map[string][]byte, error) {
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %s: only bcrypt passwords are supported", line, username)
+		}
+		users[username] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	logging "github.com/kubeservice-stack/common/pkg/logger"
+)
+
+const (
+	// a failed discovery is not tried again before this
+	oidcDiscoveryRetryInterval = 10 * time.Second
+	oidcDiscoveryTimeout       = 10 * time.Second
+)
+
+// OIDCConfig configures the checks of the id tokens besides the signature and the expiry.
+type OIDCConfig struct {
+	// Issuers are trusted, a token is verified with the keys of its "iss".
+	Issuers []string
+	// Audiences accepted in "aud", any audience is accepted if empty.
+	Audiences []string
+	// RequiredClaims must be in the token with the value, or contain it if the claim is a list.
+	RequiredClaims map[string]string
+	// GroupsClaim lists the groups of the user.
+	GroupsClaim string
+	// RefreshInterval is how often the discovery and the key set are refreshed.
+	RefreshInterval time.Duration
+}
+
+// OIDCAuthenticator verifies id tokens with long-lived verifiers, one per issuer.
+// A verifier caches the key set of its issuer, keys it does not know are fetched on demand,
+// and it is rebuilt every RefreshInterval. While an issuer is unreachable the previous verifier is kept.
+type OIDCAuthenticator struct {
+	config  OIDCConfig
+	issuers map[string]*oidcIssuer
+}
+
+type oidcIssuer struct {
+	url     string
+	client  *http.Client
+	refresh time.Duration
+
+	mu          sync.Mutex
+	verifier    *oidc.IDTokenVerifier
+	discoveryAt time.Time
+	attemptAt   time.Time
+	refreshing  bool
+}
+
+var _ TokenAuthenticator = &OIDCAuthenticator{}
+
+// NewOIDCAuthenticator discovers the issuers, an issuer failing is logged and discovered again on demand.
+func NewOIDCAuthenticator(config OIDCConfig) *OIDCAuthenticator {
+	a := &OIDCAuthenticator{config: config, issuers: map[string]*oidcIssuer{}}
+	client := &http.Client{Timeout: oidcDiscoveryTimeout}
+	for _, url := range config.Issuers {
+		issuer := &oidcIssuer{url: url, client: client, refresh: config.RefreshInterval}
+		if _, err := issuer.getVerifier(); err != nil {
+			authLogger.Warn("discover oidc issuer", logging.Any("issuer", url), logging.Error(err))
+		}
+		a.issuers[strings.TrimSuffix(url, "/")] = issuer
+	}
+	return a
+}
+
+func (a *OIDCAuthenticator) AuthenticateToken(ctx context.Context, token string) (*UserInfo, error) {
+	iss, err := unverifiedIssuer(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	issuer, ok := a.issuers[strings.TrimSuffix(iss, "/")]
+	if !ok {
+		return nil, fmt.Errorf("%w: issuer %s is not trusted", ErrInvalidToken, iss)
+	}
+	verifier, err := issuer.getVerifier()
+	if err != nil {
+		return nil, err
+	}
+	idtoken, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if len(a.config.Audiences) > 0 && !slices.ContainsFunc(idtoken.Audience, func(aud string) bool {
+		return slices.Contains(a.config.Audiences, aud)
+	}) {
+		return nil, fmt.Errorf("%w: audience %v is not accepted", ErrInvalidToken, idtoken.Audience)
+	}
+	claims := map[string]any{}
+	if err := idtoken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	for claim, value := range a.config.RequiredClaims {
+		if !claimContains(claims[claim], value) {
+			return nil, fmt.Errorf("%w: claim %s must be %s", ErrInvalidToken, claim, value)
+		}
+	}
+	user := &UserInfo{Username: idtoken.Subject}
+	if a.config.GroupsClaim != "" {
+		user.Groups = claimStrings(claims[a.config.GroupsClaim])
+	}
+	return user, nil
+}
+
+// getVerifier returns the verifier, the issuer is discovered first if there is none yet.
+// A due refresh runs in the background, the previous verifier is used meanwhile.
+func (i *oidcIssuer) getVerifier() (*oidc.IDTokenVerifier, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	retry := now.Sub(i.attemptAt) >= oidcDiscoveryRetryInterval
+	if i.verifier != nil {
+		if retry && !i.refreshing && i.refresh > 0 && now.Sub(i.discoveryAt) > i.refresh {
+			i.attemptAt, i.refreshing = now, true
+			go func() {
+				verifier, err := i.discover()
+				i.mu.Lock()
+				defer i.mu.Unlock()
+				i.refreshing = false
+				if err != nil {
+					authLogger.Warn("refresh oidc issuer, keep the previous keys", logging.Any("issuer", i.url), logging.Error(err))
+					return
+				}
+				i.verifier, i.discoveryAt = verifier, time.Now()
+			}()
+		}
+		return i.verifier, nil
+	}
+	if !retry {
+		return nil, fmt.Errorf("oidc issuer %s is unavailable", i.url)
+	}
+	i.attemptAt = now
+	verifier, err := i.discover()
+	if err != nil {
+		return nil, err
+	}
+	i.verifier, i.discoveryAt = verifier, now
+	return verifier, nil
+}
+
+func (i *oidcIssuer) discover() (*oidc.IDTokenVerifier, error) {
+	// the key set keeps the context of the discovery to fetch the keys later
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), i.client), i.url)
+	if err != nil {
+		return nil, fmt.Errorf("oidc issuer %s: %w", i.url, err)
+	}
+	// the audiences are checked by the authenticator, as there may be several
+	return provider.Verifier(&oidc.Config{SkipClientIDCheck: true}), nil
+}
+
+// unverifiedIssuer returns the "iss" of a jwt, only to choose the keys to verify it with.
+func unverifiedIssuer(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed jwt")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed jwt payload: %w", err)
+	}
+	claims := struct {
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("malformed jwt payload: %w", err)
+	}
+	return claims.Issuer, nil
+}
+
+// claimContains reports whether the claim is the value, or contains it if the claim is a list.
+func claimContains(claim any, value string) bool {
+	if list, ok := claim.([]any); ok {
+		return slices.ContainsFunc(list, func(item any) bool { return claimContains(item, value) })
+	}
+	return claim != nil && fmt.Sprint(claim) == value
+}
+
+// claimStrings returns the strings of a claim, a list or a single string.
+func claimStrings(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if item, ok := item.(string); ok {
+				values = append(values, item)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"path"
+	"slices"
+	"strings"
+
+	"kubegems.io/modelx/pkg/config"
+)
+
+// RBACAuthorizer grants the roles of the bindings a user is subject of.
+type RBACAuthorizer struct {
+	Bindings []config.RoleBinding
+}
+
+func NewRBACAuthorizer(policy *config.RBACConfig) *RBACAuthorizer {
+	return &RBACAuthorizer{Bindings: policy.Bindings}
+}
+
+// Authorize reports whether user has role on the repository "project/name".
+// An empty name is the project itself, and an empty project is all the repositories.
+func (a *RBACAuthorizer) Authorize(user *UserInfo, role, project, name string) bool {
+	if user == nil {
+		return false
+	}
+	for _, binding := range a.Bindings {
+		if !config.RoleAllows(binding.Role, role) || !bindingSubject(binding, user) {
+			continue
+		}
+		for _, pattern := range binding.Repositories {
+			if matchRepository(pattern, project, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func bindingSubject(binding config.RoleBinding, user *UserInfo) bool {
+	if slices.Contains(binding.Users, user.Username) {
+		return true
+	}
+	for _, group := range user.Groups {
+		if slices.Contains(binding.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRepository matches a project pattern against the project,
+// and a "project/name" pattern against the repository, or only its project part against a project.
+func matchRepository(pattern, project, name string) bool {
+	if project == "" {
+		return pattern == config.RBACAllRepositories
+	}
+	projectpattern, namepattern, isrepository := strings.Cut(pattern, "/")
+	if !isrepository || name == "" {
+		matched, _ := path.Match(projectpattern, project)
+		return matched
+	}
+	matched, _ := path.Match(projectpattern+"/"+namepattern, project+"/"+name)
+	return matched
+}
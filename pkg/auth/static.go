@@ -0,0 +1,50 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+
+	"kubegems.io/modelx/pkg/config"
+)
+
+// StaticTokenAuthenticator authenticates the bearer tokens of a token file,
+// the file is reloaded once modified.
+type StaticTokenAuthenticator struct {
+	file *reloadingFile[*config.TokenFileConfig]
+}
+
+var _ TokenAuthenticator = &StaticTokenAuthenticator{}
+
+func NewStaticTokenAuthenticator(path string) (*StaticTokenAuthenticator, error) {
+	file, err := newReloadingFile(path, config.ParseTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("token file %s: %w", path, err)
+	}
+	return &StaticTokenAuthenticator{file: file}, nil
+}
+
+func (a *StaticTokenAuthenticator) AuthenticateToken(ctx context.Context, token string) (*UserInfo, error) {
+	for _, static := range a.file.Get().Tokens {
+		if subtle.ConstantTimeCompare([]byte(static.Token), []byte(token)) == 1 {
+			return &UserInfo{Username: static.Username, Groups: static.Groups, Scopes: static.Scopes}, nil
+		}
+	}
+	return nil, ErrInvalidToken
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	logging "github.com/kubeservice-stack/common/pkg/logger"
+
+	"kubegems.io/modelx/pkg/config"
+)
+
+// CertificateUser returns the user of the verified client certificate of the connection, nil if there is none.
+// The username is the field of the certificate, the organizations of the subject are the groups.
+func CertificateUser(state *tls.ConnectionState, field string) *UserInfo {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	username := ""
+	switch field {
+	case config.TLSClientUsernameDNS:
+		if len(cert.DNSNames) > 0 {
+			username = cert.DNSNames[0]
+		}
+	case config.TLSClientUsernameEmail:
+		if len(cert.EmailAddresses) > 0 {
+			username = cert.EmailAddresses[0]
+		}
+	case config.TLSClientUsernameURI:
+		if len(cert.URIs) > 0 {
+			username = cert.URIs[0].String()
+		}
+	default:
+		username = cert.Subject.CommonName
+	}
+	if username == "" {
+		return nil
+	}
+	return &UserInfo{Username: username, Groups: cert.Subject.Organization}
+}
+
+// NewServerTLSConfig returns the tls config serving the certificate and verifying the client certificates
+// of the options, the files are read again once modified. A modification failing to load keeps the previous config.
+func NewServerTLSConfig(options *config.TLSOptions) (*tls.Config, error) {
+	clientAuth, err := options.ClientAuthType()
+	if err != nil {
+		return nil, err
+	}
+	s := &serverTLS{clientAuth: clientAuth}
+	if s.cert, err = newReloadingFile(options.CertFile, rawFile); err != nil {
+		return nil, fmt.Errorf("tls cert %s: %w", options.CertFile, err)
+	}
+	if s.key, err = newReloadingFile(options.KeyFile, rawFile); err != nil {
+		return nil, fmt.Errorf("tls key %s: %w", options.KeyFile, err)
+	}
+	if options.CAFile != "" {
+		if s.ca, err = newReloadingFile(options.CAFile, rawFile); err != nil {
+			return nil, fmt.Errorf("tls ca %s: %w", options.CAFile, err)
+		}
+	}
+	if _, err := s.config(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.config()
+		},
+	}, nil
+}
+
+func rawFile(raw []byte) ([]byte, error) {
+	return raw, nil
+}
+
+type serverTLS struct {
+	cert, key, ca *reloadingFile[[]byte]
+	clientAuth    tls.ClientAuthType
+
+	mu      sync.Mutex
+	current *tls.Config
+	// the content the config is last built from, a broken content is not built again
+	certPEM, keyPEM, caPEM []byte
+}
+
+func (s *serverTLS) config() (*tls.Config, error) {
+	certPEM, keyPEM := s.cert.Get(), s.key.Get()
+	var caPEM []byte
+	if s.ca != nil {
+		caPEM = s.ca.Get()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil && bytes.Equal(certPEM, s.certPEM) && bytes.Equal(keyPEM, s.keyPEM) && bytes.Equal(caPEM, s.caPEM) {
+		return s.current, nil
+	}
+	s.certPEM, s.keyPEM, s.caPEM = certPEM, keyPEM, caPEM
+	config, err := buildServerTLSConfig(certPEM, keyPEM, caPEM, s.clientAuth)
+	if err != nil {
+		if s.current == nil {
+			return nil, err
+		}
+		authLogger.Error("reload tls certificates, keep the previous ones", logging.Error(err))
+		return s.current, nil
+	}
+	s.current = config
+	return config, nil
+}
+
+func buildServerTLSConfig(certPEM, keyPEM, caPEM []byte, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("tls certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		// GetConfigForClient replaces the config http.Server sets up
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if caPEM != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("tls ca: no certificate found")
+		}
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
@@ -15,3 +15,148 @@ limitations under the License.
 */
 
 package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	TokenReviewAPIVersion = "modelx.kubegems.io/v1"
+	TokenReviewKind       = "TokenReview"
+
+	// cached reviews beyond this are swept of the expired ones
+	webhookCacheSweepSize = 4096
+)
+
+// TokenReview is posted to the authentication webhook with the token in the spec,
+// the webhook answers it with the status filled:
+//
+//	{"apiVersion": "modelx.kubegems.io/v1", "kind": "TokenReview",
+//	 "status": {"authenticated": true, "user": {"username": "alice", "groups": ["ml"], "scopes": ["pull"]}}}
+type TokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       TokenReviewSpec   `json:"spec"`
+	Status     TokenReviewStatus `json:"status"`
+}
+
+type TokenReviewSpec struct {
+	Token string `json:"token"`
+}
+
+type TokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          UserInfo `json:"user"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// WebhookAuthenticator asks an external service about the tokens it does not know,
+// the answers, rejections included, are cached for CacheTTL.
+type WebhookAuthenticator struct {
+	URL      string
+	CacheTTL time.Duration
+
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[[sha256.Size]byte]webhookReview
+}
+
+type webhookReview struct {
+	user    *UserInfo
+	expires time.Time
+}
+
+var _ TokenAuthenticator = &WebhookAuthenticator{}
+
+func NewWebhookAuthenticator(url string, timeout, cacheTTL time.Duration) *WebhookAuthenticator {
+	return &WebhookAuthenticator{
+		URL:      url,
+		CacheTTL: cacheTTL,
+		client:   &http.Client{Timeout: timeout},
+		cache:    map[[sha256.Size]byte]webhookReview{},
+	}
+}
+
+func (a *WebhookAuthenticator) AuthenticateToken(ctx context.Context, token string) (*UserInfo, error) {
+	// tokens are only kept hashed
+	key := sha256.Sum256([]byte(token))
+	if review, ok := a.cached(key); ok {
+		if review.user == nil {
+			return nil, ErrInvalidToken
+		}
+		return review.user, nil
+	}
+	status, err := a.review(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	review := webhookReview{expires: time.Now().Add(a.CacheTTL)}
+	if status.Authenticated && status.User.Username != "" {
+		user := status.User
+		review.user = &user
+	}
+	a.store(key, review)
+	if review.user == nil {
+		return nil, ErrInvalidToken
+	}
+	return review.user, nil
+}
+
+func (a *WebhookAuthenticator) review(ctx context.Context, token string) (*TokenReviewStatus, error) {
+	body, err := json.Marshal(TokenReview{APIVersion: TokenReviewAPIVersion, Kind: TokenReviewKind, Spec: TokenReviewSpec{Token: token}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token review: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token review: webhook responded %s", resp.Status)
+	}
+	review := TokenReview{}
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		return nil, fmt.Errorf("token review: %w", err)
+	}
+	return &review.Status, nil
+}
+
+func (a *WebhookAuthenticator) cached(key [sha256.Size]byte) (webhookReview, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	review, ok := a.cache[key]
+	if !ok || time.Now().After(review.expires) {
+		return webhookReview{}, false
+	}
+	return review, true
+}
+
+func (a *WebhookAuthenticator) store(key [sha256.Size]byte, review webhookReview) {
+	if a.CacheTTL <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= webhookCacheSweepSize {
+		now := time.Now()
+		for k, v := range a.cache {
+			if now.After(v.expires) {
+				delete(a.cache, k)
+			}
+		}
+	}
+	a.cache[key] = review
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package client
 
 import (
+	"time"
+
 	logging "github.com/kubeservice-stack/common/pkg/logger"
 	"github.com/opencontainers/go-digest"
 
@@ -44,6 +46,16 @@ const (
 	// default retry count
 	DefaultPullPushConcurrency = 5
 
+	// retry count and first backoff of the requests the server answers 429,
+	// the backoff doubles up to the max unless the server sets Retry-After.
+	DefaultTooManyRequestsRetry   = 5
+	DefaultTooManyRequestsBackoff = time.Second
+	MaxTooManyRequestsBackoff     = time.Minute
+
+	// chunk size and retry count of upload sessions
+	DefaultUploadChunkSize  = int64(64 << 20)
+	DefaultUploadChunkRetry = 5
+
 	ModelConfigFileName = "modelx.yaml"
 	ReadmeFileName      = "README.md"
 	ModelCacheDir       = ".modelx"
@@ -45,6 +45,10 @@ func (c *Client) Copy(ctx context.Context, repoTo, versionTo string, repoFrom, v
 		b.SetStatus("done", true)
 		return nil
 	})
+	// the manifest is checked against the blobs, copy it after them
+	if err := p.Wait(); err != nil {
+		return err
+	}
 
 	// copy manifest
 	p.Go("manifest", "copying", func(b *progress.Bar) error {
@@ -22,8 +22,54 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
 )
 
+// doWithBackoff sends req, and sends it again after a while when the server answers 429.
+// The wait is the Retry-After of the response, or doubles from DefaultTooManyRequestsBackoff.
+// A request whose body can not be read again is not sent again.
+func doWithBackoff(cli *http.Client, req *http.Request) (*http.Response, error) {
+	backoff := DefaultTooManyRequestsBackoff
+	for i := 0; ; i++ {
+		resp, err := cli.Do(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || i >= DefaultTooManyRequestsRetry {
+			return resp, err
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, nil
+		}
+		wait := retryAfter(resp.Header.Get("Retry-After"), backoff)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		extensionLogger.Debug("too many requests, retry later", zap.String("url", req.URL.String()), zap.Duration("wait", wait))
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, MaxTooManyRequestsBackoff)
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retryAfter parses the Retry-After header, in seconds or a http date.
+func retryAfter(value string, fallback time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return min(time.Duration(seconds)*time.Second, MaxTooManyRequestsBackoff)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return min(max(time.Until(at), 0), MaxTooManyRequestsBackoff)
+	}
+	return fallback
+}
+
 func HTTPDownload(ctx context.Context, location *url.URL, header http.Header, into io.Writer) error {
 	req, err := http.NewRequestWithContext(ctx, "GET", location.String(), nil)
 	if err != nil {
@@ -33,7 +79,7 @@ func HTTPDownload(ctx context.Context, location *url.URL, header http.Header, in
 	for k, v := range header {
 		req.Header[k] = v
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doWithBackoff(http.DefaultClient, req)
 	if err != nil {
 		return err
 	}
@@ -65,7 +111,7 @@ func HTTPUpload(ctx context.Context, location *url.URL, header http.Header, cont
 	}
 	req.ContentLength, req.GetBody = contentlen, getbody
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doWithBackoff(http.DefaultClient, req)
 	if err != nil {
 		return err
 	}
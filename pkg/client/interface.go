@@ -85,7 +85,7 @@ func (t *RegistryClient) extrequest(ctx context.Context, method, url string, hea
 		},
 	}
 
-	resp, err := norediretccli.Do(req)
+	resp, err := doWithBackoff(norediretccli, req)
 	if err != nil {
 		return nil, err
 	}
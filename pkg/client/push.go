@@ -27,6 +27,7 @@ import (
 	"github.com/opencontainers/go-digest"
 
 	"kubegems.io/modelx/pkg/progress"
+	"kubegems.io/modelx/pkg/response"
 	"kubegems.io/modelx/pkg/util"
 )
 
@@ -202,14 +203,66 @@ func (c *Client) PushBlob(ctx context.Context, repo string, desc DescriptorWithC
 	return nil
 }
 
+// UploadBlob uploads the blob without checking whether the registry has it, and without progress.
+func (c *Client) UploadBlob(ctx context.Context, repo string, desc DescriptorWithContent) error {
+	return c.pushBlob(ctx, repo, desc)
+}
+
 func (c *Client) pushBlob(ctx context.Context, repo string, desc DescriptorWithContent) error {
 	location, err := c.Remote.GetBlobLocation(ctx, repo, desc.Descriptor, util.BlobLocationPurposeUpload)
 	if err != nil {
 		if !IsServerUnsupportError(err) {
 			return err
 		}
-
-		return c.Remote.UploadBlobContent(ctx, repo, desc)
+		// a session stores the chunks then copies them into the blob, only worth it if the blob has several
+		if desc.Size <= DefaultUploadChunkSize {
+			return c.Remote.UploadBlobContent(ctx, repo, desc)
+		}
+		return c.uploadBlobChunked(ctx, repo, desc)
 	}
 	return c.Extension.Upload(ctx, desc, *location)
 }
+
+// uploadBlobChunked uploads the blob in chunks through an upload session,
+// a session left by an interrupted push is resumed from the offset the server has received.
+func (c *Client) uploadBlobChunked(ctx context.Context, repo string, desc DescriptorWithContent) error {
+	status, err := c.Remote.StartBlobUpload(ctx, repo, desc.Digest)
+	if err != nil {
+		// server without upload sessions
+		if IsServerUnsupportError(err) {
+			return c.Remote.UploadBlobContent(ctx, repo, desc)
+		}
+		return err
+	}
+	offset := status.Offset
+	for offset < desc.Size {
+		err := retry(ctx, DefaultUploadChunkRetry, func() error {
+			length := min(DefaultUploadChunkSize, desc.Size-offset)
+			content, err := desc.GetContent()
+			if err != nil {
+				return err
+			}
+			status, err := c.Remote.UploadBlobChunk(ctx, repo, desc.Digest, offset, length, NewSectionReader(content, offset, length))
+			if err != nil {
+				// the server may have kept part of the chunk, continue from where it is
+				if current, geterr := c.Remote.GetBlobUpload(ctx, repo, desc.Digest); geterr == nil {
+					offset = current.Offset
+				}
+				return err
+			}
+			offset = status.Offset
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.Remote.CommitBlobUpload(ctx, repo, desc.Digest); err != nil {
+		// received content is wrong, start over on the next push
+		if response.IsErrCode(err, response.ErrCodeDigestInvalid) || response.IsErrCode(err, response.ErrCodeSizeInvalid) {
+			_ = c.Remote.CancelBlobUpload(ctx, repo, desc.Digest)
+		}
+		return err
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ package client
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -31,6 +32,17 @@ import (
 	"kubegems.io/modelx/pkg/util"
 )
 
+// Authorization returns the Authorization header of a bearer token, or of basic auth if there is no token.
+func Authorization(token, username, password string) string {
+	if token != "" {
+		return "Bearer " + token
+	}
+	if username != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	return ""
+}
+
 func NewRegistryClient(addr string, auth string) *RegistryClient {
 	return &RegistryClient{
 		Registry:      addr,
@@ -63,6 +75,14 @@ func (t *RegistryClient) PutManifest(ctx context.Context, repository string, ver
 	return t.simpleuploadrequest(ctx, "PUT", path, manifest, nil)
 }
 
+func (t *RegistryClient) DeleteManifest(ctx context.Context, repository string, version string) error {
+	if version == "" {
+		version = "latest"
+	}
+	path := "/" + repository + "/manifests/" + version
+	return t.simplerequest(ctx, "DELETE", path, nil)
+}
+
 func (t *RegistryClient) CopyBlobs(ctx context.Context, repositoryTo, repositoryFrom string, versionTo, versionFrom string) error {
 	if versionTo == "" {
 		versionTo = "latest"
@@ -84,6 +104,12 @@ func (t *RegistryClient) GetIndex(ctx context.Context, repository string, search
 	return index, nil
 }
 
+// RemoveIndex deletes the repository with all its versions.
+func (t *RegistryClient) RemoveIndex(ctx context.Context, repository string) error {
+	path := "/" + repository + "/index"
+	return t.simplerequest(ctx, "DELETE", path, nil)
+}
+
 func (t *RegistryClient) GetGlobalIndex(ctx context.Context, search string) (*util.Index, error) {
 	query := url.Values{}
 	if search != "" {
@@ -106,6 +132,7 @@ func (t *RegistryClient) HeadBlobString(ctx context.Context, repository string,
 	if err != nil {
 		return false, err
 	}
+	resp.Body.Close()
 	return resp.StatusCode == http.StatusOK, nil
 }
 
@@ -115,6 +142,7 @@ func (t *RegistryClient) HeadBlob(ctx context.Context, repository string, digest
 	if err != nil {
 		return false, err
 	}
+	resp.Body.Close()
 	return resp.StatusCode == http.StatusOK, nil
 }
 
@@ -123,6 +151,50 @@ func (t *RegistryClient) GetBlobContent(ctx context.Context, repository string,
 	return t.simplerequest(ctx, "GET", path, into)
 }
 
+// StatBlob returns the size of the blob, BLOB_UNKNOWN is returned if the registry does not have it.
+func (t *RegistryClient) StatBlob(ctx context.Context, repository string, digest digest.Digest) (int64, error) {
+	path := "/" + repository + "/blobs/" + digest.String()
+	resp, err := t.request(ctx, "HEAD", path, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return 0, response.NewBlobUnknownError(digest)
+	case resp.StatusCode >= 400:
+		return 0, response.ErrorInfo{HttpStatus: resp.StatusCode, Message: resp.Status}
+	}
+	return resp.ContentLength, nil
+}
+
+// GetBlobReader streams the blob, the caller must close the returned reader.
+func (t *RegistryClient) GetBlobReader(ctx context.Context, repository string, digest digest.Digest) (io.ReadCloser, int64, error) {
+	path := "/" + repository + "/blobs/" + digest.String()
+	resp, err := t.request(ctx, "GET", path, nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// GetBlobRangeReader streams length bytes of the blob from offset, the caller must close the returned reader.
+func (t *RegistryClient) GetBlobRangeReader(ctx context.Context, repository string, digest digest.Digest, offset, length int64) (io.ReadCloser, error) {
+	header := map[string]string{
+		"Range": "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10),
+	}
+	path := "/" + repository + "/blobs/" + digest.String()
+	resp, err := t.request(ctx, "GET", path, header, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, response.ErrorInfo{HttpStatus: resp.StatusCode, Message: "range request not satisfied: " + resp.Status}
+	}
+	return resp.Body, nil
+}
+
 func (t *RegistryClient) GetBlobLocation(ctx context.Context, repository string, desc util.Descriptor, purpose string) (*util.BlobLocation, error) {
 	reqpath := "/" + path.Join(repository, "blobs", desc.Digest.String(), "locations", purpose)
 	query := url.Values{}
@@ -153,6 +225,50 @@ func (t *RegistryClient) UploadBlobContent(ctx context.Context, repository strin
 	return err
 }
 
+func (t *RegistryClient) StartBlobUpload(ctx context.Context, repository string, digest digest.Digest) (*util.UploadStatus, error) {
+	status := &util.UploadStatus{}
+	path := "/" + repository + "/blobs/" + digest.String() + "/uploads"
+	if err := t.simplerequest(ctx, "POST", path, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (t *RegistryClient) GetBlobUpload(ctx context.Context, repository string, digest digest.Digest) (*util.UploadStatus, error) {
+	status := &util.UploadStatus{}
+	path := "/" + repository + "/blobs/" + digest.String() + "/uploads"
+	if err := t.simplerequest(ctx, "GET", path, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (t *RegistryClient) UploadBlobChunk(ctx context.Context, repository string, digest digest.Digest,
+	offset int64, length int64, chunk io.Reader,
+) (*util.UploadStatus, error) {
+	header := map[string]string{
+		"Content-Type":   "application/octet-stream",
+		"Content-Range":  strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10),
+		"Content-Length": strconv.FormatInt(length, 10),
+	}
+	status := &util.UploadStatus{}
+	path := "/" + repository + "/blobs/" + digest.String() + "/uploads"
+	if _, err := t.request(ctx, "PATCH", path, header, chunk, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (t *RegistryClient) CommitBlobUpload(ctx context.Context, repository string, digest digest.Digest) error {
+	path := "/" + repository + "/blobs/" + digest.String() + "/uploads"
+	return t.simplerequest(ctx, "PUT", path, nil)
+}
+
+func (t *RegistryClient) CancelBlobUpload(ctx context.Context, repository string, digest digest.Digest) error {
+	path := "/" + repository + "/blobs/" + digest.String() + "/uploads"
+	return t.simplerequest(ctx, "DELETE", path, nil)
+}
+
 type GetContentFunc func() (io.ReadSeekCloser, error)
 
 type RqeuestBody struct {
@@ -187,10 +303,14 @@ func (t *RegistryClient) request(ctx context.Context, method, url string,
 	for k, v := range header {
 		req.Header.Set(k, v)
 	}
+	if contentLength, ok := header["Content-Length"]; ok {
+		// the transport only sends the length of known body types
+		req.ContentLength, _ = strconv.ParseInt(contentLength, 10, 64)
+	}
 	req.Header.Set("Authorization", t.Authorization)
 	req.Header.Set("User-Agent", UserAgent)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doWithBackoff(http.DefaultClient, req)
 	if err != nil {
 		return nil, err
 	}
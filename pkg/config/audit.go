@@ -0,0 +1,34 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+type AuditOptions struct {
+	// File is the JSONL file the audit records are appended to, the audit is disabled without it.
+	File string `yaml:"file"`
+	// MaxSizeMB rotates the file once it reaches this size.
+	MaxSizeMB int `yaml:"maxSizeMB"`
+	// MaxBackups is the number of the rotated files kept.
+	MaxBackups int `yaml:"maxBackups"`
+}
+
+func NewDefaultAuditOptions() *AuditOptions {
+	return &AuditOptions{
+		File:       "",
+		MaxSizeMB:  100,
+		MaxBackups: 10,
+	}
+}
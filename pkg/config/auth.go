@@ -0,0 +1,98 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type AuthOptions struct {
+	// WebhookURL reviews the bearer tokens, like a kubernetes TokenReview webhook.
+	WebhookURL     string        `yaml:"webhookURL"`
+	WebhookTimeout time.Duration `yaml:"webhookTimeout"`
+	// WebhookCacheTTL is how long a review is cached, rejected tokens included.
+	WebhookCacheTTL time.Duration `yaml:"webhookCacheTTL"`
+	// HtpasswdFile authenticates HTTP basic auth with the bcrypt passwords of an htpasswd file.
+	HtpasswdFile string `yaml:"htpasswdFile"`
+	// TokenFile authenticates the bearer tokens it lists.
+	TokenFile string `yaml:"tokenFile"`
+	// AnonymousProjects are globs of the projects anyone may pull from without credentials.
+	AnonymousProjects []string `yaml:"anonymousProjects"`
+}
+
+func NewDefaultAuthOptions() *AuthOptions {
+	return &AuthOptions{
+		WebhookURL:        "",
+		WebhookTimeout:    10 * time.Second,
+		WebhookCacheTTL:   2 * time.Minute,
+		HtpasswdFile:      "",
+		TokenFile:         "",
+		AnonymousProjects: []string{},
+	}
+}
+
+// Enabled reports whether a built-in authenticator is configured, besides OIDC.
+func (o *AuthOptions) Enabled() bool {
+	return o != nil && (o.WebhookURL != "" || o.HtpasswdFile != "" || o.TokenFile != "")
+}
+
+// TokenFileConfig is the content of AuthOptions.TokenFile:
+//
+//	tokens:
+//	  - token: 0c3a5d1e9f...
+//	    username: ci
+//	    groups: ["ml"]
+//	    scopes: ["pull", "push"]
+type TokenFileConfig struct {
+	Tokens []StaticToken `yaml:"tokens"`
+}
+
+type StaticToken struct {
+	Token    string   `yaml:"token"`
+	Username string   `yaml:"username"`
+	Groups   []string `yaml:"groups,omitempty"`
+	// Scopes limits what the token allows, empty allows everything.
+	Scopes []string `yaml:"scopes,omitempty"`
+}
+
+func ParseTokenFile(raw []byte) (*TokenFileConfig, error) {
+	config := &TokenFileConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *TokenFileConfig) Validate() error {
+	tokens := map[string]bool{}
+	for i, token := range c.Tokens {
+		if token.Token == "" || token.Username == "" {
+			return fmt.Errorf("token #%d: token and username must be set", i)
+		}
+		if tokens[token.Token] {
+			return fmt.Errorf("token #%d of %s: duplicated token", i, token.Username)
+		}
+		tokens[token.Token] = true
+	}
+	return nil
+}
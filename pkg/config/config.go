@@ -17,51 +17,248 @@ limitations under the License.
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
 	"time"
 )
 
 var GlobalModelxdOptions *Options = DefaultOptions()
 
 type Options struct {
-	Listen         string
-	TLS            *TLSOptions
-	S3             *S3Options
-	Local          *LocalFSOptions
-	EnableRedirect bool
-	EnableMetrics  bool
-	OIDC           *OIDCOptions
+	Listen         string          `yaml:"listen"`
+	TLS            *TLSOptions     `yaml:"tls"`
+	S3             *S3Options      `yaml:"s3"`
+	Local          *LocalFSOptions `yaml:"local"`
+	EnableRedirect bool            `yaml:"enableRedirect"`
+	EnableMetrics  bool            `yaml:"enableMetrics"`
+	// EnableGlobalBlobs stores blobs once for all repositories.
+	EnableGlobalBlobs bool `yaml:"enableGlobalBlobs"`
+	// LogLevel is one of debug, info, warn and error.
+	LogLevel    string              `yaml:"logLevel"`
+	OIDC        *OIDCOptions        `yaml:"oidc"`
+	Auth        *AuthOptions        `yaml:"auth"`
+	GC          *GCOptions          `yaml:"gc"`
+	Retention   *RetentionOptions   `yaml:"retention"`
+	Quota       *QuotaOptions       `yaml:"quota"`
+	Proxy       *ProxyOptions       `yaml:"proxy"`
+	Replication *ReplicationOptions `yaml:"replication"`
+	Webhook     *WebhookOptions     `yaml:"webhook"`
+	RBAC        *RBACOptions        `yaml:"rbac"`
+	Audit       *AuditOptions       `yaml:"audit"`
+	RateLimit   *RateLimitOptions   `yaml:"rateLimit"`
+	Shutdown    *ShutdownOptions    `yaml:"shutdown"`
+	Readiness   *ReadinessOptions   `yaml:"readiness"`
+}
+
+type ReadinessOptions struct {
+	// WriteProbe makes the readiness check also write and remove a probe object, not only stat the global index.
+	WriteProbe bool `yaml:"writeProbe"`
+	// CacheTTL is how long a readiness check result is served before the storage is checked again.
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+	// Timeout of a storage check, the storage is not ready if it does not answer in time.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func NewDefaultReadinessOptions() *ReadinessOptions {
+	return &ReadinessOptions{
+		WriteProbe: false,
+		CacheTTL:   5 * time.Second,
+		Timeout:    3 * time.Second,
+	}
+}
+
+type ShutdownOptions struct {
+	// Delay between failing the readiness check and closing the listener, so the load balancers stop sending requests.
+	Delay time.Duration `yaml:"delay"`
+	// Timeout is how long the requests in progress and the scheduled runs have to finish, they are cut off after it.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func NewDefaultShutdownOptions() *ShutdownOptions {
+	return &ShutdownOptions{
+		Delay:   5 * time.Second,
+		Timeout: 5 * time.Minute,
+	}
+}
+
+type GCOptions struct {
+	// Interval between scheduled garbage collections, 0 disables the scheduler.
+	Interval time.Duration `yaml:"interval"`
+	// MinBlobAge keeps unreferenced blobs younger than this, their push may not have put its manifest yet.
+	MinBlobAge time.Duration `yaml:"minBlobAge"`
+	// DryRun makes scheduled garbage collections only report what they would remove.
+	DryRun bool `yaml:"dryRun"`
+	// UploadTTL removes the upload sessions idle for longer than this, 0 keeps them.
+	UploadTTL time.Duration `yaml:"uploadTTL"`
+}
+
+func NewDefaultGCOptions() *GCOptions {
+	return &GCOptions{
+		Interval:   0,
+		MinBlobAge: time.Hour,
+		DryRun:     false,
+		UploadTTL:  24 * time.Hour,
+	}
 }
 
 type OIDCOptions struct {
-	Issuer string
+	Issuer string `yaml:"issuer"`
+	// ExtraIssuers are trusted besides Issuer, a token is verified by the issuer in its "iss".
+	ExtraIssuers []string `yaml:"extraIssuers"`
+	// Audiences accepted in the id tokens, any audience is accepted if empty.
+	Audiences []string `yaml:"audiences"`
+	// RequiredClaims must be in the id tokens with the value, or contain it if the claim is a list.
+	RequiredClaims map[string]string `yaml:"requiredClaims"`
+	// GroupsClaim is the claim of the id token listing the groups of the user.
+	GroupsClaim string `yaml:"groupsClaim"`
+	// RefreshInterval is how often the discovery and the key set of the issuers are refreshed.
+	RefreshInterval time.Duration `yaml:"refreshInterval"`
+}
+
+func NewDefaultOIDCOptions() *OIDCOptions {
+	return &OIDCOptions{
+		Issuer:          "",
+		GroupsClaim:     "groups",
+		RefreshInterval: time.Hour,
+	}
+}
+
+// TrustedIssuers returns Issuer and ExtraIssuers.
+func (o *OIDCOptions) TrustedIssuers() []string {
+	issuers := []string{}
+	if o.Issuer != "" {
+		issuers = append(issuers, o.Issuer)
+	}
+	return append(issuers, o.ExtraIssuers...)
 }
 
 func DefaultOptions() *Options {
 	return &Options{
 		Listen:         ":8080",
-		TLS:            &TLSOptions{},
+		TLS:            &TLSOptions{ClientUsername: TLSClientUsernameCN},
 		S3:             NewDefaultS3Options(),
-		OIDC:           &OIDCOptions{},
+		OIDC:           NewDefaultOIDCOptions(),
+		Auth:           NewDefaultAuthOptions(),
+		GC:             NewDefaultGCOptions(),
+		Retention:      NewDefaultRetentionOptions(),
+		Quota:          NewDefaultQuotaOptions(),
+		Proxy:          NewDefaultProxyOptions(),
+		Replication:    NewDefaultReplicationOptions(),
+		Webhook:        NewDefaultWebhookOptions(),
+		RBAC:           NewDefaultRBACOptions(),
+		Audit:          NewDefaultAuditOptions(),
+		RateLimit:      NewDefaultRateLimitOptions(),
+		Shutdown:       NewDefaultShutdownOptions(),
+		Readiness:      NewDefaultReadinessOptions(),
 		Local:          NewDefaultLocalFSOptions(),
 		EnableRedirect: false, // default to false
 		EnableMetrics:  true,  // default to true
+		LogLevel:       "info",
+	}
+}
+
+// redactedValue replaces the secrets in the logs.
+const redactedValue = "[redacted]"
+
+// Redacted returns a copy of the options safe to log, the credentials are replaced.
+func (o *Options) Redacted() *Options {
+	out := *o
+	if o.S3 != nil {
+		s3 := *o.S3
+		s3.AccessKey, s3.SecretKey = redact(s3.AccessKey), redact(s3.SecretKey)
+		out.S3 = &s3
 	}
+	if o.Proxy != nil {
+		proxy := *o.Proxy
+		proxy.Password, proxy.Token = redact(proxy.Password), redact(proxy.Token)
+		out.Proxy = &proxy
+	}
+	return &out
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
 }
 
 type TLSOptions struct {
-	CertFile string
-	KeyFile  string
-	CAFile   string
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// CAFile verifies the client certificates, the files are read again once modified.
+	CAFile string `yaml:"caFile"`
+	// ClientAuth is one of the TLSClientAuth modes, it is require-and-verify with CAFile and none without by default.
+	ClientAuth string `yaml:"clientAuth"`
+	// ClientUsername is the field of a verified client certificate used as the username, one of the TLSClientUsername fields.
+	ClientUsername string `yaml:"clientUsername"`
+}
+
+const (
+	TLSClientAuthNone             = "none"
+	TLSClientAuthRequest          = "request"
+	TLSClientAuthRequire          = "require"
+	TLSClientAuthVerifyIfGiven    = "verify-if-given"
+	TLSClientAuthRequireAndVerify = "require-and-verify"
+
+	// the subject common name
+	TLSClientUsernameCN = "cn"
+	// the first DNS, email or URI subject alternative name
+	TLSClientUsernameDNS   = "dns"
+	TLSClientUsernameEmail = "email"
+	TLSClientUsernameURI   = "uri"
+)
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	TLSClientAuthNone:             tls.NoClientCert,
+	TLSClientAuthRequest:          tls.RequestClientCert,
+	TLSClientAuthRequire:          tls.RequireAnyClientCert,
+	TLSClientAuthVerifyIfGiven:    tls.VerifyClientCertIfGiven,
+	TLSClientAuthRequireAndVerify: tls.RequireAndVerifyClientCert,
+}
+
+// ClientAuthType returns the tls client auth of ClientAuth.
+func (o *TLSOptions) ClientAuthType() (tls.ClientAuthType, error) {
+	mode := o.ClientAuth
+	if mode == "" {
+		mode = TLSClientAuthNone
+		if o.CAFile != "" {
+			mode = TLSClientAuthRequireAndVerify
+		}
+	}
+	clientAuth, ok := tlsClientAuthTypes[mode]
+	if !ok {
+		return tls.NoClientCert, fmt.Errorf("unknown client auth %q", o.ClientAuth)
+	}
+	if clientAuth >= tls.VerifyClientCertIfGiven && o.CAFile == "" {
+		return tls.NoClientCert, fmt.Errorf("client auth %s needs the ca file", mode)
+	}
+	return clientAuth, nil
+}
+
+func (o *TLSOptions) Validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("certFile and keyFile must be set together")
+	}
+	if _, err := o.ClientAuthType(); err != nil {
+		return err
+	}
+	switch o.ClientUsername {
+	case TLSClientUsernameCN, TLSClientUsernameDNS, TLSClientUsernameEmail, TLSClientUsernameURI:
+		return nil
+	default:
+		return fmt.Errorf("unknown client username %q", o.ClientUsername)
+	}
 }
 
 type S3Options struct {
-	URL           string        `json:"url,omitempty"`
-	Region        string        `json:"region,omitempty"`
-	Buket         string        `json:"buket,omitempty"`
-	AccessKey     string        `json:"accessKey,omitempty"`
-	SecretKey     string        `json:"secretKey,omitempty"`
-	PresignExpire time.Duration `json:"presignExpire,omitempty"`
-	PathStyle     bool          `json:"pathStyle,omitempty"`
+	URL           string        `json:"url,omitempty" yaml:"url"`
+	Region        string        `json:"region,omitempty" yaml:"region"`
+	Buket         string        `json:"buket,omitempty" yaml:"bucket"`
+	AccessKey     string        `json:"accessKey,omitempty" yaml:"accessKey"`
+	SecretKey     string        `json:"secretKey,omitempty" yaml:"secretKey"`
+	PresignExpire time.Duration `json:"presignExpire,omitempty" yaml:"presignExpire"`
+	PathStyle     bool          `json:"pathStyle,omitempty" yaml:"pathStyle"`
 }
 
 func NewDefaultS3Options() *S3Options {
@@ -77,7 +274,7 @@ func NewDefaultS3Options() *S3Options {
 }
 
 type LocalFSOptions struct {
-	Basepath string
+	Basepath string `yaml:"basepath"`
 }
 
 func NewDefaultLocalFSOptions() *LocalFSOptions {
@@ -0,0 +1,232 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variables overriding the options,
+// the variable of a setting is its yaml path in upper snake case, such as MODELXD_S3_SECRET_KEY.
+const EnvPrefix = "MODELXD_"
+
+// LoadOptionsFile decodes the yaml file onto options, the settings missing in it are kept.
+// The file mirrors Options:
+//
+//	listen: ":8080"
+//	logLevel: info
+//	s3:
+//	  url: http://minio:9000
+//	  bucket: modelx
+//	  accessKey: modelx
+//	auth:
+//	  htpasswdFile: /etc/modelx/htpasswd
+//	rbac:
+//	  configFile: /etc/modelx/rbac.yaml
+//	rateLimit:
+//	  configFile: /etc/modelx/ratelimit.yaml
+func LoadOptionsFile(file string, options *Options) error {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(options); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("modelxd config %s: %w", file, err)
+	}
+	return nil
+}
+
+// LoadOptionsEnv overrides options with the EnvPrefix variables of environ, in the form of os.Environ.
+// Lists are comma separated, maps are comma separated key=value pairs.
+func LoadOptionsEnv(options *Options, environ []string) error {
+	values := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix) {
+			values[k] = v
+		}
+	}
+	return setEnvFields(reflect.ValueOf(options).Elem(), strings.TrimSuffix(EnvPrefix, "_"), values)
+}
+
+func setEnvFields(v reflect.Value, prefix string, values map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + envName(tag)
+		if value.Kind() == reflect.Pointer && value.Type().Elem().Kind() == reflect.Struct {
+			if value.IsNil() {
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+			if err := setEnvFields(value.Elem(), name, values); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok := values[name]
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(value, raw); err != nil {
+			return fmt.Errorf("env %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setEnvValue(value reflect.Value, raw string) error {
+	switch value.Interface().(type) {
+	case string:
+		value.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+	case []string:
+		list := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		value.Set(reflect.ValueOf(list))
+	case map[string]string:
+		m := map[string]string{}
+		for _, pair := range strings.Split(raw, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%s must be formatted as key=value", pair)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		value.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// envName converts a camel case yaml key to upper snake case, such as webhookCacheTTL to WEBHOOK_CACHE_TTL.
+func envName(key string) string {
+	runes := []rune(key)
+	sb := strings.Builder{}
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				sb.WriteByte('_')
+			}
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+	return sb.String()
+}
+
+// Validate checks the options and the config files they refer to.
+func (o *Options) Validate() error {
+	if o.Listen == "" {
+		return fmt.Errorf("listen must be set")
+	}
+	if o.TLS != nil {
+		if err := o.TLS.Validate(); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	if _, err := zapcore.ParseLevel(o.LogLevel); err != nil {
+		return fmt.Errorf("logLevel: %w", err)
+	}
+	if o.RBAC != nil && o.RBAC.ConfigFile != "" {
+		if _, err := LoadRBACConfig(o.RBAC.ConfigFile); err != nil {
+			return err
+		}
+	}
+	if o.RateLimit != nil && o.RateLimit.ConfigFile != "" {
+		if _, err := LoadRateLimitConfig(o.RateLimit.ConfigFile); err != nil {
+			return err
+		}
+	}
+	if o.Retention != nil && o.Retention.ConfigFile != "" {
+		if _, err := LoadRetentionConfig(o.Retention.ConfigFile); err != nil {
+			return err
+		}
+	}
+	if o.Quota != nil && o.Quota.ConfigFile != "" {
+		if _, err := LoadQuotaConfig(o.Quota.ConfigFile); err != nil {
+			return err
+		}
+	}
+	if o.Replication != nil && o.Replication.ConfigFile != "" {
+		if _, err := LoadReplicationConfig(o.Replication.ConfigFile); err != nil {
+			return err
+		}
+	}
+	if o.Webhook != nil && o.Webhook.ConfigFile != "" {
+		if _, err := LoadWebhookConfig(o.Webhook.ConfigFile); err != nil {
+			return err
+		}
+	}
+	if o.Auth != nil && o.Auth.TokenFile != "" {
+		raw, err := os.ReadFile(o.Auth.TokenFile)
+		if err != nil {
+			return err
+		}
+		if _, err := ParseTokenFile(raw); err != nil {
+			return fmt.Errorf("token file %s: %w", o.Auth.TokenFile, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "time"
+
+type ProxyOptions struct {
+	// Upstream is the url of the modelxd to pull through, empty disables the proxy mode.
+	Upstream string `yaml:"upstream"`
+	// Username and Password authenticate to the upstream with basic auth.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Token authenticates to the upstream with a bearer token, it is preferred over the basic auth.
+	Token string `yaml:"token"`
+	// ManifestTTL is how long a cached manifest is served before it is fetched again, so moving tags like latest refresh.
+	ManifestTTL time.Duration `yaml:"manifestTTL"`
+}
+
+func NewDefaultProxyOptions() *ProxyOptions {
+	return &ProxyOptions{
+		Upstream:    "",
+		ManifestTTL: 5 * time.Minute,
+	}
+}
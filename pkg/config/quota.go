@@ -0,0 +1,117 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// QuotaDefaultKey configures the quota of the projects or repositories without their own entry.
+const QuotaDefaultKey = "*"
+
+type QuotaOptions struct {
+	// ConfigFile is the yaml file of the quotas, nothing is limited without it.
+	ConfigFile string `yaml:"configFile"`
+}
+
+func NewDefaultQuotaOptions() *QuotaOptions {
+	return &QuotaOptions{ConfigFile: ""}
+}
+
+// QuotaConfig is the content of QuotaOptions.ConfigFile:
+//
+//	projects:
+//	  "*":
+//	    maxBytes: 1Ti
+//	  nightly:
+//	    maxBytes: 10Ti
+//	    maxVersions: 5000
+//	repositories:
+//	  nightly/llama:
+//	    maxVersions: 100
+type QuotaConfig struct {
+	// Projects are keyed by the project, the first segment of the repository.
+	Projects map[string]Quota `yaml:"projects"`
+	// Repositories are keyed by "project/name".
+	Repositories map[string]Quota `yaml:"repositories"`
+}
+
+// Quota limits the sum of the version sizes and the number of versions, zero is unlimited.
+type Quota struct {
+	MaxBytes    ByteSize `yaml:"maxBytes,omitempty"`
+	MaxVersions int      `yaml:"maxVersions,omitempty"`
+}
+
+// ByteSize is a number of bytes, in yaml it may also be a quantity such as "500Gi".
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	quantity, err := resource.ParseQuantity(node.Value)
+	if err != nil {
+		return fmt.Errorf("size %s: %w", node.Value, err)
+	}
+	*b = ByteSize(quantity.Value())
+	return nil
+}
+
+func LoadQuotaConfig(file string) (*QuotaConfig, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &QuotaConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("quota config %s: %w", file, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("quota config %s: %w", file, err)
+	}
+	return config, nil
+}
+
+func (c *QuotaConfig) Validate() error {
+	for kind, quotas := range map[string]map[string]Quota{"project": c.Projects, "repository": c.Repositories} {
+		for name, quota := range quotas {
+			if quota.MaxBytes < 0 || quota.MaxVersions < 0 {
+				return fmt.Errorf("%s %s: maxBytes and maxVersions must not be negative", kind, name)
+			}
+		}
+	}
+	return nil
+}
+
+// ProjectQuota returns the quota of the project, ok is false if it is not limited.
+func (c *QuotaConfig) ProjectQuota(project string) (Quota, bool) {
+	return lookupQuota(c.Projects, project)
+}
+
+// RepositoryQuota returns the quota of the repository, ok is false if it is not limited.
+func (c *QuotaConfig) RepositoryQuota(repository string) (Quota, bool) {
+	return lookupQuota(c.Repositories, repository)
+}
+
+func lookupQuota(quotas map[string]Quota, name string) (Quota, bool) {
+	if quota, ok := quotas[name]; ok {
+		return quota, true
+	}
+	quota, ok := quotas[QuotaDefaultKey]
+	return quota, ok
+}
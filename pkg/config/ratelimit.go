@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+type RateLimitOptions struct {
+	// ConfigFile is the yaml file of the rate limits, nothing is limited without it.
+	ConfigFile string `yaml:"configFile"`
+}
+
+func NewDefaultRateLimitOptions() *RateLimitOptions {
+	return &RateLimitOptions{ConfigFile: ""}
+}
+
+// RateLimitConfig is the content of RateLimitOptions.ConfigFile, a limit not set is unlimited:
+//
+//	user:
+//	  rate: 50
+//	  burst: 100
+//	ip:
+//	  rate: 100
+//	  burst: 200
+//	metadata:
+//	  rate: 20
+//	  burst: 40
+//	blob:
+//	  rate: 5
+//	  burst: 10
+//	maxBlobTransfers: 64
+type RateLimitConfig struct {
+	// User limits the requests of each authenticated user.
+	User RateLimit `yaml:"user,omitempty"`
+	// IP limits the requests of each client ip, authenticated or not.
+	IP RateLimit `yaml:"ip,omitempty"`
+	// Metadata limits the index, manifest and other api requests of each user, or client ip if anonymous.
+	Metadata RateLimit `yaml:"metadata,omitempty"`
+	// Blob limits the blob downloads and uploads of each user, or client ip if anonymous.
+	Blob RateLimit `yaml:"blob,omitempty"`
+	// MaxBlobTransfers caps the blob downloads and uploads in progress over all the clients.
+	MaxBlobTransfers int `yaml:"maxBlobTransfers,omitempty"`
+}
+
+// RateLimit is a token bucket refilled with Rate tokens per second, up to Burst tokens.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0
+}
+
+func LoadRateLimitConfig(file string) (*RateLimitConfig, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &RateLimitConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("rate limit config %s: %w", file, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("rate limit config %s: %w", file, err)
+	}
+	return config, nil
+}
+
+func (c *RateLimitConfig) Validate() error {
+	limits := map[string]*RateLimit{"user": &c.User, "ip": &c.IP, "metadata": &c.Metadata, "blob": &c.Blob}
+	for name, limit := range limits {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return fmt.Errorf("%s: rate and burst must not be negative", name)
+		}
+		if limit.Enabled() && limit.Burst == 0 {
+			return fmt.Errorf("%s: burst must be set with the rate", name)
+		}
+	}
+	if c.MaxBlobTransfers < 0 {
+		return fmt.Errorf("maxBlobTransfers must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// RoleReader pulls.
+	RoleReader = "reader"
+	// RoleWriter pulls, pushes and deletes versions.
+	RoleWriter = "writer"
+	// RoleAdmin may also delete repositories and run the maintenance, such as garbage collect.
+	RoleAdmin = "admin"
+
+	// RBACAllRepositories matches all the repositories, the global maintenance requires an admin of it.
+	RBACAllRepositories = "*"
+)
+
+// Roles are ordered by what they allow, a role allows all that the roles before it do.
+var Roles = []string{RoleReader, RoleWriter, RoleAdmin}
+
+type RBACOptions struct {
+	// ConfigFile is the yaml file of the role bindings, authenticated users may do anything without it.
+	ConfigFile string `yaml:"configFile"`
+}
+
+func NewDefaultRBACOptions() *RBACOptions {
+	return &RBACOptions{ConfigFile: ""}
+}
+
+// RBACConfig is the content of RBACOptions.ConfigFile:
+//
+//	bindings:
+//	  - name: ops
+//	    role: admin
+//	    repositories: ["*"]
+//	    groups: ["ops"]
+//	  - name: ml
+//	    role: writer
+//	    repositories: ["ml", "library/llama*"]
+//	    users: ["alice"]
+//	    groups: ["ml"]
+type RBACConfig struct {
+	Bindings []RoleBinding `yaml:"bindings"`
+}
+
+// RoleBinding grants Role on Repositories to the users and the members of the groups.
+type RoleBinding struct {
+	Name string `yaml:"name,omitempty"`
+	Role string `yaml:"role"`
+	// Repositories are globs of a project, such as "ml", or of "project/name", such as "library/llama*".
+	Repositories []string `yaml:"repositories"`
+	// Users are matched with the subject of the token.
+	Users  []string `yaml:"users,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
+}
+
+func LoadRBACConfig(file string) (*RBACConfig, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &RBACConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("rbac config %s: %w", file, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("rbac config %s: %w", file, err)
+	}
+	return config, nil
+}
+
+func (c *RBACConfig) Validate() error {
+	for i, binding := range c.Bindings {
+		name := binding.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if !slices.Contains(Roles, binding.Role) {
+			return fmt.Errorf("binding %s: role must be one of %s", name, strings.Join(Roles, ", "))
+		}
+		if len(binding.Repositories) == 0 {
+			return fmt.Errorf("binding %s: repositories must be set", name)
+		}
+		for _, pattern := range binding.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("binding %s: repository %s: %w", name, pattern, err)
+			}
+		}
+		if len(binding.Users) == 0 && len(binding.Groups) == 0 {
+			return fmt.Errorf("binding %s: users or groups must be set", name)
+		}
+	}
+	return nil
+}
+
+// RoleAllows reports whether role allows all that required does.
+func RoleAllows(role, required string) bool {
+	return slices.Index(Roles, role) >= slices.Index(Roles, required)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ReplicationTriggerEvent replicates a version as soon as it is pushed or deleted.
+	ReplicationTriggerEvent = "event"
+	// ReplicationTriggerSchedule syncs the matching repositories every interval.
+	ReplicationTriggerSchedule = "schedule"
+
+	DefaultReplicationRetries = 3
+)
+
+type ReplicationOptions struct {
+	// ConfigFile is the yaml file of the replication rules, nothing is replicated without it.
+	ConfigFile string `yaml:"configFile"`
+}
+
+func NewDefaultReplicationOptions() *ReplicationOptions {
+	return &ReplicationOptions{ConfigFile: ""}
+}
+
+// ReplicationConfig is the content of ReplicationOptions.ConfigFile:
+//
+//	rules:
+//	  - name: to-shanghai
+//	    repository: "library/*"
+//	    target: https://modelx.sh.example.com
+//	    token: xxx
+//	    trigger: event
+//	    deletion: true
+//	  - repository: "nightly/*"
+//	    target: https://modelx.bj.example.com
+//	    username: admin
+//	    password: xxx
+//	    trigger: schedule
+//	    interval: 1h
+type ReplicationConfig struct {
+	Rules []ReplicationRule `yaml:"rules"`
+}
+
+// ReplicationRule copies the versions of the repositories matching Repository to the Target registry,
+// with the blobs the target is missing.
+type ReplicationRule struct {
+	// Name identifies the rule in its status, it defaults to the repository and the target.
+	Name string `yaml:"name,omitempty"`
+	// Repository is a glob of "project/name", such as "library/*". Every matching rule applies.
+	Repository string `yaml:"repository"`
+	// Target is the url of the modelxd to replicate to.
+	Target string `yaml:"target"`
+	// Username and Password authenticate to the target with basic auth, Token with a bearer token.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Token    string `yaml:"token,omitempty"`
+	// Trigger is event or schedule, it defaults to event.
+	Trigger string `yaml:"trigger,omitempty"`
+	// Interval between the syncs of a scheduled rule.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Deletion propagates deleted versions and repositories to the target.
+	Deletion bool `yaml:"deletion,omitempty"`
+	// Retries of a failed replication, it defaults to DefaultReplicationRetries.
+	Retries int `yaml:"retries,omitempty"`
+}
+
+func LoadReplicationConfig(file string) (*ReplicationConfig, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &ReplicationConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("replication config %s: %w", file, err)
+	}
+	config.setDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("replication config %s: %w", file, err)
+	}
+	return config, nil
+}
+
+func (c *ReplicationConfig) setDefaults() {
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Name == "" {
+			rule.Name = rule.Repository + " -> " + rule.Target
+		}
+		if rule.Trigger == "" {
+			rule.Trigger = ReplicationTriggerEvent
+		}
+		if rule.Retries == 0 {
+			rule.Retries = DefaultReplicationRetries
+		}
+	}
+}
+
+func (c *ReplicationConfig) Validate() error {
+	names := map[string]struct{}{}
+	for i, rule := range c.Rules {
+		if rule.Repository == "" {
+			return fmt.Errorf("rule %d: repository is required", i)
+		}
+		if _, err := path.Match(rule.Repository, ""); err != nil {
+			return fmt.Errorf("rule %d: repository %s: %w", i, rule.Repository, err)
+		}
+		target, err := url.Parse(rule.Target)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return fmt.Errorf("rule %d: target %q must be a http or https url", i, rule.Target)
+		}
+		switch rule.Trigger {
+		case ReplicationTriggerEvent:
+		case ReplicationTriggerSchedule:
+			if rule.Interval <= 0 {
+				return fmt.Errorf("rule %d: interval is required by a scheduled rule", i)
+			}
+		default:
+			return fmt.Errorf("rule %d: unknown trigger %s", i, rule.Trigger)
+		}
+		if rule.Retries < 0 {
+			return fmt.Errorf("rule %d: retries must not be negative", i)
+		}
+		if _, ok := names[rule.Name]; ok {
+			return fmt.Errorf("rule %d: duplicated name %s", i, rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+	}
+	return nil
+}
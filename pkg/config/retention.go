@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type RetentionOptions struct {
+	// ConfigFile is the yaml file of the retention rules, retention is disabled without it.
+	ConfigFile string `yaml:"configFile"`
+	// Interval between scheduled retention runs, 0 disables the scheduler.
+	Interval time.Duration `yaml:"interval"`
+	// DryRun makes scheduled runs only report the versions they would prune.
+	DryRun bool `yaml:"dryRun"`
+}
+
+func NewDefaultRetentionOptions() *RetentionOptions {
+	return &RetentionOptions{
+		ConfigFile: "",
+		Interval:   24 * time.Hour,
+		DryRun:     false,
+	}
+}
+
+// RetentionConfig is the content of RetentionOptions.ConfigFile:
+//
+//	rules:
+//	  - repository: "nightly/*"
+//	    keepLast: 10
+//	    maxAge: 720h
+//	    keepRegexp: '^v\d+\.\d+\.\d+$'
+type RetentionConfig struct {
+	Rules []RetentionRule `yaml:"rules"`
+}
+
+// RetentionRule prunes the versions of the repositories matching Repository.
+// A version is kept if it matches KeepRegexp or is one of the KeepLast most recent others,
+// the rest is pruned once older than MaxAge, or right away if MaxAge is not set.
+type RetentionRule struct {
+	// Repository is a glob of "project/name", such as "nightly/*". The first matching rule applies.
+	Repository string        `yaml:"repository"`
+	KeepLast   int           `yaml:"keepLast,omitempty"`
+	MaxAge     time.Duration `yaml:"maxAge,omitempty"`
+	KeepRegexp string        `yaml:"keepRegexp,omitempty"`
+}
+
+func LoadRetentionConfig(file string) (*RetentionConfig, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &RetentionConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("retention config %s: %w", file, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("retention config %s: %w", file, err)
+	}
+	return config, nil
+}
+
+func (c *RetentionConfig) Validate() error {
+	for i, rule := range c.Rules {
+		if rule.Repository == "" {
+			return fmt.Errorf("rule %d: repository is required", i)
+		}
+		if _, err := path.Match(rule.Repository, ""); err != nil {
+			return fmt.Errorf("rule %d: repository %s: %w", i, rule.Repository, err)
+		}
+		if rule.KeepLast < 0 || rule.MaxAge < 0 {
+			return fmt.Errorf("rule %d: keepLast and maxAge must not be negative", i)
+		}
+		if rule.KeepLast == 0 && rule.MaxAge == 0 {
+			return fmt.Errorf("rule %d: one of keepLast and maxAge is required", i)
+		}
+		if _, err := regexp.Compile(rule.KeepRegexp); err != nil {
+			return fmt.Errorf("rule %d: keepRegexp %s: %w", i, rule.KeepRegexp, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultWebhookTimeout    = 10 * time.Second
+	DefaultWebhookMaxRetries = 10
+)
+
+// the name of an endpoint is also the name of its queue directory
+var webhookNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+type WebhookOptions struct {
+	// ConfigFile is the yaml file of the webhook endpoints, no event is sent without it.
+	ConfigFile string `yaml:"configFile"`
+	// QueueDir keeps the events not delivered yet, so they survive a restart.
+	QueueDir string `yaml:"queueDir"`
+}
+
+func NewDefaultWebhookOptions() *WebhookOptions {
+	return &WebhookOptions{
+		ConfigFile: "",
+		QueueDir:   "data/webhooks",
+	}
+}
+
+// WebhookConfig is the content of WebhookOptions.ConfigFile:
+//
+//	webhooks:
+//	  - name: ci
+//	    url: https://ci.example.com/hooks/modelx
+//	    secret: xxx
+//	    events: ["manifest.push", "manifest.delete"]
+//	  - name: serving
+//	    url: https://serving.example.com/modelx
+//	    timeout: 30s
+//	    maxRetries: 20
+type WebhookConfig struct {
+	Webhooks []WebhookEndpoint `yaml:"webhooks"`
+}
+
+// WebhookEndpoint receives the events as json posts, signed with Secret.
+type WebhookEndpoint struct {
+	// Name identifies the endpoint and its queue directory.
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Secret signs the body with HMAC-SHA256, the signature is not sent without it.
+	Secret string `yaml:"secret,omitempty"`
+	// Events are the event types sent to the endpoint, all of them if empty.
+	Events []string `yaml:"events,omitempty"`
+	// Timeout of a delivery, it defaults to DefaultWebhookTimeout.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// MaxRetries of a delivery before the event is dropped, it defaults to DefaultWebhookMaxRetries.
+	MaxRetries int `yaml:"maxRetries,omitempty"`
+}
+
+func LoadWebhookConfig(file string) (*WebhookConfig, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &WebhookConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("webhook config %s: %w", file, err)
+	}
+	for i := range config.Webhooks {
+		endpoint := &config.Webhooks[i]
+		if endpoint.Timeout == 0 {
+			endpoint.Timeout = DefaultWebhookTimeout
+		}
+		if endpoint.MaxRetries == 0 {
+			endpoint.MaxRetries = DefaultWebhookMaxRetries
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("webhook config %s: %w", file, err)
+	}
+	return config, nil
+}
+
+func (c *WebhookConfig) Validate() error {
+	names := map[string]struct{}{}
+	for i, endpoint := range c.Webhooks {
+		if endpoint.Name == "" {
+			return fmt.Errorf("webhook %d: name is required", i)
+		}
+		if !webhookNameRegexp.MatchString(endpoint.Name) {
+			return fmt.Errorf("webhook %d: name %s must start with a letter or digit, followed by letters, digits, '.', '_' or '-'", i, endpoint.Name)
+		}
+		if _, ok := names[endpoint.Name]; ok {
+			return fmt.Errorf("webhook %d: duplicated name %s", i, endpoint.Name)
+		}
+		names[endpoint.Name] = struct{}{}
+		u, err := url.Parse(endpoint.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %d: url %q must be a http or https url", i, endpoint.URL)
+		}
+		if endpoint.Timeout < 0 || endpoint.MaxRetries < 0 {
+			return fmt.Errorf("webhook %d: timeout and maxRetries must not be negative", i)
+		}
+	}
+	return nil
+}
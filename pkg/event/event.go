@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package event
+
+import (
+	"sync"
+	"time"
+
+	logging "github.com/kubeservice-stack/common/pkg/logger"
+	"github.com/opencontainers/go-digest"
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+var eventLogger = logging.GetLogger("pkg/event", "event")
+
+type Type string
+
+const (
+	TypeManifestPush     Type = "manifest.push"
+	TypeManifestDelete   Type = "manifest.delete"
+	TypeRepositoryDelete Type = "repository.delete"
+	TypeBlobGC           Type = "blob.gc"
+	TypeBlobsCopy        Type = "blobs.copy"
+)
+
+var Types = []Type{TypeManifestPush, TypeManifestDelete, TypeRepositoryDelete, TypeBlobGC, TypeBlobsCopy}
+
+// Event is a change of the registry.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      Type      `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	// Repository is empty for a blob removed from the global blob pool.
+	Repository string `json:"repository,omitempty"`
+	Reference  string `json:"reference,omitempty"`
+	// Digest is the digest of the manifest, or of the blob for blob.gc.
+	Digest digest.Digest `json:"digest,omitempty"`
+	Size   int64         `json:"size,omitempty"`
+	// Source is the repository the blobs were copied from.
+	Source string `json:"source,omitempty"`
+	// Username is who made the change, empty for anonymous requests and scheduled jobs.
+	Username string `json:"username,omitempty"`
+}
+
+// Bus passes the published events to every subscriber, in the goroutine of the publisher.
+// Subscribers must not block, they queue the events they handle slowly.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []func(Event)
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+func (b *Bus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Publish sets the id and the timestamp of the event if missing and passes it to the subscribers.
+func (b *Bus) Publish(e Event) {
+	if e.ID == "" {
+		e.ID = uuid.NewV4().String()
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+	eventLogger.Debug("publish event", zap.Any("type", e.Type), zap.Any("repository", e.Repository), zap.Any("reference", e.Reference))
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.subscribers {
+		fn(e)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package event
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/version"
+)
+
+const (
+	HeaderEvent    = "X-Modelx-Event"
+	HeaderDelivery = "X-Modelx-Delivery"
+	// HeaderSignature is "sha256=" and the hex HMAC-SHA256 of the body keyed by the endpoint secret.
+	HeaderSignature = "X-Modelx-Signature"
+
+	WebhookRetryBackoff    = time.Second
+	WebhookMaxRetryBackoff = 5 * time.Minute
+
+	// WebhookFailedDir keeps the events dropped after all retries, in the queue directory of the endpoint.
+	WebhookFailedDir = "failed"
+)
+
+// WebhookSink posts the events to a webhook endpoint.
+// An event is written to the queue directory of the endpoint when it is handled and removed once the endpoint
+// answered 2xx, so queued events survive a restart. Events are delivered one at a time in order, a failed delivery
+// is retried with backoff up to MaxRetries times before the event is moved to WebhookFailedDir.
+type WebhookSink struct {
+	Endpoint config.WebhookEndpoint
+
+	dir    string
+	types  map[Type]struct{}
+	client *http.Client
+	wakeup chan struct{}
+}
+
+func NewWebhookSink(endpoint config.WebhookEndpoint, queuedir string) (*WebhookSink, error) {
+	types := map[Type]struct{}{}
+	for _, name := range endpoint.Events {
+		if !slices.Contains(Types, Type(name)) {
+			return nil, fmt.Errorf("webhook %s: unknown event %s", endpoint.Name, name)
+		}
+		types[Type(name)] = struct{}{}
+	}
+	dir := filepath.Join(queuedir, endpoint.Name)
+	if err := os.MkdirAll(filepath.Join(dir, WebhookFailedDir), 0o755); err != nil {
+		return nil, err
+	}
+	return &WebhookSink{
+		Endpoint: endpoint,
+		dir:      dir,
+		types:    types,
+		client:   &http.Client{Timeout: endpoint.Timeout},
+		wakeup:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Sign returns the value of HeaderSignature for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handle queues the event if the endpoint wants its type.
+func (s *WebhookSink) Handle(e Event) {
+	if _, ok := s.types[e.Type]; len(s.types) > 0 && !ok {
+		return
+	}
+	if err := s.enqueue(e); err != nil {
+		eventLogger.Error("queue webhook event", zap.String("webhook", s.Endpoint.Name), zap.String("id", e.ID), zap.Error(err))
+		return
+	}
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the queued events until ctx is done.
+func (s *WebhookSink) Run(ctx context.Context) error {
+	eventLogger.Info("start webhook", zap.String("webhook", s.Endpoint.Name), zap.String("url", s.Endpoint.URL))
+	backoff, attempts := WebhookRetryBackoff, 0
+	for {
+		name, err := s.next()
+		if err != nil {
+			eventLogger.Error("list webhook queue", zap.String("webhook", s.Endpoint.Name), zap.Error(err))
+		}
+		if name == "" {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-s.wakeup:
+			case <-time.After(WebhookMaxRetryBackoff):
+			}
+			continue
+		}
+		err = s.deliver(ctx, name)
+		if err == nil {
+			_ = os.Remove(filepath.Join(s.dir, name))
+			backoff, attempts = WebhookRetryBackoff, 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		attempts++
+		if attempts > s.Endpoint.MaxRetries {
+			eventLogger.Error("drop webhook event", zap.String("webhook", s.Endpoint.Name), zap.String("event", name), zap.Int("attempts", attempts), zap.Error(err))
+			_ = os.Rename(filepath.Join(s.dir, name), filepath.Join(s.dir, WebhookFailedDir, name))
+			backoff, attempts = WebhookRetryBackoff, 0
+			continue
+		}
+		eventLogger.Warn("deliver webhook event", zap.String("webhook", s.Endpoint.Name), zap.String("event", name), zap.Int("attempts", attempts), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, WebhookMaxRetryBackoff)
+	}
+}
+
+// enqueue writes the event through a temporary file, queued files are named by time so they list in order.
+func (s *WebhookSink) enqueue(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), e.ID)
+	return os.Rename(f.Name(), filepath.Join(s.dir, name))
+}
+
+// next returns the name of the oldest queued event, empty if the queue is empty.
+func (s *WebhookSink) next() (string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return "", err
+	}
+	// entries are sorted by name
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		return entry.Name(), nil
+	}
+	return "", nil
+}
+
+func (s *WebhookSink) deliver(ctx context.Context, name string) error {
+	body, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	e := Event{}
+	if err := json.Unmarshal(body, &e); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "modelxd/"+version.Get().GitVersion)
+	req.Header.Set(HeaderEvent, string(e.Type))
+	req.Header.Set(HeaderDelivery, e.ID)
+	if s.Endpoint.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(s.Endpoint.Secret, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package event
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kubegems.io/modelx/pkg/config"
+)
+
+func TestSign(t *testing.T) {
+	assert := assert.New(t)
+	// echo -n '{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal("sha256=77325902caca812dc259733aacd046b73817372c777b8d95b402647474516e13", Sign("secret", []byte("{}")))
+	assert.NotEqual(Sign("secret", []byte("{}")), Sign("other", []byte("{}")))
+}
+
+func TestBusPublish(t *testing.T) {
+	assert := assert.New(t)
+	bus := NewBus()
+	received := []Event{}
+	bus.Subscribe(func(e Event) { received = append(received, e) })
+	bus.Publish(Event{Type: TypeManifestPush, Repository: "library/m", Reference: "v1"})
+	assert.Len(received, 1)
+	assert.NotEmpty(received[0].ID)
+	assert.False(received[0].Timestamp.IsZero())
+}
+
+func TestWebhookSink(t *testing.T) {
+	assert := assert.New(t)
+	delivered := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		delivered <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	endpoint := config.WebhookEndpoint{
+		Name:       "test",
+		URL:        server.URL,
+		Secret:     "secret",
+		Events:     []string{string(TypeManifestPush)},
+		Timeout:    time.Second,
+		MaxRetries: 3,
+	}
+	sink, err := NewWebhookSink(endpoint, dir)
+	assert.NoError(err)
+
+	// queued before running, like events left by a restart
+	sink.Handle(Event{ID: "1", Type: TypeManifestPush, Repository: "library/m", Reference: "v1"})
+	sink.Handle(Event{ID: "2", Type: TypeManifestDelete, Repository: "library/m", Reference: "v1"})
+	entries, _ := os.ReadDir(filepath.Join(dir, "test"))
+	assert.Len(entries, 2) // the event and the failed dir
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = sink.Run(ctx) }()
+
+	select {
+	case r := <-delivered:
+		body := <-bodies
+		assert.Equal(string(TypeManifestPush), r.Header.Get(HeaderEvent))
+		assert.Equal("1", r.Header.Get(HeaderDelivery))
+		assert.Equal(Sign("secret", body), r.Header.Get(HeaderSignature))
+	case <-time.After(10 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	assert.Eventually(func() bool {
+		name, _ := sink.next()
+		return name == ""
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNewWebhookSinkUnknownEvent(t *testing.T) {
+	_, err := NewWebhookSink(config.WebhookEndpoint{Name: "test", Events: []string{"unknown"}}, t.TempDir())
+	assert.Error(t, err)
+}
@@ -40,3 +40,19 @@ func TestHealthzRoute(t *testing.T) {
 	assert.Equal(200, w.Code)
 	assert.Len(w.Body.String(), 15)
 }
+
+func TestHealthzDraining(t *testing.T) {
+	assert := assert.New(t)
+	r := gin.New()
+	router.Router(r)
+	SetDraining(true)
+	defer SetDraining(false)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	r.ServeHTTP(w, req)
+
+	// liveness does not depend on the shutdown
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"status":"ok"}`, w.Body.String())
+}
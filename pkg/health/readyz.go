@@ -0,0 +1,157 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package healthz
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"kubegems.io/modelx/pkg/routers"
+)
+
+const (
+	ReadyzStatusOK       = "ok"
+	ReadyzStatusFailed   = "failed"
+	ReadyzStatusDraining = "draining"
+)
+
+// ReadinessCheck is a dependency the server needs to serve requests, such as its storage.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// ReadinessCheckResult is the result of a readiness check.
+type ReadinessCheckResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ReadinessResult is the response of the readiness check.
+type ReadinessResult struct {
+	Status string                 `json:"status"`
+	Checks []ReadinessCheckResult `json:"checks,omitempty"`
+}
+
+// readiness runs the checks at most once per ttl, the probes in between get the last result.
+type readiness struct {
+	checks  []ReadinessCheck
+	ttl     time.Duration
+	timeout time.Duration
+
+	mu        sync.Mutex
+	result    *ReadinessResult
+	checkedAt time.Time
+}
+
+var (
+	readinessChecks atomic.Pointer[readiness]
+	draining        atomic.Bool
+)
+
+// SetDraining makes the readiness check fail while the server is shutting down, so no more requests are routed to it.
+func SetDraining(v bool) {
+	draining.Store(v)
+}
+
+// SetReadinessChecks sets the checks run by the readiness check, each check has timeout to finish
+// and the result is cached for ttl so frequent probes stay cheap.
+func SetReadinessChecks(checks []ReadinessCheck, ttl, timeout time.Duration) {
+	readinessChecks.Store(&readiness{checks: checks, ttl: ttl, timeout: timeout})
+}
+
+func (r *readiness) check(ctx context.Context) ReadinessResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.result != nil && time.Since(r.checkedAt) < r.ttl {
+		return *r.result
+	}
+	result := &ReadinessResult{
+		Status: ReadyzStatusOK,
+		Checks: make([]ReadinessCheckResult, len(r.checks)),
+	}
+	wg := sync.WaitGroup{}
+	for i, check := range r.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result.Checks[i] = runReadinessCheck(ctx, check, r.timeout)
+		}()
+	}
+	wg.Wait()
+	for _, check := range result.Checks {
+		if check.Status != ReadyzStatusOK {
+			result.Status = ReadyzStatusFailed
+		}
+	}
+	r.result, r.checkedAt = result, time.Now()
+	return *result
+}
+
+func runReadinessCheck(ctx context.Context, check ReadinessCheck, timeout time.Duration) ReadinessCheckResult {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := check.Check(ctx)
+	result := ReadinessCheckResult{Name: check.Name, Status: ReadyzStatusOK, Latency: time.Since(start).String()}
+	if err != nil {
+		result.Status, result.Error = ReadyzStatusFailed, err.Error()
+	}
+	return result
+}
+
+// Readyz godoc
+// @Summary Readyz
+// @Schemes
+// @Description Readyz checks the dependencies of the server, such as its storage
+// @Tags healthz
+// @Accept json
+// @Produce json
+// @Success 200 {object} ReadinessResult
+// @Failure 503 {object} ReadinessResult
+// @Router /readyz [get]
+func Readyz(c *gin.Context) {
+	if draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, ReadinessResult{Status: ReadyzStatusDraining})
+		return
+	}
+	r := readinessChecks.Load()
+	if r == nil {
+		c.JSON(http.StatusOK, ReadinessResult{Status: ReadyzStatusOK})
+		return
+	}
+	// the checks are shared by the probes waiting on them, a probe going away does not cancel them
+	result := r.check(context.WithoutCancel(c.Request.Context()))
+	if result.Status != ReadyzStatusOK {
+		c.JSON(http.StatusServiceUnavailable, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func init() {
+	router.Register("readyz", "/", "readyz", http.MethodGet, Readyz)
+}
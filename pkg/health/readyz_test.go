@@ -0,0 +1,130 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package healthz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"kubegems.io/modelx/pkg/routers"
+)
+
+func readyz(r *gin.Engine) (int, ReadinessResult) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	r.ServeHTTP(w, req)
+	result := ReadinessResult{}
+	_ = json.Unmarshal(w.Body.Bytes(), &result)
+	return w.Code, result
+}
+
+func TestReadyz(t *testing.T) {
+	assert := assert.New(t)
+	r := gin.New()
+	router.Router(r)
+	defer readinessChecks.Store(nil)
+
+	// no checks set
+	code, result := readyz(r)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(ReadyzStatusOK, result.Status)
+
+	var storageErr atomic.Pointer[error]
+	calls := atomic.Int32{}
+	SetReadinessChecks([]ReadinessCheck{
+		{Name: "ok", Check: func(ctx context.Context) error { return nil }},
+		{Name: "storage", Check: func(ctx context.Context) error {
+			calls.Add(1)
+			if err := storageErr.Load(); err != nil {
+				return *err
+			}
+			return nil
+		}},
+	}, time.Hour, time.Second)
+
+	code, result = readyz(r)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(ReadyzStatusOK, result.Status)
+	if assert.Len(result.Checks, 2) {
+		assert.Equal("ok", result.Checks[0].Name)
+		assert.Equal("storage", result.Checks[1].Name)
+		assert.Equal(ReadyzStatusOK, result.Checks[1].Status)
+		assert.NotEmpty(result.Checks[1].Latency)
+	}
+
+	// cached until the ttl
+	err := errors.New("bucket unreachable")
+	storageErr.Store(&err)
+	code, _ = readyz(r)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(int32(1), calls.Load())
+
+	SetReadinessChecks(readinessChecks.Load().checks, 0, time.Second)
+	code, result = readyz(r)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(ReadyzStatusFailed, result.Status)
+	if assert.Len(result.Checks, 2) {
+		assert.Equal(ReadyzStatusOK, result.Checks[0].Status)
+		assert.Equal(ReadyzStatusFailed, result.Checks[1].Status)
+		assert.Equal("bucket unreachable", result.Checks[1].Error)
+	}
+	assert.Equal(int32(2), calls.Load())
+}
+
+func TestReadyzTimeout(t *testing.T) {
+	assert := assert.New(t)
+	r := gin.New()
+	router.Router(r)
+	defer readinessChecks.Store(nil)
+
+	SetReadinessChecks([]ReadinessCheck{
+		{Name: "storage", Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	}, 0, 10*time.Millisecond)
+
+	code, result := readyz(r)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	if assert.Len(result.Checks, 1) {
+		assert.Equal(context.DeadlineExceeded.Error(), result.Checks[0].Error)
+	}
+}
+
+func TestReadyzDraining(t *testing.T) {
+	assert := assert.New(t)
+	r := gin.New()
+	router.Router(r)
+	SetDraining(true)
+	defer SetDraining(false)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(`{"status":"draining"}`, w.Body.String())
+}
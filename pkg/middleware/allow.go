@@ -18,6 +18,7 @@ package middleware
 
 import (
 	"net"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -41,6 +42,19 @@ var defaultAllowPath = map[string]AllowConfig{
 		HostAllowDomain: false,
 		HostAllowIP:     true,
 	},
+	"readyz": {
+		HostAllowDomain: false,
+		HostAllowIP:     true,
+	},
+}
+
+// probeRoutes are the health checks of the kubelet and the load balancers,
+// they carry no credentials and must not be rejected by the authentication, authorization and rate limits.
+var probeRoutes = []string{"/healthz", "/readyz"}
+
+// isProbe reports whether the request is a health check.
+func isProbe(c *gin.Context) bool {
+	return slices.Contains(probeRoutes, c.FullPath())
 }
 
 type AllowConfig struct {
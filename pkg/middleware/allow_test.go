@@ -19,11 +19,15 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+
+	"kubegems.io/modelx/pkg/config"
 )
 
 func TestAllow(t *testing.T) {
@@ -60,3 +64,44 @@ func TestAllowWithHost(t *testing.T) {
 	assert.Equal(http.StatusOK, w.Code)
 	assert.Equal("true", w.Body.String())
 }
+
+func TestProbesSkipAuth(t *testing.T) {
+	assert := assert.New(t)
+	tokens := filepath.Join(t.TempDir(), "tokens.yaml")
+	assert.NoError(os.WriteFile(tokens, []byte("tokens:\n  - token: t1\n    username: ci\n"), 0o600))
+	authenticators, err := NewAuthenticators(&config.AuthOptions{TokenFile: tokens})
+	assert.NoError(err)
+	SetAuthenticators(authenticators)
+	defer SetAuthenticators(nil)
+	SetRBACPolicy(&config.RBACConfig{Bindings: []config.RoleBinding{{Role: config.RoleAdmin, Repositories: []string{"*"}, Users: []string{"ci"}}}})
+	defer SetRBACPolicy(nil)
+	SetRateLimits(&config.RateLimitConfig{IP: config.RateLimit{Rate: 0.001, Burst: 1}})
+	defer SetRateLimits(nil)
+	origin := config.GlobalModelxdOptions.OIDC
+	config.GlobalModelxdOptions.OIDC = &config.OIDCOptions{Issuer: "http://127.0.0.1:1/"}
+	defer func() { config.GlobalModelxdOptions.OIDC = origin }()
+
+	for _, middlewares := range [][]gin.HandlerFunc{
+		{OIDCAuthFunc(), RBACFunc(), RateLimitFunc()},
+		{AuthnFunc(), RBACFunc(), RateLimitFunc()},
+	} {
+		router := gin.New()
+		router.Use(middlewares...)
+		handler := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+		router.GET("/healthz", handler)
+		router.GET("/readyz", handler)
+		router.GET("/:repository/:name/index", handler)
+		do := func(path string) int {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		for range 3 {
+			assert.Equal(http.StatusOK, do("/healthz"))
+			assert.Equal(http.StatusOK, do("/readyz"))
+		}
+		assert.Equal(http.StatusUnauthorized, do("/library/llama/index"))
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"slices"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+type anonymousKey struct{}
+
+// AnonymousFromContext reports whether the request is let through without credentials,
+// as it only pulls from the anonymous projects. The global listings must be filtered with AnonymousProject.
+func AnonymousFromContext(ctx context.Context) bool {
+	anonymous, _ := ctx.Value(anonymousKey{}).(bool)
+	return anonymous
+}
+
+var anonymousProjects atomic.Pointer[[]string]
+
+// SetAnonymousProjects replaces the globs of the projects anyone may pull from, nil disables the anonymous pulls.
+func SetAnonymousProjects(projects []string) {
+	anonymousProjects.Store(&projects)
+}
+
+func loadAnonymousProjects() []string {
+	if projects := anonymousProjects.Load(); projects != nil {
+		return *projects
+	}
+	return nil
+}
+
+// AnonymousProject reports whether anyone may pull from the project without credentials.
+func AnonymousProject(project string) bool {
+	return slices.ContainsFunc(loadAnonymousProjects(), func(pattern string) bool {
+		matched, _ := path.Match(pattern, project)
+		return matched
+	})
+}
+
+// global listings filtered for the anonymous requests
+var anonymousListingRoutes = []string{"/", "/v2/", "/v2/_catalog"}
+
+// allowAnonymous reports whether the request without credentials may go on,
+// the request is then marked as anonymous.
+func allowAnonymous(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead || isUploadLocation(c) {
+		return false
+	}
+	if len(loadAnonymousProjects()) == 0 {
+		return false
+	}
+	if project := c.Param("repository"); project != "" {
+		if !AnonymousProject(project) {
+			return false
+		}
+	} else if !slices.Contains(anonymousListingRoutes, c.FullPath()) {
+		return false
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), anonymousKey{}, true))
+	return true
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"kubegems.io/modelx/pkg/config"
+)
+
+func TestAnonymousPull(t *testing.T) {
+	assert := assert.New(t)
+	tokens := filepath.Join(t.TempDir(), "tokens.yaml")
+	assert.NoError(os.WriteFile(tokens, []byte("tokens:\n  - token: t1\n    username: ci\n"), 0o600))
+	options := &config.AuthOptions{TokenFile: tokens, AnonymousProjects: []string{"public", "demo-*"}}
+	authenticators, err := NewAuthenticators(options)
+	assert.NoError(err)
+	SetAuthenticators(authenticators)
+	defer SetAuthenticators(nil)
+	SetAnonymousProjects(options.AnonymousProjects)
+	defer SetAnonymousProjects(nil)
+
+	router := gin.New()
+	router.Use(AuthnFunc())
+	handler := func(c *gin.Context) {
+		if AnonymousFromContext(c.Request.Context()) {
+			c.String(http.StatusOK, "anonymous")
+			return
+		}
+		c.String(http.StatusOK, UsernameFromContext(c.Request.Context()))
+	}
+	router.GET("/", handler)
+	router.Any("/:repository/:name/index", handler)
+	router.GET("/:repository/:name/blobs/:digest/locations/:purpose", handler)
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodGet, "/public/m/index", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("anonymous", w.Body.String())
+	assert.Equal(http.StatusOK, do(http.MethodHead, "/demo-1/m/index", "").Code)
+	assert.Equal("anonymous", do(http.MethodGet, "/", "").Body.String())
+
+	assert.Equal(http.StatusUnauthorized, do(http.MethodDelete, "/public/m/index", "").Code)
+	assert.Equal("anonymous", do(http.MethodGet, "/public/m/blobs/sha256:abc/locations/download", "").Body.String())
+	assert.Equal(http.StatusUnauthorized, do(http.MethodGet, "/public/m/blobs/sha256:abc/locations/upload", "").Code)
+	assert.Equal(http.StatusUnauthorized, do(http.MethodGet, "/private/m/index", "").Code)
+	// credentials are still checked when given
+	assert.Equal(http.StatusUnauthorized, do(http.MethodGet, "/public/m/index", "wrong").Code)
+	assert.Equal("ci", do(http.MethodDelete, "/public/m/index", "t1").Body.String())
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"kubegems.io/modelx/pkg/audit"
+)
+
+const (
+	AUDIT = "AUDIT"
+	// runs before the authentication, so the denied requests are recorded too
+	AUDITWEIGHT = 1010
+)
+
+var auditLog atomic.Pointer[audit.FileLog]
+
+// SetAuditLog sets where the records are appended, nil disables the audit.
+func SetAuditLog(l *audit.FileLog) {
+	auditLog.Store(l)
+}
+
+// AuditFunc records the mutating requests once handled, with the user the authentication set.
+func AuditFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		l := auditLog.Load()
+		if l == nil {
+			return
+		}
+		operation := auditOperation(c)
+		if operation == "" {
+			return
+		}
+		ctx := c.Request.Context()
+		record := audit.Record{
+			Time:      start.UTC(),
+			Operation: operation,
+			Username:  UsernameFromContext(ctx),
+			ClientIP:  c.ClientIP(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Reference: c.Param("reference"),
+			Digest:    c.Param("digest"),
+			Status:    c.Writer.Status(),
+			Result:    audit.ResultSuccess,
+		}
+		if requestID, ok := ctx.Value(String("requestID")).(string); ok {
+			record.RequestID = requestID
+		} else {
+			// denied before RequestInfo ran
+			record.RequestID = c.GetHeader("requestID")
+		}
+		if project := c.Param("repository"); project != "" {
+			record.Repository = strings.TrimSuffix(project+"/"+c.Param("name"), "/")
+		}
+		if to := c.Param("repositoryto"); to != "" {
+			record.Repository = to + "/" + c.Param("nameto")
+			record.Reference = c.Param("referenceto")
+			record.Source = c.Param("repositoryfrom") + "/" + c.Param("namefrom") + "@" + c.Param("referencefrom")
+		}
+		if record.Status >= http.StatusBadRequest {
+			record.Result = audit.ResultFailure
+		}
+		if err := l.Append(record); err != nil {
+			ginLogger.Error("append audit record", zap.Error(err))
+		}
+	}
+}
+
+// RecordAudit appends a record of an operation made without a request, nothing is recorded if the audit is disabled.
+func RecordAudit(record audit.Record) {
+	l := auditLog.Load()
+	if l == nil {
+		return
+	}
+	if err := l.Append(record); err != nil {
+		ginLogger.Error("append audit record", zap.Error(err))
+	}
+}
+
+// auditOperation names the mutating operation of the route, empty for the reads and the upload chunks.
+func auditOperation(c *gin.Context) string {
+	route, method := c.FullPath(), c.Request.Method
+	if route == "" {
+		return ""
+	}
+	switch method {
+	case http.MethodGet:
+		if isUploadLocation(c) {
+			return "GrantUploadLocation"
+		}
+		return ""
+	case http.MethodHead, http.MethodOptions, http.MethodPatch:
+		return ""
+	}
+	switch {
+	case strings.Contains(route, "/manifests/"):
+		if method == http.MethodDelete {
+			return "DeleteManifest"
+		}
+		return "PutManifest"
+	case strings.HasSuffix(route, "/index"):
+		return "DeleteIndex"
+	case strings.HasPrefix(route, "/copys/"):
+		return "CopyBlobs"
+	case strings.HasSuffix(route, "/garbage-collect"):
+		return "GarbageCollect"
+	case strings.HasSuffix(route, "/retention"):
+		return "ApplyRetention"
+	case strings.Contains(route, "/uploads"):
+		switch method {
+		case http.MethodPost:
+			return "StartBlobUpload"
+		case http.MethodDelete:
+			return "CancelBlobUpload"
+		}
+		return "CommitBlobUpload"
+	case strings.Contains(route, "/blobs/"):
+		if method == http.MethodDelete {
+			return "DeleteBlob"
+		}
+		return "PutBlob"
+	}
+	return method + " " + route
+}
+
+func init() {
+	Register(&Instance{Name: AUDIT, F: AuditFunc, Weight: AUDITWEIGHT})
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"kubegems.io/modelx/pkg/audit"
+	"kubegems.io/modelx/pkg/auth"
+)
+
+func TestAudit(t *testing.T) {
+	assert := assert.New(t)
+	l, err := audit.NewFileLog(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	assert.NoError(err)
+	defer l.Close()
+	SetAuditLog(l)
+	defer SetAuditLog(nil)
+
+	router := gin.New()
+	router.Use(AuditFunc(), RequestInfo(), func(c *gin.Context) {
+		if c.GetHeader("X-User") == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Request = c.Request.WithContext(NewUserInfoContext(c.Request.Context(), &auth.UserInfo{Username: c.GetHeader("X-User")}))
+	})
+	handler := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/:repository/:name/manifests/:reference", handler)
+	router.DELETE("/:repository/:name/manifests/:reference", handler)
+	router.DELETE("/:repository/:name/index", handler)
+	router.GET("/:repository/:name/blobs/:digest/locations/:purpose", handler)
+	router.PUT("/copys/:repositoryto/:nameto/:referenceto/:repositoryfrom/:namefrom/:referencefrom", handler)
+
+	do := func(user, method, path string) {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-User", user)
+		req.Header.Set("requestID", "r-"+user)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	do("alice", http.MethodGet, "/prod/ranker/manifests/v12")
+	do("alice", http.MethodDelete, "/prod/ranker/manifests/v12")
+	do("", http.MethodDelete, "/prod/ranker/index")
+	do("bob", http.MethodGet, "/prod/ranker/blobs/sha256:abc/locations/download")
+	do("bob", http.MethodGet, "/prod/ranker/blobs/sha256:abc/locations/upload")
+	do("bob", http.MethodPut, "/copys/prod/ranker/v13/dev/ranker/v1")
+
+	records, err := l.Query(audit.Query{})
+	assert.NoError(err)
+	assert.Len(records, 4)
+
+	assert.Equal("CopyBlobs", records[0].Operation)
+	assert.Equal("prod/ranker", records[0].Repository)
+	assert.Equal("v13", records[0].Reference)
+	assert.Equal("dev/ranker@v1", records[0].Source)
+
+	assert.Equal("GrantUploadLocation", records[1].Operation)
+	assert.Equal("sha256:abc", records[1].Digest)
+
+	// denied before the handler
+	assert.Equal("DeleteIndex", records[2].Operation)
+	assert.Equal(http.StatusUnauthorized, records[2].Status)
+	assert.Equal(audit.ResultFailure, records[2].Result)
+	assert.Empty(records[2].Username)
+
+	assert.Equal("DeleteManifest", records[3].Operation)
+	assert.Equal("alice", records[3].Username)
+	assert.Equal("r-alice", records[3].RequestID)
+	assert.Equal("prod/ranker", records[3].Repository)
+	assert.Equal("v12", records[3].Reference)
+	assert.Equal(audit.ResultSuccess, records[3].Result)
+	assert.NotEmpty(records[3].ClientIP)
+}
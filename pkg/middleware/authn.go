@@ -0,0 +1,194 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"kubegems.io/modelx/pkg/auth"
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/response"
+)
+
+type userInfoKey struct{}
+
+// UserInfoFromContext returns the authenticated user, nil for anonymous requests.
+func UserInfoFromContext(ctx context.Context) *auth.UserInfo {
+	if user, ok := ctx.Value(userInfoKey{}).(*auth.UserInfo); ok {
+		return user
+	}
+	return nil
+}
+
+// NewUserInfoContext sets the user and its name.
+func NewUserInfoContext(ctx context.Context, user *auth.UserInfo) context.Context {
+	ctx = NewUsernameContext(ctx, user.Username)
+	return context.WithValue(ctx, userInfoKey{}, user)
+}
+
+const (
+	AUTHN = "AUTHN"
+	// runs after OIDC, a request OIDC authenticated is not authenticated again
+	AUTHNWEIGHT = 998
+)
+
+// Authenticators are the built-in authenticators besides OIDC.
+type Authenticators struct {
+	Token auth.TokenAuthenticators
+	Basic []auth.BasicAuthenticator
+}
+
+var authenticators atomic.Pointer[Authenticators]
+
+// SetAuthenticators replaces the built-in authenticators, nil disables them.
+func SetAuthenticators(a *Authenticators) {
+	authenticators.Store(a)
+}
+
+// NewAuthenticators returns the built-in authenticators configured in options.
+func NewAuthenticators(options *config.AuthOptions) (*Authenticators, error) {
+	authenticators := &Authenticators{}
+	if options == nil {
+		return authenticators, nil
+	}
+	if options.TokenFile != "" {
+		static, err := auth.NewStaticTokenAuthenticator(options.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators.Token = append(authenticators.Token, static)
+	}
+	if options.WebhookURL != "" {
+		authenticators.Token = append(authenticators.Token, auth.NewWebhookAuthenticator(options.WebhookURL, options.WebhookTimeout, options.WebhookCacheTTL))
+	}
+	if options.HtpasswdFile != "" {
+		htpasswd, err := auth.NewHtpasswdAuthenticator(options.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators.Basic = append(authenticators.Basic, htpasswd)
+	}
+	return authenticators, nil
+}
+
+func (a *Authenticators) empty() bool {
+	return a == nil || (len(a.Token) == 0 && len(a.Basic) == 0)
+}
+
+// authenticate authenticates the basic auth, or else the bearer token of the request.
+func (a *Authenticators) authenticate(c *gin.Context) (*auth.UserInfo, error) {
+	ctx := c.Request.Context()
+	if username, password, ok := c.Request.BasicAuth(); ok && len(a.Basic) > 0 {
+		for _, authenticator := range a.Basic {
+			user, err := authenticator.AuthenticateBasic(ctx, username, password)
+			if err == nil || !errors.Is(err, auth.ErrInvalidToken) {
+				return user, err
+			}
+		}
+		return nil, auth.ErrInvalidToken
+	}
+	token := BearerToken(c)
+	if token == "" || len(a.Token) == 0 {
+		return nil, errMissingCredentials
+	}
+	return a.Token.AuthenticateToken(ctx, token)
+}
+
+var errMissingCredentials = errors.New("missing access token")
+
+// AuthnFunc authenticates the requests with the built-in authenticators,
+// and denies the requests the scopes of the token do not allow.
+func AuthnFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authenticators := authenticators.Load()
+		if authenticators.empty() || isProbe(c) {
+			c.Next()
+			return
+		}
+		user := UserInfoFromContext(c.Request.Context())
+		if user == nil {
+			authenticated, err := authenticators.authenticate(c)
+			if errors.Is(err, errMissingCredentials) && allowAnonymous(c) {
+				c.Next()
+				return
+			}
+			if err != nil {
+				msg := "invalid access token"
+				switch {
+				case errors.Is(err, errMissingCredentials):
+					msg = err.Error()
+				case !errors.Is(err, auth.ErrInvalidToken):
+					ginLogger.Error("authenticate request", zap.Error(err))
+				}
+				if len(authenticators.Basic) > 0 {
+					c.Header("WWW-Authenticate", `Basic realm="modelx"`)
+				}
+				response.ResponseError(c.Writer, response.NewUnauthorizedError(msg))
+				c.Abort()
+				return
+			}
+			user = authenticated
+			c.Request = c.Request.WithContext(NewUserInfoContext(c.Request.Context(), user))
+		}
+		if scope := requestScope(c); !user.HasScope(scope) {
+			response.ResponseError(c.Writer, response.NewDeniedError("token does not allow "+scope))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// BearerToken returns the token of the Authorization header, or of the token or access_token query.
+func BearerToken(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && token != "" {
+		return token
+	}
+	queries := c.Request.URL.Query()
+	for _, k := range []string{"token", "access_token"} {
+		if token := queries.Get(k); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// requestScope returns the token scope the request needs, an upload location is a push.
+func requestScope(c *gin.Context) string {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if isUploadLocation(c) {
+			return auth.ScopePush
+		}
+		return auth.ScopePull
+	case http.MethodDelete:
+		return auth.ScopeDelete
+	default:
+		return auth.ScopePush
+	}
+}
+
+func init() {
+	Register(&Instance{Name: AUTHN, F: AuthnFunc, Weight: AUTHNWEIGHT})
+}
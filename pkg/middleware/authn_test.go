@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"kubegems.io/modelx/pkg/auth"
+	"kubegems.io/modelx/pkg/config"
+)
+
+func TestAuthnWebhook(t *testing.T) {
+	assert := assert.New(t)
+	reviews := atomic.Int32{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews.Add(1)
+		review := auth.TokenReview{}
+		_ = json.NewDecoder(r.Body).Decode(&review)
+		switch review.Spec.Token {
+		case "admin":
+			review.Status = auth.TokenReviewStatus{Authenticated: true, User: auth.UserInfo{Username: "alice", Groups: []string{"ml"}}}
+		case "reader":
+			review.Status = auth.TokenReviewStatus{Authenticated: true, User: auth.UserInfo{Username: "bob", Scopes: []string{auth.ScopePull}}}
+		}
+		_ = json.NewEncoder(w).Encode(review)
+	}))
+	defer webhook.Close()
+
+	authenticators, err := NewAuthenticators(&config.AuthOptions{WebhookURL: webhook.URL, WebhookTimeout: time.Second, WebhookCacheTTL: time.Minute})
+	assert.NoError(err)
+	SetAuthenticators(authenticators)
+	defer SetAuthenticators(nil)
+
+	router := gin.New()
+	router.Use(AuthnFunc())
+	handler := func(c *gin.Context) {
+		c.String(http.StatusOK, UsernameFromContext(c.Request.Context()))
+	}
+	router.Any("/test1", handler)
+	router.GET("/:repository/:name/blobs/:digest/locations/:purpose", handler)
+	doPath := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	do := func(method, token string) *httptest.ResponseRecorder {
+		return doPath(method, "/test1", token)
+	}
+
+	assert.Equal(http.StatusUnauthorized, do(http.MethodGet, "").Code)
+	assert.Equal(http.StatusUnauthorized, do(http.MethodGet, "unknown").Code)
+
+	w := do(http.MethodPut, "admin")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("alice", w.Body.String())
+
+	w = do(http.MethodGet, "reader")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("bob", w.Body.String())
+	assert.Equal(http.StatusForbidden, do(http.MethodPut, "reader").Code)
+	assert.Equal(http.StatusForbidden, do(http.MethodDelete, "reader").Code)
+	// an upload location needs the push scope
+	assert.Equal(http.StatusOK, doPath(http.MethodGet, "/ml/m/blobs/sha256:abc/locations/download", "reader").Code)
+	assert.Equal(http.StatusForbidden, doPath(http.MethodGet, "/ml/m/blobs/sha256:abc/locations/upload", "reader").Code)
+	assert.Equal(http.StatusOK, doPath(http.MethodGet, "/ml/m/blobs/sha256:abc/locations/upload", "admin").Code)
+
+	// reviews are cached, the rejected one included
+	assert.Equal(int32(3), reviews.Load())
+	assert.Equal(http.StatusUnauthorized, do(http.MethodGet, "unknown").Code)
+	assert.Equal(int32(3), reviews.Load())
+}
+
+func TestAuthnFiles(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(err)
+	htpasswd := filepath.Join(dir, "htpasswd")
+	assert.NoError(os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0o600))
+	tokens := filepath.Join(dir, "tokens.yaml")
+	assert.NoError(os.WriteFile(tokens, []byte("tokens:\n  - token: t1\n    username: ci\n    groups: [ml]\n"), 0o600))
+
+	authenticators, err := NewAuthenticators(&config.AuthOptions{HtpasswdFile: htpasswd, TokenFile: tokens})
+	assert.NoError(err)
+	SetAuthenticators(authenticators)
+	defer SetAuthenticators(nil)
+
+	router := gin.New()
+	router.Use(AuthnFunc())
+	router.GET("/test1", func(c *gin.Context) {
+		c.String(http.StatusOK, UsernameFromContext(c.Request.Context()))
+	})
+	do := func(setauth func(req *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/test1", nil)
+		setauth(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	basic := func(username, password string) func(req *http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(username, password) }
+	}
+	bearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	w := do(basic("alice", "secret"))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("alice", w.Body.String())
+	w = do(basic("alice", "wrong"))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal(`Basic realm="modelx"`, w.Header().Get("WWW-Authenticate"))
+
+	w = do(bearer("t1"))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ci", w.Body.String())
+	assert.Equal(http.StatusUnauthorized, do(bearer("t2")).Code)
+
+	// the files are reloaded once modified, a broken one keeps the previous content
+	assert.NoError(os.WriteFile(tokens, []byte("tokens:\n  - token: t2\n    username: ci2\n"), 0o600))
+	assert.NoError(os.Chtimes(tokens, time.Now(), time.Now().Add(time.Minute)))
+	assert.Equal(http.StatusUnauthorized, do(bearer("t1")).Code)
+	assert.Equal("ci2", do(bearer("t2")).Body.String())
+
+	assert.NoError(os.WriteFile(htpasswd, []byte("alice\n"), 0o600))
+	assert.NoError(os.Chtimes(htpasswd, time.Now(), time.Now().Add(time.Minute)))
+	assert.Equal(http.StatusOK, do(basic("alice", "secret")).Code)
+}
+
+func TestAuthnDisabled(t *testing.T) {
+	assert := assert.New(t)
+	router := gin.New()
+	router.Use(AuthnFunc())
+	router.GET("/test1", func(c *gin.Context) {
+		c.String(http.StatusOK, "dongjiang")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/test1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"kubegems.io/modelx/pkg/auth"
+	"kubegems.io/modelx/pkg/config"
+)
+
+const (
+	CLIENTCERT = "CLIENTCERT"
+	// runs before OIDC and AUTHN, a request with a verified client certificate is not authenticated again
+	CLIENTCERTWEIGHT = 1000
+)
+
+// ClientCertFunc authenticates the requests by their verified tls client certificate,
+// the username is the field of the certificate set in the tls options.
+func ClientCertFunc() gin.HandlerFunc {
+	field := config.TLSClientUsernameCN
+	if options := config.GlobalModelxdOptions.TLS; options != nil && options.ClientUsername != "" {
+		field = options.ClientUsername
+	}
+	return func(c *gin.Context) {
+		if user := auth.CertificateUser(c.Request.TLS, field); user != nil {
+			c.Request = c.Request.WithContext(NewUserInfoContext(c.Request.Context(), user))
+		}
+		c.Next()
+	}
+}
+
+func init() {
+	Register(&Instance{Name: CLIENTCERT, F: ClientCertFunc, Weight: CLIENTCERTWEIGHT})
+}
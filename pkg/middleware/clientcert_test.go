@@ -0,0 +1,184 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"kubegems.io/modelx/pkg/auth"
+	"kubegems.io/modelx/pkg/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestClientCert(t *testing.T, ca *testCert, cn string, orgs ...string) tls.Certificate {
+	c := newTestCert(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: cn, Organization: orgs},
+		EmailAddresses: []string{cn + "@example.com"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	pair, err := tls.X509KeyPair(c.pem, c.keyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestClientCert(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "modelxd"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	options := &config.TLSOptions{
+		CertFile:       filepath.Join(dir, "tls.crt"),
+		KeyFile:        filepath.Join(dir, "tls.key"),
+		CAFile:         filepath.Join(dir, "ca.crt"),
+		ClientUsername: config.TLSClientUsernameCN,
+	}
+	assert.NoError(os.WriteFile(options.CertFile, server.pem, 0o600))
+	assert.NoError(os.WriteFile(options.KeyFile, server.keyPEM(t), 0o600))
+	assert.NoError(os.WriteFile(options.CAFile, ca.pem, 0o600))
+	tlsconfig, err := auth.NewServerTLSConfig(options)
+	assert.NoError(err)
+
+	router := gin.New()
+	router.Use(ClientCertFunc())
+	router.GET("/", func(c *gin.Context) {
+		user := UserInfoFromContext(c.Request.Context())
+		c.String(http.StatusOK, user.Username+":"+strings.Join(user.Groups, ","))
+	})
+	srv := httptest.NewUnstartedServer(router)
+	srv.TLS = tlsconfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) (string, error) {
+		cli := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := cli.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	body, err := get(newTestClientCert(t, ca, "alice", "dev"))
+	assert.NoError(err)
+	assert.Equal("alice:dev", body)
+	// require-and-verify by default with the ca
+	_, err = get()
+	assert.Error(err)
+	_, err = get(newTestClientCert(t, newTestCA(t, "other"), "mallory"))
+	assert.Error(err)
+
+	// the ca is read again once modified
+	rotated := newTestCA(t, "rotated")
+	assert.NoError(os.WriteFile(options.CAFile, rotated.pem, 0o600))
+	future := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(options.CAFile, future, future))
+	body, err = get(newTestClientCert(t, rotated, "bob"))
+	assert.NoError(err)
+	assert.Equal("bob:", body)
+	_, err = get(newTestClientCert(t, ca, "alice"))
+	assert.Error(err)
+
+	// a broken ca keeps the previous one
+	assert.NoError(os.WriteFile(options.CAFile, []byte("broken"), 0o600))
+	_, err = get(newTestClientCert(t, rotated, "bob"))
+	assert.NoError(err)
+}
+
+func TestCertificateUser(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA(t, "ca")
+	leaf := newTestClientCert(t, ca, "alice", "dev", "ops").Leaf
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca.cert}}}
+
+	user := auth.CertificateUser(state, config.TLSClientUsernameCN)
+	assert.Equal(&auth.UserInfo{Username: "alice", Groups: []string{"dev", "ops"}}, user)
+	assert.Equal("alice@example.com", auth.CertificateUser(state, config.TLSClientUsernameEmail).Username)
+	// no dns name to use
+	assert.Nil(auth.CertificateUser(state, config.TLSClientUsernameDNS))
+	// unverified certificates are not users
+	assert.Nil(auth.CertificateUser(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}, config.TLSClientUsernameCN))
+	assert.Nil(auth.CertificateUser(nil, config.TLSClientUsernameCN))
+}
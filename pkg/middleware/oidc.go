@@ -18,12 +18,12 @@ package middleware
 
 import (
 	"context"
-	"strings"
+	"errors"
 
 	"go.uber.org/zap"
 
-	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/gin-gonic/gin"
+	"kubegems.io/modelx/pkg/auth"
 	"kubegems.io/modelx/pkg/config"
 	"kubegems.io/modelx/pkg/response"
 )
@@ -47,49 +47,57 @@ const (
 	OIDCProvider
 )
 
+// OIDCAuthFunc verifies the id tokens with the verifiers built once from the options,
+// the tokens it can not verify are left to the built-in authenticators if there are some.
+// The requests already authenticated by a client certificate are let through.
 func OIDCAuthFunc() gin.HandlerFunc {
+	options := config.GlobalModelxdOptions.OIDC
+	if options == nil || options.Issuer == "" {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	authenticator := auth.NewOIDCAuthenticator(auth.OIDCConfig{
+		Issuers:         options.TrustedIssuers(),
+		Audiences:       options.Audiences,
+		RequiredClaims:  options.RequiredClaims,
+		GroupsClaim:     options.GroupsClaim,
+		RefreshInterval: options.RefreshInterval,
+	})
 	return func(c *gin.Context) {
-		if config.GlobalModelxdOptions.OIDC != nil && config.GlobalModelxdOptions.OIDC.Issuer != "" {
-			reqCxt := c.Request.Context()
-			ctx := oidc.InsecureIssuerURLContext(context.TODO(), config.GlobalModelxdOptions.OIDC.Issuer)
-			provider, err := oidc.NewProvider(ctx, config.GlobalModelxdOptions.OIDC.Issuer)
-			if err != nil {
-				ginLogger.Error("oidc new provider error", zap.Error(err))
-				response.ResponseError(c.Writer, response.NewUnauthorizedError("oidc new provider error"))
-				c.Abort()
+		reqCxt := c.Request.Context()
+		if UserInfoFromContext(reqCxt) != nil || isProbe(c) {
+			c.Next()
+			return
+		}
+		token := BearerToken(c)
+		if len(token) == 0 {
+			if !authenticators.Load().empty() || allowAnonymous(c) {
+				c.Next()
 				return
 			}
-
-			verifier := provider.Verifier(&oidc.Config{
-				SkipClientIDCheck: true,
-				SkipIssuerCheck:   true,
-			})
-
-			headerAuthorzation := c.GetHeader("Authorization")
-			token := strings.TrimPrefix(headerAuthorzation, "Bearer ")
-			if token == "" {
-				queries := c.Request.URL.Query()
-				for _, k := range []string{"token", "access_token"} {
-					if token = queries.Get(k); token != "" {
-						break
-					}
-				}
-			}
-			if len(token) == 0 {
-				response.ResponseError(c.Writer, response.NewUnauthorizedError("missing access token"))
-				c.Abort()
+			response.ResponseError(c.Writer, response.NewUnauthorizedError("missing access token"))
+			c.Abort()
+			return
+		}
+		user, err := authenticator.AuthenticateToken(reqCxt, token)
+		if err != nil {
+			// the token may be issued by another authenticator
+			if !authenticators.Load().empty() {
+				c.Next()
 				return
 			}
-			idtoken, err := verifier.Verify(reqCxt, token)
-			if err != nil {
-				response.ResponseError(c.Writer, response.NewUnauthorizedError("invalid access token"))
+			if !errors.Is(err, auth.ErrInvalidToken) {
+				ginLogger.Error("oidc provider error", zap.Error(err))
+				response.ResponseError(c.Writer, response.NewUnauthorizedError("oidc provider error"))
 				c.Abort()
 				return
 			}
-
-			reqCxt = NewUsernameContext(reqCxt, idtoken.Subject)
-			c.Request = c.Request.WithContext(reqCxt)
+			response.ResponseError(c.Writer, response.NewUnauthorizedError("invalid access token"))
+			c.Abort()
+			return
 		}
+		c.Request = c.Request.WithContext(NewUserInfoContext(reqCxt, user))
 		// 处理请求
 		c.Next()
 	}
@@ -1,9 +1,19 @@
 package middleware
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -43,3 +53,97 @@ func TestOIDCAuth(t *testing.T) {
 
 	assert.Equal(http.StatusUnauthorized, w.Code)
 }
+
+// fakeIssuer serves the discovery and the key set of an oidc issuer signing with key.
+func fakeIssuer(t *testing.T, key *rsa.PrivateKey, discoveries *atomic.Int32) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			discoveries.Add(1)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"issuer":                                server.URL,
+				"jwks_uri":                              server.URL + "/keys",
+				"authorization_endpoint":                server.URL + "/auth",
+				"id_token_signing_alg_values_supported": []string{"RS256"},
+			})
+		case "/keys":
+			_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+				"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signing))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCAuthVerifier(t *testing.T) {
+	assert := assert.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	discoveries := &atomic.Int32{}
+	issuer := fakeIssuer(t, key, discoveries)
+	other := fakeIssuer(t, key, &atomic.Int32{})
+
+	origin := config.GlobalModelxdOptions.OIDC
+	config.GlobalModelxdOptions.OIDC = &config.OIDCOptions{
+		Issuer:         issuer.URL,
+		Audiences:      []string{"modelx"},
+		RequiredClaims: map[string]string{"email_verified": "true"},
+		GroupsClaim:    "groups",
+	}
+	defer func() { config.GlobalModelxdOptions.OIDC = origin }()
+
+	router := gin.New()
+	router.Use(OIDCAuthFunc())
+	router.GET("/test1", func(c *gin.Context) {
+		user := UserInfoFromContext(c.Request.Context())
+		c.String(http.StatusOK, user.Username+":"+strings.Join(user.Groups, ","))
+	})
+	do := func(claims map[string]any) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/test1", nil)
+		req.Header.Set("Authorization", "Bearer "+signToken(t, key, claims))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	claims := func(iss string, override map[string]any) map[string]any {
+		claims := map[string]any{
+			"iss": iss, "sub": "alice", "aud": "modelx", "exp": time.Now().Add(time.Hour).Unix(),
+			"email_verified": true, "groups": []string{"ml", "ops"},
+		}
+		for k, v := range override {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	for i := 0; i < 3; i++ {
+		w := do(claims(issuer.URL, nil))
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal("alice:ml,ops", w.Body.String())
+	}
+	// discovered once at startup, not per request
+	assert.Equal(int32(1), discoveries.Load())
+
+	assert.Equal(http.StatusUnauthorized, do(claims(issuer.URL, map[string]any{"aud": "other"})).Code)
+	assert.Equal(http.StatusUnauthorized, do(claims(issuer.URL, map[string]any{"email_verified": false})).Code)
+	assert.Equal(http.StatusUnauthorized, do(claims(issuer.URL, map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})).Code)
+	assert.Equal(http.StatusUnauthorized, do(claims(other.URL, nil)).Code)
+}
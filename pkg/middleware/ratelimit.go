@@ -0,0 +1,240 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/response"
+)
+
+const (
+	IPRATELIMIT = "IPRATELIMIT"
+	// runs before the authentication, the requests failing it are limited by their client ip too
+	IPRATELIMITWEIGHT = 1005
+	RATELIMIT         = "RATELIMIT"
+	// runs after the authentication, the users are limited by their name
+	RATELIMITWEIGHT = 950
+
+	// the ip token taken by IPRateLimitFunc, given back if RateLimitFunc rejects the request
+	ipReservationKey = "ratelimit.ip"
+
+	// limiters idle for this long are dropped
+	rateLimiterIdle = 10 * time.Minute
+	// Retry-After of a request rejected for too many blob transfers in progress
+	blobTransfersRetryAfter = time.Second
+)
+
+var rateLimiter atomic.Pointer[RateLimiter]
+
+// SetRateLimits replaces the rate limits, nil disables them.
+func SetRateLimits(limits *config.RateLimitConfig) {
+	if limits == nil {
+		rateLimiter.Store(nil)
+		return
+	}
+	rateLimiter.Store(NewRateLimiter(limits))
+}
+
+// RateLimiter keeps a token bucket per user, per client ip and per route class,
+// and counts the blob transfers in progress.
+type RateLimiter struct {
+	user     *limiterSet
+	ip       *limiterSet
+	metadata *limiterSet
+	blob     *limiterSet
+	// transfers is nil if they are not capped
+	transfers chan struct{}
+}
+
+func NewRateLimiter(limits *config.RateLimitConfig) *RateLimiter {
+	l := &RateLimiter{
+		user:     newLimiterSet(limits.User),
+		ip:       newLimiterSet(limits.IP),
+		metadata: newLimiterSet(limits.Metadata),
+		blob:     newLimiterSet(limits.Blob),
+	}
+	if limits.MaxBlobTransfers > 0 {
+		l.transfers = make(chan struct{}, limits.MaxBlobTransfers)
+	}
+	return l
+}
+
+// IPRateLimitFunc rejects the requests over the limit of their client ip with 429 and a Retry-After.
+func IPRateLimitFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := rateLimiter.Load()
+		if limiter == nil || isProbe(c) {
+			c.Next()
+			return
+		}
+		now := time.Now()
+		reservation := limiter.ip.reserve(c.ClientIP(), now)
+		if reservation == nil {
+			c.Next()
+			return
+		}
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			tooManyRequests(c, delay, "rate limit exceeded")
+			return
+		}
+		c.Set(ipReservationKey, ipReservation{reservation: reservation, at: now})
+		c.Next()
+	}
+}
+
+// RateLimitFunc rejects the requests over the limits of their user and route class with 429 and a Retry-After.
+func RateLimitFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter := rateLimiter.Load()
+		if limiter == nil || isProbe(c) {
+			c.Next()
+			return
+		}
+		username, ip := UsernameFromContext(c.Request.Context()), c.ClientIP()
+		identity := "ip:" + ip
+		if username != "" {
+			identity = "user:" + username
+		}
+		isblob := isBlobTransfer(c)
+		now := time.Now()
+		reservations := []*rate.Reservation{}
+		// the request is limited as of its ip token, which can only be given back at the time it was taken
+		if value, ok := c.Get(ipReservationKey); ok {
+			reserved := value.(ipReservation)
+			now = reserved.at
+			reservations = append(reservations, reserved.reservation)
+		}
+		if username != "" {
+			reservations = append(reservations, limiter.user.reserve(username, now))
+		}
+		if isblob {
+			reservations = append(reservations, limiter.blob.reserve(identity, now))
+		} else {
+			reservations = append(reservations, limiter.metadata.reserve(identity, now))
+		}
+		delay := time.Duration(0)
+		for _, reservation := range reservations {
+			if reservation != nil {
+				delay = max(delay, reservation.DelayFrom(now))
+			}
+		}
+		if delay > 0 {
+			// the rejected request takes no token
+			for _, reservation := range reservations {
+				if reservation != nil {
+					reservation.CancelAt(now)
+				}
+			}
+			tooManyRequests(c, delay, "rate limit exceeded")
+			return
+		}
+		if isblob && limiter.transfers != nil {
+			select {
+			case limiter.transfers <- struct{}{}:
+				defer func() { <-limiter.transfers }()
+			default:
+				tooManyRequests(c, blobTransfersRetryAfter, "too many blob transfers in progress")
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+type ipReservation struct {
+	reservation *rate.Reservation
+	at          time.Time
+}
+
+func tooManyRequests(c *gin.Context, retryAfter time.Duration, msg string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	response.ResponseError(c.Writer, response.NewTooManyRequestsError(msg))
+	c.Abort()
+}
+
+// isBlobTransfer reports whether the request downloads or uploads blob content,
+// HEAD and the blob locations are metadata.
+func isBlobTransfer(c *gin.Context) bool {
+	route := c.FullPath()
+	if !strings.Contains(route, "/blobs/") || strings.Contains(route, "/locations/") {
+		return false
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodPut, http.MethodPatch:
+		return true
+	}
+	return false
+}
+
+// limiterSet is a token bucket per key, the buckets idle for rateLimiterIdle are dropped.
+type limiterSet struct {
+	limit config.RateLimit
+
+	mu        sync.Mutex
+	limiters  map[string]*idleLimiter
+	lastSweep time.Time
+}
+
+type idleLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newLimiterSet(limit config.RateLimit) *limiterSet {
+	return &limiterSet{limit: limit, limiters: map[string]*idleLimiter{}, lastSweep: time.Now()}
+}
+
+// reserve takes a token from the bucket of key, nil if it is not limited.
+func (s *limiterSet) reserve(key string, now time.Time) *rate.Reservation {
+	if !s.limit.Enabled() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > rateLimiterIdle {
+		for k, l := range s.limiters {
+			if now.Sub(l.lastSeen) > rateLimiterIdle {
+				delete(s.limiters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	l, ok := s.limiters[key]
+	if !ok {
+		l = &idleLimiter{limiter: rate.NewLimiter(rate.Limit(s.limit.Rate), s.limit.Burst)}
+		s.limiters[key] = l
+	}
+	l.lastSeen = now
+	return l.limiter.ReserveN(now, 1)
+}
+
+func init() {
+	Register(&Instance{Name: IPRATELIMIT, F: IPRateLimitFunc, Weight: IPRATELIMITWEIGHT})
+	Register(&Instance{Name: RATELIMIT, F: RateLimitFunc, Weight: RATELIMITWEIGHT})
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"kubegems.io/modelx/pkg/config"
+)
+
+func TestRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	SetRateLimits(&config.RateLimitConfig{
+		IP:               config.RateLimit{Rate: 0.001, Burst: 3},
+		Blob:             config.RateLimit{Rate: 0.001, Burst: 2},
+		MaxBlobTransfers: 1,
+	})
+	defer SetRateLimits(nil)
+
+	router := gin.New()
+	router.Use(IPRateLimitFunc(), RateLimitFunc())
+	release := make(chan struct{})
+	router.GET("/:repository/:name/index", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/:repository/:name/blobs/:digest", func(c *gin.Context) {
+		if c.Query("wait") != "" {
+			<-release
+		}
+		c.Status(http.StatusOK)
+	})
+	do := func(path, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// blob transfers are capped, the request in progress holds the only slot
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- do("/p/m/blobs/sha256:1?wait=1", "10.0.0.1") }()
+	for {
+		if l := rateLimiter.Load(); len(l.transfers) == 1 {
+			break
+		}
+		runtime.Gosched()
+	}
+	w := do("/p/m/blobs/sha256:2", "10.0.0.2")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal("1", w.Header().Get("Retry-After"))
+	close(release)
+	assert.Equal(http.StatusOK, (<-done).Code)
+
+	// the blob bucket of 10.0.0.1 has one token left, the ip bucket two
+	assert.Equal(http.StatusOK, do("/p/m/blobs/sha256:1", "10.0.0.1").Code)
+	w = do("/p/m/blobs/sha256:1", "10.0.0.1")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(w.Header().Get("Retry-After"))
+	// the rejected request took no token of the ip bucket
+	assert.Equal(http.StatusOK, do("/p/m/index", "10.0.0.1").Code)
+	assert.Equal(http.StatusTooManyRequests, do("/p/m/index", "10.0.0.1").Code)
+	// other clients have their own buckets
+	assert.Equal(http.StatusOK, do("/p/m/index", "10.0.0.3").Code)
+
+	SetRateLimits(nil)
+	assert.Equal(http.StatusOK, do("/p/m/index", "10.0.0.1").Code)
+}
+
+func TestRateLimitFailedAuthentication(t *testing.T) {
+	assert := assert.New(t)
+	SetRateLimits(&config.RateLimitConfig{IP: config.RateLimit{Rate: 0.001, Burst: 2}})
+	defer SetRateLimits(nil)
+
+	// the authentication rejects every request before the user limits
+	router := gin.New()
+	router.Use(IPRateLimitFunc(), func(c *gin.Context) { c.AbortWithStatus(http.StatusUnauthorized) }, RateLimitFunc())
+	router.GET("/:repository/:name/index", func(c *gin.Context) { c.Status(http.StatusOK) })
+	do := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/p/m/index", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(http.StatusUnauthorized, do("10.0.0.1"))
+	assert.Equal(http.StatusUnauthorized, do("10.0.0.1"))
+	assert.Equal(http.StatusTooManyRequests, do("10.0.0.1"))
+	assert.Equal(http.StatusUnauthorized, do("10.0.0.2"))
+}
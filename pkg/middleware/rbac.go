@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+
+	"kubegems.io/modelx/pkg/auth"
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/response"
+	"kubegems.io/modelx/pkg/util"
+)
+
+const (
+	RBAC = "RBAC"
+	// runs after the authentication
+	RBACWEIGHT = 900
+)
+
+var rbacAuthorizer atomic.Pointer[auth.RBACAuthorizer]
+
+// SetRBACPolicy replaces the role bindings, nil disables the authorization.
+func SetRBACPolicy(policy *config.RBACConfig) {
+	if policy == nil {
+		rbacAuthorizer.Store(nil)
+		return
+	}
+	rbacAuthorizer.Store(auth.NewRBACAuthorizer(policy))
+}
+
+// rbacPermission is a role required on the repository "project/name".
+type rbacPermission struct {
+	role    string
+	project string
+	name    string
+}
+
+// RBACFunc denies the requests the roles of the user do not allow.
+func RBACFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authorizer := rbacAuthorizer.Load()
+		if authorizer == nil || isProbe(c) {
+			c.Next()
+			return
+		}
+		permissions := requestPermissions(c)
+		if len(permissions) == 0 {
+			c.Next()
+			return
+		}
+		user := UserInfoFromContext(c.Request.Context())
+		if user == nil && (AnonymousFromContext(c.Request.Context()) || allowAnonymous(c)) {
+			c.Next()
+			return
+		}
+		if user == nil {
+			response.ResponseError(c.Writer, response.NewUnauthorizedError("missing access token"))
+			c.Abort()
+			return
+		}
+		for _, permission := range permissions {
+			if !authorizer.Authorize(user, permission.role, permission.project, permission.name) {
+				response.ResponseError(c.Writer, response.NewDeniedError(permission.String()))
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+func (p rbacPermission) String() string {
+	switch {
+	case p.project == "":
+		return fmt.Sprintf("role %s on all repositories required", p.role)
+	case p.name == "":
+		return fmt.Sprintf("role %s on project %s required", p.role, p.project)
+	default:
+		return fmt.Sprintf("role %s on repository %s/%s required", p.role, p.project, p.name)
+	}
+}
+
+// requestPermissions returns the roles the route requires, none for the global reads such as the global index.
+func requestPermissions(c *gin.Context) []rbacPermission {
+	route := c.FullPath()
+	// copy blobs reads the source repository and writes the target one
+	if from := c.Param("repositoryfrom"); from != "" {
+		return []rbacPermission{
+			{role: config.RoleWriter, project: c.Param("repositoryto"), name: c.Param("nameto")},
+			{role: config.RoleReader, project: from, name: c.Param("namefrom")},
+		}
+	}
+	project, name := c.Param("repository"), c.Param("name")
+	for _, suffix := range []string{"/garbage-collect", "/retention", "/replications", "/audit"} {
+		if strings.HasSuffix(route, suffix) {
+			return []rbacPermission{{role: config.RoleAdmin, project: project, name: name}}
+		}
+	}
+	if project == "" {
+		return nil
+	}
+	role := config.RoleWriter
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		// an upload location is a presigned write
+		if !isUploadLocation(c) {
+			role = config.RoleReader
+		}
+	case http.MethodDelete:
+		// deleting a repository or a blob others may reference
+		if strings.HasSuffix(route, "/index") || strings.HasSuffix(route, "/blobs/:digest") {
+			role = config.RoleAdmin
+		}
+	}
+	permissions := []rbacPermission{{role: role, project: project, name: name}}
+	// an OCI cross repository mount reads the blob of the source repository
+	if strings.HasSuffix(route, "/blobs/uploads/") && c.Request.Method == http.MethodPost && c.Query("mount") != "" {
+		if from := c.Query("from"); from != "" {
+			fromproject, fromname, _ := strings.Cut(from, "/")
+			permissions = append(permissions, rbacPermission{role: config.RoleReader, project: fromproject, name: fromname})
+		}
+	}
+	return permissions
+}
+
+// isUploadLocation reports whether the request asks for the location to upload a blob to.
+func isUploadLocation(c *gin.Context) bool {
+	return strings.HasSuffix(c.FullPath(), "/locations/:purpose") && c.Param("purpose") == util.BlobLocationPurposeUpload
+}
+
+func init() {
+	Register(&Instance{Name: RBAC, F: RBACFunc, Weight: RBACWEIGHT})
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"kubegems.io/modelx/pkg/auth"
+	"kubegems.io/modelx/pkg/config"
+)
+
+func TestRBAC(t *testing.T) {
+	assert := assert.New(t)
+	SetRBACPolicy(&config.RBACConfig{Bindings: []config.RoleBinding{
+		{Role: config.RoleAdmin, Repositories: []string{"*"}, Groups: []string{"ops"}},
+		{Role: config.RoleWriter, Repositories: []string{"ml"}, Users: []string{"alice"}},
+		{Role: config.RoleReader, Repositories: []string{"library/llama*"}, Groups: []string{"ml"}},
+		{Role: config.RoleReader, Repositories: []string{"library/public"}, Users: []string{"alice"}},
+	}})
+	defer SetRBACPolicy(nil)
+
+	users := map[string]*auth.UserInfo{
+		"root":  {Username: "root", Groups: []string{"ops"}},
+		"alice": {Username: "alice"},
+		"bob":   {Username: "bob", Groups: []string{"ml"}},
+	}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if user, ok := users[c.GetHeader("X-User")]; ok {
+			c.Request = c.Request.WithContext(NewUserInfoContext(c.Request.Context(), user))
+		}
+	}, RBACFunc())
+	handler := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	router.GET("/", handler)
+	router.POST("/garbage-collect", handler)
+	router.GET("/:repository/:name/index", handler)
+	router.DELETE("/:repository/:name/index", handler)
+	router.PUT("/:repository/:name/manifests/:reference", handler)
+	router.DELETE("/:repository/:name/manifests/:reference", handler)
+	router.GET("/:repository/:name/blobs/:digest/locations/:purpose", handler)
+	router.POST("/v2/:repository/:name/blobs/uploads/", handler)
+	router.PUT("/copys/:repositoryto/:nameto/:referenceto/:repositoryfrom/:namefrom/:referencefrom", handler)
+
+	do := func(user, method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(http.StatusOK, do("", http.MethodGet, "/"))
+	assert.Equal(http.StatusUnauthorized, do("", http.MethodGet, "/ml/m/index"))
+
+	assert.Equal(http.StatusOK, do("root", http.MethodPost, "/garbage-collect"))
+	assert.Equal(http.StatusOK, do("root", http.MethodDelete, "/ml/m/index"))
+
+	assert.Equal(http.StatusForbidden, do("alice", http.MethodPost, "/garbage-collect"))
+	assert.Equal(http.StatusOK, do("alice", http.MethodPut, "/ml/m/manifests/v1"))
+	assert.Equal(http.StatusOK, do("alice", http.MethodDelete, "/ml/m/manifests/v1"))
+	assert.Equal(http.StatusForbidden, do("alice", http.MethodDelete, "/ml/m/index"))
+	assert.Equal(http.StatusForbidden, do("alice", http.MethodGet, "/library/llama/index"))
+
+	assert.Equal(http.StatusOK, do("bob", http.MethodGet, "/library/llama-7b/index"))
+	assert.Equal(http.StatusForbidden, do("bob", http.MethodGet, "/library/qwen/index"))
+	assert.Equal(http.StatusForbidden, do("bob", http.MethodPut, "/library/llama/manifests/v1"))
+
+	// an upload location is a write
+	assert.Equal(http.StatusOK, do("bob", http.MethodGet, "/library/llama/blobs/sha256:abc/locations/download"))
+	assert.Equal(http.StatusForbidden, do("bob", http.MethodGet, "/library/llama/blobs/sha256:abc/locations/upload"))
+	assert.Equal(http.StatusOK, do("alice", http.MethodGet, "/ml/m/blobs/sha256:abc/locations/upload"))
+
+	// copy requires reading the source and writing the target
+	assert.Equal(http.StatusForbidden, do("alice", http.MethodPut, "/copys/ml/m/v1/library/llama/v1"))
+	assert.Equal(http.StatusOK, do("root", http.MethodPut, "/copys/ml/m/v1/library/llama/v1"))
+
+	// an OCI mount requires reading the source and writing the target
+	assert.Equal(http.StatusOK, do("alice", http.MethodPost, "/v2/ml/m/blobs/uploads/"))
+	assert.Equal(http.StatusForbidden, do("alice", http.MethodPost, "/v2/ml/m/blobs/uploads/?mount=sha256:abc&from=library/llama"))
+	assert.Equal(http.StatusOK, do("alice", http.MethodPost, "/v2/ml/m/blobs/uploads/?mount=sha256:abc&from=library/public"))
+	assert.Equal(http.StatusForbidden, do("bob", http.MethodPost, "/v2/ml/m/blobs/uploads/?mount=sha256:abc&from=library/llama"))
+}
@@ -0,0 +1,569 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	"go.uber.org/zap"
+
+	registry "kubegems.io/modelx/pkg/registry"
+	errors "kubegems.io/modelx/pkg/response"
+	"kubegems.io/modelx/pkg/routers"
+	types "kubegems.io/modelx/pkg/util"
+)
+
+const (
+	OCIGroup = "/v2"
+
+	HeaderDistributionAPIVersion = "Docker-Distribution-API-Version"
+	HeaderContentDigest          = "Docker-Content-Digest"
+	HeaderUploadUUID             = "Docker-Upload-UUID"
+
+	DistributionAPIVersion = "registry/2.0"
+)
+
+// OCIHandler marks the response as served by the OCI distribution api.
+func OCIHandler(h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Set(HeaderDistributionAPIVersion, DistributionAPIVersion)
+		h(c)
+	}
+}
+
+func OCIBase(c *gin.Context) {
+	errors.ResponseOK(c.Writer, struct{}{})
+}
+
+func OCICatalog(c *gin.Context) {
+	index, err := GlobalRegistry.Store.GetGlobalIndex(c.Request.Context(), "")
+	if err != nil && !isOCIStoreNotFound(err) {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	index = anonymousIndex(c.Request.Context(), index)
+	repositories := make([]string, 0, len(index.Manifests))
+	for _, repository := range index.Manifests {
+		repositories = append(repositories, repository.Name)
+	}
+	page, err := ociPaginate(c, OCIGroup+"/_catalog", repositories)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	errors.ResponseOK(c.Writer, types.OCICatalog{Repositories: page})
+}
+
+func OCITagsList(c *gin.Context) {
+	name, _ := GetRepositoryReference(c)
+	index, err := GlobalRegistry.Store.GetIndex(c.Request.Context(), name, "")
+	if err != nil {
+		if isOCIStoreNotFound(err) {
+			errors.ResponseOCIError(c.Writer, errors.NewNameUnknownError(name))
+		} else {
+			errors.ResponseOCIError(c.Writer, err)
+		}
+		return
+	}
+	tags := make([]string, 0, len(index.Manifests))
+	for _, manifest := range index.Manifests {
+		tags = append(tags, manifest.Name)
+	}
+	page, err := ociPaginate(c, OCIGroup+"/"+name+"/tags/list", tags)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	errors.ResponseOK(c.Writer, types.OCITagList{Name: name, Tags: page})
+}
+
+// OCIGetManifest serves both GET and HEAD, manifests pushed through the OCI api are
+// returned byte for byte, others are converted to an OCI image manifest.
+func OCIGetManifest(c *gin.Context) {
+	name, reference := GetRepositoryReference(c)
+	content, mediaType, err := resolveOCIManifest(c.Request.Context(), name, reference)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	c.Writer.Header().Set("Content-Type", mediaType)
+	c.Writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	c.Writer.Header().Set(HeaderContentDigest, digest.FromBytes(content).String())
+	c.Writer.WriteHeader(http.StatusOK)
+	if c.Request.Method != http.MethodHead {
+		_, _ = c.Writer.Write(content)
+	}
+}
+
+func OCIPutManifest(c *gin.Context) {
+	name, reference := GetRepositoryReference(c)
+	ctx := c.Request.Context()
+
+	content, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, errors.NewManifestInvalidError(err))
+		return
+	}
+	ocimanifest := types.OCIManifest{}
+	if err := json.Unmarshal(content, &ocimanifest); err != nil {
+		errors.ResponseOCIError(c.Writer, errors.NewManifestInvalidError(err))
+		return
+	}
+	mediaType := c.Request.Header.Get("Content-Type")
+	if mediaType == "" {
+		mediaType = ocimanifest.MediaType
+	}
+	switch mediaType {
+	case types.MediaTypeOCIManifest, types.MediaTypeDockerManifest:
+	case types.MediaTypeOCIIndex, types.MediaTypeDockerManifestList:
+		errors.ResponseOCIError(c.Writer, errors.NewUnsupportedError("manifest index is not supported"))
+		return
+	default:
+		errors.ResponseOCIError(c.Writer, errors.NewManifestInvalidError(fmt.Errorf("unsupported manifest media type %q", mediaType)))
+		return
+	}
+
+	dgst := digest.FromBytes(content)
+	if expected, err := digest.Parse(reference); err == nil {
+		if expected != dgst {
+			errors.ResponseOCIError(c.Writer, errors.NewDigestMismatchError(expected, dgst))
+			return
+		}
+		// untagged manifests are kept under their digest
+		reference = dgst.Encoded()
+	}
+
+	// keep the raw manifest, the digest of a manifest is computed on its exact bytes.
+	raw := registry.BlobContent{
+		Content:       io.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+		ContentType:   mediaType,
+	}
+	if err := GlobalRegistry.Store.PutBlob(ctx, name, dgst, raw); err != nil {
+		modelLogger.Error("store put oci manifest", zap.Error(err), zap.Any("action", "put-oci-manifest"), zap.Any("repository", name), zap.Any("digest", dgst.String()))
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+
+	manifest := types.ManifestFromOCI(ocimanifest)
+	manifest.MediaType = mediaType
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+	manifest.Annotations[types.AnnotationOCIManifestDigest] = dgst.String()
+	if err := GlobalRegistry.Store.PutManifest(ctx, name, reference, mediaType, manifest); err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	c.Writer.Header().Set("Location", OCIGroup+"/"+name+"/manifests/"+dgst.String())
+	c.Writer.Header().Set(HeaderContentDigest, dgst.String())
+	c.Writer.WriteHeader(http.StatusCreated)
+}
+
+func OCIDeleteManifest(c *gin.Context) {
+	name, reference := GetRepositoryReference(c)
+	ctx := c.Request.Context()
+
+	tags := []string{reference}
+	if dgst, err := digest.Parse(reference); err == nil {
+		found, err := findOCIManifestTags(ctx, name, dgst)
+		if err != nil {
+			errors.ResponseOCIError(c.Writer, err)
+			return
+		}
+		tags = found
+	}
+	if len(tags) == 0 {
+		errors.ResponseOCIError(c.Writer, errors.NewManifestUnknownError(name+"/"+reference))
+		return
+	}
+	for _, tag := range tags {
+		exist, err := GlobalRegistry.Store.ExistsManifest(ctx, name, tag)
+		if err != nil {
+			errors.ResponseOCIError(c.Writer, err)
+			return
+		}
+		if !exist {
+			errors.ResponseOCIError(c.Writer, errors.NewManifestUnknownError(name+"/"+tag))
+			return
+		}
+		if err := GlobalRegistry.Store.DeleteManifest(ctx, name, tag); err != nil {
+			errors.ResponseOCIError(c.Writer, err)
+			return
+		}
+	}
+	c.Writer.WriteHeader(http.StatusAccepted)
+}
+
+// OCIGetBlob serves both GET and HEAD.
+func OCIGetBlob(c *gin.Context) {
+	ociBlobDigestFun(c, func(ctx context.Context, repository string, dgst digest.Digest) {
+		c.Writer.Header().Set(HeaderContentDigest, dgst.String())
+		ServeBlob(c, repository, dgst, errors.ResponseOCIError)
+	})
+}
+
+func OCIDeleteBlob(c *gin.Context) {
+	ociBlobDigestFun(c, func(ctx context.Context, repository string, dgst digest.Digest) {
+		if !ociBlobExists(c, repository, dgst) {
+			return
+		}
+		if err := GlobalRegistry.Store.DeleteBlob(ctx, repository, dgst); err != nil {
+			errors.ResponseOCIError(c.Writer, err)
+			return
+		}
+		c.Writer.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// OCIStartUpload mounts a blob from another repository with ?mount=&from=,
+// uploads a monolithic blob with ?digest=, or else opens an upload session.
+func OCIStartUpload(c *gin.Context) {
+	name, _ := GetRepositoryReference(c)
+	ctx := c.Request.Context()
+	query := c.Request.URL.Query()
+
+	if mount, from := query.Get("mount"), query.Get("from"); mount != "" && from != "" {
+		dgst, err := digest.Parse(mount)
+		if err != nil {
+			errors.ResponseOCIError(c.Writer, errors.NewDigestInvalidError(mount))
+			return
+		}
+		// a failed mount falls back to a regular upload session
+		if ok, _ := GlobalRegistry.Store.ExistsBlob(ctx, from, dgst); ok {
+			if err := GlobalRegistry.Store.CopyBlob(ctx, name, from, dgst); err == nil {
+				ociBlobCreated(c, name, dgst)
+				return
+			}
+		}
+	}
+
+	if digeststr := query.Get("digest"); digeststr != "" {
+		dgst, err := digest.Parse(digeststr)
+		if err != nil {
+			errors.ResponseOCIError(c.Writer, errors.NewDigestInvalidError(digeststr))
+			return
+		}
+		content := registry.BlobContent{
+			ContentLength: c.Request.ContentLength,
+			ContentType:   ociBlobContentType(c),
+			Content:       c.Request.Body,
+		}
+		if err := GlobalRegistry.Store.PutBlob(ctx, name, dgst, content); err != nil {
+			modelLogger.Error("store put blob", zap.Error(err), zap.Any("action", "put-oci-blob"), zap.Any("repository", name), zap.Any("digest", dgst.String()))
+			errors.ResponseOCIError(c.Writer, err)
+			return
+		}
+		ociBlobCreated(c, name, dgst)
+		return
+	}
+
+	status, err := GlobalRegistry.Store.CreateUpload(ctx, name)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	ociUploadAccepted(c, status, http.StatusAccepted)
+}
+
+func OCIGetUpload(c *gin.Context) {
+	name, _ := GetRepositoryReference(c)
+	status, err := GlobalRegistry.Store.GetUpload(c.Request.Context(), name, c.Param("uuid"))
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	ociUploadAccepted(c, status, http.StatusNoContent)
+}
+
+func OCIPatchUpload(c *gin.Context) {
+	name, _ := GetRepositoryReference(c)
+	offset := int64(-1)
+	if c.Request.Header.Get("Content-Range") != "" {
+		start, _, err := ParseAndCheckContentRange(c.Request.Header)
+		if err != nil {
+			errors.ResponseOCIError(c.Writer, err)
+			return
+		}
+		offset = start
+	}
+	content := registry.BlobContent{
+		ContentLength: c.Request.ContentLength,
+		ContentType:   "application/octet-stream",
+		Content:       c.Request.Body,
+	}
+	status, err := GlobalRegistry.Store.PutUploadChunk(c.Request.Context(), name, c.Param("uuid"), offset, content)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	ociUploadAccepted(c, status, http.StatusAccepted)
+}
+
+// OCIPutUpload closes the upload session, the request body if any is the last chunk.
+func OCIPutUpload(c *gin.Context) {
+	name, _ := GetRepositoryReference(c)
+	ctx := c.Request.Context()
+	id := c.Param("uuid")
+
+	digeststr := c.Query("digest")
+	dgst, err := digest.Parse(digeststr)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, errors.NewDigestInvalidError(digeststr))
+		return
+	}
+	if c.Request.ContentLength != 0 {
+		content := registry.BlobContent{
+			ContentLength: c.Request.ContentLength,
+			ContentType:   "application/octet-stream",
+			Content:       c.Request.Body,
+		}
+		if _, err := GlobalRegistry.Store.PutUploadChunk(ctx, name, id, -1, content); err != nil {
+			errors.ResponseOCIError(c.Writer, err)
+			return
+		}
+	}
+	if err := GlobalRegistry.Store.CommitUpload(ctx, name, id, dgst); err != nil {
+		modelLogger.Error("store commit upload", zap.Error(err), zap.Any("action", "commit-oci-upload"), zap.Any("repository", name), zap.Any("digest", dgst.String()))
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	ociBlobCreated(c, name, dgst)
+}
+
+func OCIDeleteUpload(c *gin.Context) {
+	name, _ := GetRepositoryReference(c)
+	ctx := c.Request.Context()
+	id := c.Param("uuid")
+	if _, err := GlobalRegistry.Store.GetUpload(ctx, name, id); err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	if err := GlobalRegistry.Store.CancelUpload(ctx, name, id); err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return
+	}
+	c.Writer.WriteHeader(http.StatusNoContent)
+}
+
+func ociBlobDigestFun(c *gin.Context, fun func(ctx context.Context, repository string, digest digest.Digest)) {
+	name, _ := GetRepositoryReference(c)
+	digeststr := c.Param("digest")
+	dgst, err := digest.Parse(digeststr)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, errors.NewDigestInvalidError(digeststr))
+		return
+	}
+	fun(c.Request.Context(), name, dgst)
+}
+
+func ociBlobExists(c *gin.Context, repository string, dgst digest.Digest) bool {
+	ok, err := GlobalRegistry.Store.ExistsBlob(c.Request.Context(), repository, dgst)
+	if err != nil {
+		errors.ResponseOCIError(c.Writer, err)
+		return false
+	}
+	if !ok {
+		errors.ResponseOCIError(c.Writer, errors.NewBlobUnknownError(dgst))
+		return false
+	}
+	return true
+}
+
+func ociBlobContentType(c *gin.Context) string {
+	if contentType := c.Request.Header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+func ociBlobCreated(c *gin.Context, repository string, dgst digest.Digest) {
+	c.Writer.Header().Set("Location", OCIGroup+"/"+repository+"/blobs/"+dgst.String())
+	c.Writer.Header().Set(HeaderContentDigest, dgst.String())
+	c.Writer.WriteHeader(http.StatusCreated)
+}
+
+func ociUploadAccepted(c *gin.Context, status *registry.UploadStatus, code int) {
+	c.Writer.Header().Set("Location", OCIGroup+"/"+status.Repository+"/blobs/uploads/"+status.ID)
+	c.Writer.Header().Set("Range", fmt.Sprintf("0-%d", max(status.Offset-1, 0)))
+	c.Writer.Header().Set(HeaderUploadUUID, status.ID)
+	c.Writer.Header().Set("Content-Length", "0")
+	c.Writer.WriteHeader(code)
+}
+
+// ociPaginate applies the ?n= and ?last= parameters to sorted items and sets the Link header for the next page.
+func ociPaginate(c *gin.Context, path string, items []string) ([]string, error) {
+	if last := c.Query("last"); last != "" {
+		items = items[sort.Search(len(items), func(i int) bool { return items[i] > last }):]
+	}
+	nstr := c.Query("n")
+	if nstr == "" {
+		return items, nil
+	}
+	n, err := strconv.Atoi(nstr)
+	if err != nil || n < 0 {
+		return nil, errors.NewParameterInvalidError(fmt.Sprintf("invalid n: %s", nstr))
+	}
+	if len(items) > n {
+		items = items[:n]
+		if n > 0 {
+			next := url.Values{"n": {nstr}, "last": {items[n-1]}}
+			c.Writer.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", path, next.Encode()))
+		}
+	}
+	return items, nil
+}
+
+// resolveOCIManifest returns the OCI content and media type of the manifest referenced by a tag or a digest.
+func resolveOCIManifest(ctx context.Context, repository string, reference string) ([]byte, string, error) {
+	if dgst, err := digest.Parse(reference); err == nil {
+		if content, mediaType, err := getOCIManifestBlob(ctx, repository, dgst); err == nil {
+			return content, mediaType, nil
+		}
+		tags, err := findOCIManifestTags(ctx, repository, dgst)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(tags) == 0 {
+			return nil, "", errors.NewManifestUnknownError(repository + "/" + reference)
+		}
+		reference = tags[0]
+	}
+	exist, err := GlobalRegistry.Store.ExistsManifest(ctx, repository, reference)
+	if err != nil {
+		return nil, "", err
+	}
+	if !exist {
+		return nil, "", errors.NewManifestUnknownError(repository + "/" + reference)
+	}
+	manifest, err := GlobalRegistry.Store.GetManifest(ctx, repository, reference)
+	if err != nil {
+		return nil, "", err
+	}
+	return getOCIManifest(ctx, repository, manifest)
+}
+
+// findOCIManifestTags returns the tags in the repository whose OCI manifest has digest dgst.
+func findOCIManifestTags(ctx context.Context, repository string, dgst digest.Digest) ([]string, error) {
+	index, err := GlobalRegistry.Store.GetIndex(ctx, repository, "")
+	if err != nil {
+		if isOCIStoreNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tags := []string{}
+	for _, desc := range index.Manifests {
+		manifest, err := GlobalRegistry.Store.GetManifest(ctx, repository, desc.Name)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Annotations[types.AnnotationOCIManifestDigest] == dgst.String() {
+			tags = append(tags, desc.Name)
+			continue
+		}
+		content, _, err := getOCIManifest(ctx, repository, manifest)
+		if err != nil {
+			return nil, err
+		}
+		if digest.FromBytes(content) == dgst {
+			tags = append(tags, desc.Name)
+		}
+	}
+	return tags, nil
+}
+
+func getOCIManifest(ctx context.Context, repository string, manifest *types.Manifest) ([]byte, string, error) {
+	if dgst, err := digest.Parse(manifest.Annotations[types.AnnotationOCIManifestDigest]); err == nil {
+		if content, mediaType, err := getOCIManifestBlob(ctx, repository, dgst); err == nil {
+			return content, mediaType, nil
+		}
+	}
+	content, err := json.Marshal(types.ManifestToOCI(*manifest))
+	if err != nil {
+		return nil, "", errors.NewInternalError(err)
+	}
+	return content, types.MediaTypeOCIManifest, nil
+}
+
+func getOCIManifestBlob(ctx context.Context, repository string, dgst digest.Digest) ([]byte, string, error) {
+	exist, err := GlobalRegistry.Store.ExistsBlob(ctx, repository, dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	if !exist {
+		return nil, "", errors.NewManifestUnknownError(repository + "/" + dgst.String())
+	}
+	result, err := GlobalRegistry.Store.GetBlob(ctx, repository, dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	defer result.Close()
+
+	switch result.ContentType {
+	case types.MediaTypeOCIManifest, types.MediaTypeDockerManifest:
+	default:
+		return nil, "", errors.NewManifestUnknownError(repository + "/" + dgst.String())
+	}
+	content, err := io.ReadAll(io.LimitReader(result.Content, registry.DefaultMaxBytesRead))
+	if err != nil {
+		return nil, "", errors.NewInternalError(err)
+	}
+	if got := digest.FromBytes(content); got != dgst {
+		return nil, "", errors.NewDigestMismatchError(dgst, got)
+	}
+	return content, result.ContentType, nil
+}
+
+func isOCIStoreNotFound(err error) bool {
+	return registry.IsRegistryStoreNotNotFound(err) || registry.IsS3StorageNotFound(err) || os.IsNotExist(err)
+}
+
+func init() {
+	router.Register("OCIBase", OCIGroup, "/", http.MethodGet, OCIHandler(OCIBase))
+	router.Register("OCICatalog", OCIGroup, "/_catalog", http.MethodGet, OCIHandler(OCICatalog))
+	router.Register("OCITags", OCIGroup, ":repository/:name/tags/list", http.MethodGet, OCIHandler(OCITagsList))
+
+	// manifests
+	router.Register("OCIManifests", OCIGroup, ":repository/:name/manifests/:reference", http.MethodHead, OCIHandler(OCIGetManifest))
+	router.Register("OCIManifests", OCIGroup, ":repository/:name/manifests/:reference", http.MethodGet, OCIHandler(OCIGetManifest))
+	router.Register("OCIManifests", OCIGroup, ":repository/:name/manifests/:reference", http.MethodPut, OCIHandler(registry.MaxBytesReadHandler(OCIPutManifest, registry.DefaultMaxBytesRead)))
+	router.Register("OCIManifests", OCIGroup, ":repository/:name/manifests/:reference", http.MethodDelete, OCIHandler(OCIDeleteManifest))
+
+	// blobs
+	router.Register("OCIBlobs", OCIGroup, ":repository/:name/blobs/:digest", http.MethodHead, OCIHandler(OCIGetBlob))
+	router.Register("OCIBlobs", OCIGroup, ":repository/:name/blobs/:digest", http.MethodGet, OCIHandler(OCIGetBlob))
+	router.Register("OCIBlobs", OCIGroup, ":repository/:name/blobs/:digest", http.MethodDelete, OCIHandler(OCIDeleteBlob))
+
+	// blob uploads
+	router.Register("OCIUploads", OCIGroup, ":repository/:name/blobs/uploads/", http.MethodPost, OCIHandler(OCIStartUpload))
+	router.Register("OCIUploads", OCIGroup, ":repository/:name/blobs/uploads/:uuid", http.MethodGet, OCIHandler(OCIGetUpload))
+	router.Register("OCIUploads", OCIGroup, ":repository/:name/blobs/uploads/:uuid", http.MethodPatch, OCIHandler(OCIPatchUpload))
+	router.Register("OCIUploads", OCIGroup, ":repository/:name/blobs/uploads/:uuid", http.MethodPut, OCIHandler(OCIPutUpload))
+	router.Register("OCIUploads", OCIGroup, ":repository/:name/blobs/uploads/:uuid", http.MethodDelete, OCIHandler(OCIDeleteUpload))
+}
@@ -19,15 +19,21 @@ package model
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/opencontainers/go-digest"
 	"go.uber.org/zap"
 
+	"kubegems.io/modelx/pkg/audit"
+	"kubegems.io/modelx/pkg/event"
+	"kubegems.io/modelx/pkg/middleware"
 	registry "kubegems.io/modelx/pkg/registry"
 	errors "kubegems.io/modelx/pkg/response"
 	"kubegems.io/modelx/pkg/routers"
@@ -36,6 +42,18 @@ import (
 
 type Registry struct {
 	Store registry.RegistryInterface
+	// Storage is the storage of the local store, checked by the readiness check.
+	Storage registry.FSProvider
+	// GC holds the garbage collect options, its scheduler only runs when an interval is set.
+	GC *registry.GCScheduler
+	// Retention holds the retention rules, its scheduler only runs when rules and an interval are set.
+	Retention *registry.RetentionScheduler
+	// Replication holds the replication rules, it only runs when rules are set.
+	Replication *registry.Replicator
+	// Webhooks deliver the registry events.
+	Webhooks []*event.WebhookSink
+	// Audit keeps the records of the mutating requests, nil if the audit is disabled.
+	Audit *audit.FileLog
 }
 
 func HeadManifest(c *gin.Context) {
@@ -66,7 +84,19 @@ func GetGlobalIndex(c *gin.Context) {
 		}
 		return
 	}
-	errors.ResponseOK(c.Writer, index)
+	errors.ResponseOK(c.Writer, anonymousIndex(c.Request.Context(), index))
+}
+
+// anonymousIndex keeps only the repositories of the anonymous projects for the anonymous requests.
+func anonymousIndex(ctx context.Context, index types.Index) types.Index {
+	if !middleware.AnonymousFromContext(ctx) {
+		return index
+	}
+	index.Manifests = slices.DeleteFunc(slices.Clone(index.Manifests), func(repository types.Descriptor) bool {
+		project, _, _ := strings.Cut(repository.Name, "/")
+		return !middleware.AnonymousProject(project)
+	})
+	return index
 }
 
 func GetIndex(c *gin.Context) {
@@ -149,16 +179,23 @@ func HeadBlob(c *gin.Context) {
 			errors.ResponseError(c.Writer, err)
 			return
 		}
-		if ok {
-			c.Writer.WriteHeader(http.StatusOK)
-		} else {
+		if !ok {
 			c.Writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// the size lets a pull-through proxy serve ranges before it has the blob
+		meta, err := GlobalRegistry.Store.GetBlobMeta(c.Request.Context(), repository, digest)
+		if err != nil {
+			errors.ResponseError(c.Writer, err)
+			return
 		}
+		c.Writer.Header().Set("Content-Length", strconv.FormatInt(meta.ContentLength, 10))
+		c.Writer.WriteHeader(http.StatusOK)
 	})
 }
 
 // 如果客户端 包含 contentLength 则直接上传
-// 如果客户端 不包含 contentLength 则返回一个 Location 后续上传至该地址
+// 大文件可以使用 blobs/:digest/uploads 分块上传, 中断后查询 offset 继续上传
 func PutBlob(c *gin.Context) {
 	BlobDigestFun(c, func(ctx context.Context, repository string, digest digest.Digest) {
 		contentType := c.Request.Header.Get("Content-Type")
@@ -180,6 +217,85 @@ func PutBlob(c *gin.Context) {
 	})
 }
 
+// StartBlobUpload 开始或恢复一个分块上传会话, 会话以 digest 为标识, modelxd 重启后仍然可以继续
+func StartBlobUpload(c *gin.Context) {
+	BlobDigestFun(c, func(ctx context.Context, repository string, digest digest.Digest) {
+		status, err := GlobalRegistry.Store.ResumeUpload(ctx, repository, digest.Encoded())
+		if err != nil {
+			errors.ResponseError(c.Writer, err)
+			return
+		}
+		responseUploadStatus(c, status)
+	})
+}
+
+func GetBlobUpload(c *gin.Context) {
+	BlobDigestFun(c, func(ctx context.Context, repository string, digest digest.Digest) {
+		status, err := GlobalRegistry.Store.GetUpload(ctx, repository, digest.Encoded())
+		if err != nil {
+			errors.ResponseError(c.Writer, err)
+			return
+		}
+		responseUploadStatus(c, status)
+	})
+}
+
+// PatchBlobUpload 上传一个分块, Content-Range 的起始位置必须等于已上传的 offset, 未设置时追加到末尾
+func PatchBlobUpload(c *gin.Context) {
+	BlobDigestFun(c, func(ctx context.Context, repository string, digest digest.Digest) {
+		offset := int64(-1)
+		if c.Request.Header.Get("Content-Range") != "" {
+			start, _, err := ParseAndCheckContentRange(c.Request.Header)
+			if err != nil {
+				errors.ResponseError(c.Writer, err)
+				return
+			}
+			offset = start
+		}
+		content := registry.BlobContent{
+			ContentLength: c.Request.ContentLength,
+			ContentType:   "application/octet-stream",
+			Content:       c.Request.Body,
+		}
+		status, err := GlobalRegistry.Store.PutUploadChunk(ctx, repository, digest.Encoded(), offset, content)
+		if err != nil {
+			modelLogger.Error("store put upload chunk", zap.Error(err), zap.Any("action", "put-upload-chunk"), zap.Any("repository", repository), zap.Any("digest", digest.String()))
+			errors.ResponseError(c.Writer, err)
+			return
+		}
+		responseUploadStatus(c, status)
+	})
+}
+
+func CommitBlobUpload(c *gin.Context) {
+	BlobDigestFun(c, func(ctx context.Context, repository string, digest digest.Digest) {
+		if err := GlobalRegistry.Store.CommitUpload(ctx, repository, digest.Encoded(), digest); err != nil {
+			modelLogger.Error("store commit upload", zap.Error(err), zap.Any("action", "commit-upload"), zap.Any("repository", repository), zap.Any("digest", digest.String()))
+			errors.ResponseError(c.Writer, err)
+			return
+		}
+		c.Writer.WriteHeader(http.StatusCreated)
+	})
+}
+
+func CancelBlobUpload(c *gin.Context) {
+	BlobDigestFun(c, func(ctx context.Context, repository string, digest digest.Digest) {
+		if err := GlobalRegistry.Store.CancelUpload(ctx, repository, digest.Encoded()); err != nil {
+			errors.ResponseError(c.Writer, err)
+			return
+		}
+		errors.ResponseOK(c.Writer, "ok")
+	})
+}
+
+func responseUploadStatus(c *gin.Context, status *registry.UploadStatus) {
+	c.Writer.Header().Set("Content-Type", "application/json")
+	if status.Offset > 0 {
+		c.Writer.Header().Set("Range", fmt.Sprintf("0-%d", status.Offset-1))
+	}
+	errors.ResponseOK(c.Writer, status)
+}
+
 func CopyBlobs(c *gin.Context) {
 	repositoryTo, _ := c.Param("repositoryto")+"/"+c.Param("nameto"), c.Param("referenceto")
 	repositoryFrom, _ := c.Param("repositoryfrom")+"/"+c.Param("namefrom"), c.Param("referencefrom")
@@ -194,31 +310,235 @@ func CopyBlobs(c *gin.Context) {
 
 func GetBlob(c *gin.Context) {
 	BlobDigestFun(c, func(ctx context.Context, repository string, digest digest.Digest) {
-		result, err := GlobalRegistry.Store.GetBlob(c.Request.Context(), repository, digest)
-		if err != nil {
-			modelLogger.Error("store get blob", zap.Error(err), zap.Any("action", "get-blob"), zap.Any("repository", repository), zap.Any("digest", digest.String()))
-			if registry.IsRegistryStoreNotNotFound(err) {
-				errors.ResponseError(c.Writer, errors.NewBlobUnknownError(digest))
+		ServeBlob(c, repository, digest, errors.ResponseError)
+	})
+}
+
+// ServeBlob writes the blob with its digest as a strong ETag, GET and HEAD are both served.
+// A single byte range in the Range header is answered with 206, multiple ranges get the whole blob.
+func ServeBlob(c *gin.Context, repository string, digest digest.Digest, responseError func(http.ResponseWriter, error)) {
+	ctx := c.Request.Context()
+	exist, err := GlobalRegistry.Store.ExistsBlob(ctx, repository, digest)
+	if err != nil {
+		responseError(c.Writer, err)
+		return
+	}
+	if !exist {
+		responseError(c.Writer, errors.NewBlobUnknownError(digest))
+		return
+	}
+	meta, err := GlobalRegistry.Store.GetBlobMeta(ctx, repository, digest)
+	if err != nil {
+		responseError(c.Writer, err)
+		return
+	}
+
+	etag := `"` + digest.String() + `"`
+	header := c.Writer.Header()
+	header.Set("ETag", etag)
+	header.Set("Accept-Ranges", "bytes")
+	if match := c.Request.Header.Get("If-None-Match"); match != "" && MatchETag(match, etag) {
+		c.Writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	offset, length := int64(0), int64(-1)
+	if rangestr := c.Request.Header.Get("Range"); rangestr != "" {
+		// a stale If-Range gets the whole blob
+		if ifrange := c.Request.Header.Get("If-Range"); ifrange == "" || ifrange == etag {
+			offset, length, err = ParseRange(rangestr, meta.ContentLength)
+			if err != nil {
+				header.Set("Content-Range", fmt.Sprintf("bytes */%d", meta.ContentLength))
+				responseError(c.Writer, err)
+				return
 			}
-			errors.ResponseError(c.Writer, err)
-			return
 		}
-		defer result.Close()
+	}
+	status := http.StatusOK
+	partial := length >= 0
+	if partial {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, meta.ContentLength))
+		status = http.StatusPartialContent
+	} else {
+		length = meta.ContentLength
+	}
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	// HEAD answers as GET would, without the body
+	if c.Request.Method == http.MethodHead {
+		header.Set("Content-Type", meta.ContentType)
+		c.Writer.WriteHeader(status)
+		return
+	}
 
-		c.Writer.Header().Set("Content-Type", result.ContentType)
-		c.Writer.WriteHeader(http.StatusOK)
-		_, _ = io.Copy(c.Writer, result.Content)
-	})
+	var result *registry.BlobContent
+	if partial {
+		result, err = GlobalRegistry.Store.GetBlobRange(ctx, repository, digest, offset, length)
+	} else {
+		result, err = GlobalRegistry.Store.GetBlob(ctx, repository, digest)
+	}
+	if err != nil {
+		modelLogger.Error("store get blob", zap.Error(err), zap.Any("action", "get-blob"), zap.Any("repository", repository), zap.Any("digest", digest.String()))
+		responseError(c.Writer, err)
+		return
+	}
+	defer result.Close()
+
+	header.Set("Content-Type", result.ContentType)
+	c.Writer.WriteHeader(status)
+	_, _ = io.Copy(c.Writer, result.Content)
 }
 
 func GarbageCollect(c *gin.Context) {
 	name, _ := GetRepositoryReference(c)
-	result, err := registry.GCBlobs(c.Request.Context(), GlobalRegistry.Store, name)
+	options, err := gcOptions(c)
+	if err != nil {
+		errors.ResponseError(c.Writer, err)
+		return
+	}
+	report, err := registry.GCBlobs(c.Request.Context(), localStore(), name, options)
+	if err != nil {
+		errors.ResponseError(c.Writer, err)
+		return
+	}
+	errors.ResponseOK(c.Writer, report)
+}
+
+func GarbageCollectAll(c *gin.Context) {
+	options, err := gcOptions(c)
+	if err != nil {
+		errors.ResponseError(c.Writer, err)
+		return
+	}
+	report, err := registry.GCBlobsAll(c.Request.Context(), localStore(), options)
+	if err != nil {
+		errors.ResponseError(c.Writer, err)
+		return
+	}
+	errors.ResponseOK(c.Writer, report)
+}
+
+// GetGarbageCollectReport returns the report of the last scheduled garbage collect.
+func GetGarbageCollectReport(c *gin.Context) {
+	report := GlobalRegistry.GC.LastReport()
+	if report == nil {
+		c.Writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	errors.ResponseOK(c.Writer, report)
+}
+
+// ApplyRetention prunes versions by the retention rules now, ?dryRun=true only lists what would be pruned.
+func ApplyRetention(c *gin.Context) {
+	rules := GlobalRegistry.Retention.Rules()
+	if len(rules) == 0 {
+		errors.ResponseError(c.Writer, errors.NewConfigInvalidError("no retention rules are configured"))
+		return
+	}
+	gcoptions, err := gcOptions(c)
+	if err != nil {
+		errors.ResponseError(c.Writer, err)
+		return
+	}
+	options := registry.RetentionOptions{DryRun: gcoptions.DryRun, GC: gcoptions}
+	report, err := registry.ApplyRetention(c.Request.Context(), localStore(), rules, options)
+	if err != nil {
+		errors.ResponseError(c.Writer, err)
+		return
+	}
+	errors.ResponseOK(c.Writer, report)
+}
+
+// GetRetentionReport returns the report of the last scheduled retention run.
+func GetRetentionReport(c *gin.Context) {
+	report := GlobalRegistry.Retention.LastReport()
+	if report == nil {
+		c.Writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	errors.ResponseOK(c.Writer, report)
+}
+
+// GetReplicationStatus returns the state of every replication rule.
+func GetReplicationStatus(c *gin.Context) {
+	errors.ResponseOK(c.Writer, GlobalRegistry.Replication.Status())
+}
+
+// GetAuditRecords returns the most recent audit records,
+// filtered by ?repository=, ?user=, ?since= and ?until= in RFC 3339, at most ?limit= of them.
+func GetAuditRecords(c *gin.Context) {
+	if GlobalRegistry.Audit == nil {
+		errors.ResponseError(c.Writer, errors.NewUnsupportedError("audit is not enabled"))
+		return
+	}
+	query := audit.Query{Repository: c.Query("repository"), Username: c.Query("user")}
+	for k, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := c.Query(k); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errors.ResponseError(c.Writer, errors.NewParameterInvalidError(fmt.Sprintf("%s %s: %v", k, value, err)))
+				return
+			}
+			*t = parsed
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			errors.ResponseError(c.Writer, errors.NewParameterInvalidError(fmt.Sprintf("limit %s: %v", limit, err)))
+			return
+		}
+		query.Limit = value
+	}
+	records, err := GlobalRegistry.Audit.Query(query)
 	if err != nil {
 		errors.ResponseError(c.Writer, errors.NewInternalError(err))
 		return
 	}
-	errors.ResponseOK(c.Writer, result)
+	errors.ResponseOK(c.Writer, records)
+}
+
+// GetProjectQuota returns the usage and the quota of the project.
+func GetProjectQuota(c *gin.Context) {
+	usage, err := registry.GetProjectUsage(c.Request.Context(), localStore(), c.Param("repository"))
+	if err != nil {
+		errors.ResponseError(c.Writer, err)
+		return
+	}
+	errors.ResponseOK(c.Writer, usage)
+}
+
+// GetRepositoryQuota returns the usage and the quota of the repository.
+func GetRepositoryQuota(c *gin.Context) {
+	name, _ := GetRepositoryReference(c)
+	usage, err := registry.GetRepositoryUsage(c.Request.Context(), localStore(), name)
+	if err != nil {
+		errors.ResponseError(c.Writer, err)
+		return
+	}
+	errors.ResponseOK(c.Writer, usage)
+}
+
+// localStore is the store without the pull-through proxy,
+// garbage collect, retention and usage only work on what is stored locally.
+func localStore() registry.RegistryInterface {
+	if proxy, ok := GlobalRegistry.Store.(*registry.ProxyStore); ok {
+		return proxy.RegistryInterface
+	}
+	return GlobalRegistry.Store
+}
+
+// gcOptions uses the configured minimum blob age and upload ttl, ?dryRun=true only reports the blobs to remove.
+func gcOptions(c *gin.Context) (registry.GCOptions, error) {
+	options := GlobalRegistry.GC.Options
+	options.DryRun = false
+	if dryrun := c.Query("dryRun"); dryrun != "" {
+		value, err := strconv.ParseBool(dryrun)
+		if err != nil {
+			return options, errors.NewParameterInvalidError(fmt.Sprintf("dryRun %s: %v", dryrun, err))
+		}
+		options.DryRun = value
+	}
+	return options, nil
 }
 
 func GetBlobLocation(c *gin.Context) {
@@ -296,13 +616,80 @@ func ParseAndCheckContentRange(header http.Header) (int64, int64, error) {
 	return start, end, nil
 }
 
+// ParseRange parses a single "bytes=" range against size and returns its offset and length.
+// Headers that can not be served as a single range return a negative length, so the whole content is sent.
+func ParseRange(rangestr string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(rangestr, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, -1, nil
+	}
+	startstr, endstr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, -1, nil
+	}
+	if startstr == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.ParseInt(endstr, 10, 64)
+		if err != nil || n < 0 {
+			return 0, -1, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errors.NewRangeNotSatisfiableError(size)
+		}
+		start := max(size-n, 0)
+		return start, size - start, nil
+	}
+	start, err := strconv.ParseInt(startstr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, -1, nil
+	}
+	end := size - 1
+	if endstr != "" {
+		if end, err = strconv.ParseInt(endstr, 10, 64); err != nil || end < start {
+			return 0, -1, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, errors.NewRangeNotSatisfiableError(size)
+	}
+	return start, end - start + 1, nil
+}
+
+// MatchETag reports whether etag is in the If-None-Match list, using the weak comparison.
+func MatchETag(list string, etag string) bool {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimPrefix(strings.TrimSpace(item), "W/")
+		if item == "*" || item == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	// global index
 	router.Register("GlobalIndex", "/", "/", http.MethodGet, GetGlobalIndex)
 
 	// gc
+	router.Register("GC", "/", "garbage-collect", http.MethodPost, GarbageCollectAll)
+	router.Register("GC", "/", "garbage-collect", http.MethodGet, GetGarbageCollectReport)
 	router.Register("GC", "/", ":repository/:name/garbage-collect", http.MethodPost, GarbageCollect)
 
+	// retention
+	router.Register("Retention", "/", "retention", http.MethodPost, ApplyRetention)
+	router.Register("Retention", "/", "retention", http.MethodGet, GetRetentionReport)
+
+	// replication
+	router.Register("Replication", "/", "replications", http.MethodGet, GetReplicationStatus)
+
+	// audit
+	router.Register("Audit", "/", "audit", http.MethodGet, GetAuditRecords)
+
+	// quotas
+	router.Register("Quotas", "/quotas/", ":repository", http.MethodGet, GetProjectQuota)
+	router.Register("Quotas", "/quotas/", ":repository/:name", http.MethodGet, GetRepositoryQuota)
+
 	// index
 	router.Register("Index", "/", ":repository/:name/index", http.MethodGet, GetIndex)
 	router.Register("Index", "/", ":repository/:name/index", http.MethodDelete, DeleteIndex)
@@ -316,6 +703,12 @@ func init() {
 	router.Register("Blobs", "/", ":repository/:name/blobs/:digest", http.MethodHead, HeadBlob)
 	router.Register("Blobs", "/", ":repository/:name/blobs/:digest", http.MethodGet, GetBlob)
 	router.Register("Blobs", "/", ":repository/:name/blobs/:digest", http.MethodPut, PutBlob)
+	// repository/blobs/uploads
+	router.Register("BlobUploads", "/", ":repository/:name/blobs/:digest/uploads", http.MethodPost, StartBlobUpload)
+	router.Register("BlobUploads", "/", ":repository/:name/blobs/:digest/uploads", http.MethodGet, GetBlobUpload)
+	router.Register("BlobUploads", "/", ":repository/:name/blobs/:digest/uploads", http.MethodPatch, PatchBlobUpload)
+	router.Register("BlobUploads", "/", ":repository/:name/blobs/:digest/uploads", http.MethodPut, CommitBlobUpload)
+	router.Register("BlobUploads", "/", ":repository/:name/blobs/:digest/uploads", http.MethodDelete, CancelBlobUpload)
 	// repository/copys
 	router.Register("Blobs", "/copys/", ":repositoryto/:nameto/:referenceto/:repositoryfrom/:namefrom/:referencefrom", http.MethodPut, CopyBlobs)
 
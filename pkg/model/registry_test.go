@@ -0,0 +1,153 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/registry"
+	errors "kubegems.io/modelx/pkg/response"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		rangestr       string
+		size           int64
+		offset, length int64
+		unsatisfiable  bool
+	}{
+		{rangestr: "bytes=0-4", size: 10, offset: 0, length: 5},
+		{rangestr: "bytes=5-", size: 10, offset: 5, length: 5},
+		{rangestr: "bytes=8-100", size: 10, offset: 8, length: 2},
+		{rangestr: "bytes=-3", size: 10, offset: 7, length: 3},
+		{rangestr: "bytes=-20", size: 10, offset: 0, length: 10},
+		{rangestr: "bytes= 2-3", size: 10, offset: 2, length: 2},
+		// not served as a single range, the whole content is sent
+		{rangestr: "bytes=0-1,3-4", size: 10, length: -1},
+		{rangestr: "items=0-4", size: 10, length: -1},
+		{rangestr: "bytes=5-2", size: 10, length: -1},
+		{rangestr: "bytes=abc", size: 10, length: -1},
+		{rangestr: "bytes=a-", size: 10, length: -1},
+		{rangestr: "bytes=--1", size: 10, length: -1},
+		// unsatisfiable
+		{rangestr: "bytes=10-", size: 10, unsatisfiable: true},
+		{rangestr: "bytes=-0", size: 10, unsatisfiable: true},
+		{rangestr: "bytes=-1", size: 0, unsatisfiable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rangestr, func(t *testing.T) {
+			assert := assert.New(t)
+			offset, length, err := ParseRange(tt.rangestr, tt.size)
+			if tt.unsatisfiable {
+				info := errors.ErrorInfo{}
+				assert.ErrorAs(err, &info)
+				assert.Equal(http.StatusRequestedRangeNotSatisfiable, info.HttpStatus)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tt.length, length)
+			if tt.length >= 0 {
+				assert.Equal(tt.offset, offset)
+			}
+		})
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	etag := `"sha256:abc"`
+	tests := []struct {
+		list string
+		want bool
+	}{
+		{list: `"sha256:abc"`, want: true},
+		{list: `W/"sha256:abc"`, want: true},
+		{list: `"sha256:def", "sha256:abc"`, want: true},
+		{list: `*`, want: true},
+		{list: `"sha256:def"`, want: false},
+		{list: `sha256:abc`, want: false},
+		{list: ``, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			assert.Equal(t, tt.want, MatchETag(tt.list, etag))
+		})
+	}
+}
+
+func TestServeBlobRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fs, err := registry.NewLocalFSProvider(&config.LocalFSOptions{Basepath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &registry.FSRegistryStore{FS: fs}
+	data := []byte("0123456789")
+	blob := digest.FromBytes(data)
+	content := registry.BlobContent{Content: io.NopCloser(bytes.NewReader(data)), ContentLength: int64(len(data)), ContentType: "application/octet-stream"}
+	if err := store.PutBlob(context.Background(), "library/llama", blob, content); err != nil {
+		t.Fatal(err)
+	}
+	origin := GlobalRegistry
+	GlobalRegistry = &Registry{Store: store}
+	defer func() { GlobalRegistry = origin }()
+
+	tests := []struct {
+		method, rangestr string
+		status           int
+		contentLength    string
+		contentRange     string
+		body             string
+	}{
+		{method: http.MethodGet, status: http.StatusOK, contentLength: "10", body: "0123456789"},
+		{method: http.MethodHead, status: http.StatusOK, contentLength: "10"},
+		{method: http.MethodGet, rangestr: "bytes=2-4", status: http.StatusPartialContent, contentLength: "3", contentRange: "bytes 2-4/10", body: "234"},
+		{method: http.MethodHead, rangestr: "bytes=2-4", status: http.StatusPartialContent, contentLength: "3", contentRange: "bytes 2-4/10"},
+		{method: http.MethodHead, rangestr: "bytes=10-", status: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.rangestr, func(t *testing.T) {
+			assert := assert.New(t)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(tt.method, "/library/llama/blobs/"+blob.String(), nil)
+			if tt.rangestr != "" {
+				c.Request.Header.Set("Range", tt.rangestr)
+			}
+			ServeBlob(c, "library/llama", blob, errors.ResponseError)
+			// as gin does once the handlers return
+			c.Writer.WriteHeaderNow()
+			assert.Equal(tt.status, w.Code)
+			assert.Equal(tt.contentRange, w.Header().Get("Content-Range"))
+			if tt.contentLength != "" {
+				assert.Equal(tt.contentLength, w.Header().Get("Content-Length"))
+			}
+			if tt.status != http.StatusRequestedRangeNotSatisfiable {
+				assert.Equal(tt.body, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"time"
+
+	"kubegems.io/modelx/pkg/audit"
+	"kubegems.io/modelx/pkg/middleware"
+)
+
+// auditDeletion records a deletion made by the maintenance, as the user who requested it
+// or as username when modelxd runs it on its own.
+func auditDeletion(ctx context.Context, username string, record audit.Record, err string) {
+	if requester := middleware.UsernameFromContext(ctx); requester != "" {
+		username = requester
+	}
+	record.Time, record.Username, record.Result = time.Now().UTC(), username, audit.ResultSuccess
+	if err != "" {
+		record.Result = audit.ResultFailure
+	}
+	middleware.RecordAudit(record)
+}
+
+// auditGCReport records the blobs and the upload sessions the garbage collect removed or failed to remove.
+func auditGCReport(ctx context.Context, report *GCReport) {
+	if report.DryRun {
+		return
+	}
+	auditBlobs := func(repository string, blobs []GCBlob) {
+		for _, blob := range blobs {
+			if blob.Status == GCBlobStatusRemoved || blob.Status == GCBlobStatusFailed {
+				auditDeletion(ctx, audit.UsernameGC, audit.Record{Operation: "CollectBlob", Repository: repository, Digest: blob.Digest.String()}, blob.Error)
+			}
+		}
+	}
+	for _, repository := range report.Repositories {
+		auditBlobs(repository.Repository, repository.Blobs)
+		for _, upload := range repository.Uploads {
+			if upload.Status == GCBlobStatusRemoved || upload.Status == GCBlobStatusFailed {
+				auditDeletion(ctx, audit.UsernameGC, audit.Record{Operation: "ExpireBlobUpload", Repository: repository.Repository, Reference: upload.ID}, upload.Error)
+			}
+		}
+	}
+	auditBlobs("", report.GlobalBlobs)
+}
+
+// auditRetentionReport records the versions the retention pruned or failed to prune.
+func auditRetentionReport(ctx context.Context, report *RetentionReport) {
+	for _, repository := range report.Repositories {
+		for _, version := range repository.Versions {
+			if version.Status == RetentionStatusPruned || version.Status == RetentionStatusFailed {
+				auditDeletion(ctx, audit.UsernameRetention, audit.Record{Operation: "PruneVersion", Repository: repository.Repository, Reference: version.Name}, version.Error)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"kubegems.io/modelx/pkg/audit"
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/middleware"
+)
+
+func TestAuditRetention(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, false)
+	l, err := audit.NewFileLog(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	assert.NoError(err)
+	defer l.Close()
+	middleware.SetAuditLog(l)
+	defer middleware.SetAuditLog(nil)
+
+	config1 := putTestBlob(t, store, "library/llama", "config v1")
+	config2 := putTestBlob(t, store, "library/llama", "config v2")
+	assert.NoError(store.PutManifest(ctx, "library/llama", "v1", "", testManifest(config1)))
+	assert.NoError(store.PutManifest(ctx, "library/llama", "v2", "", testManifest(config2)))
+
+	rules := []config.RetentionRule{{Repository: "library/*", KeepLast: 1}}
+	report, err := ApplyRetention(ctx, store, rules, RetentionOptions{})
+	assert.NoError(err)
+	assert.Equal(1, report.PrunedVersions)
+	pruned := report.Repositories[0].Versions[0].Name
+
+	records, err := l.Query(audit.Query{})
+	assert.NoError(err)
+	operations := map[string]audit.Record{}
+	for _, record := range records {
+		operations[record.Operation] = record
+	}
+	assert.Len(operations, 2)
+	assert.Equal(audit.UsernameRetention, operations["PruneVersion"].Username)
+	assert.Equal(pruned, operations["PruneVersion"].Reference)
+	assert.Equal(audit.UsernameGC, operations["CollectBlob"].Username)
+	assert.Equal("library/llama", operations["CollectBlob"].Repository)
+	assert.Equal(audit.ResultSuccess, operations["CollectBlob"].Result)
+
+	// the requester is recorded when the maintenance was requested
+	_, err = ApplyRetention(middleware.NewUsernameContext(ctx, "alice"), store, []config.RetentionRule{{Repository: "library/*"}}, RetentionOptions{})
+	assert.NoError(err)
+	records, err = l.Query(audit.Query{Username: "alice"})
+	assert.NoError(err)
+	assert.Len(records, 2)
+}
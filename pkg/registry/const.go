@@ -17,6 +17,8 @@ limitations under the License.
 package registry
 
 import (
+	"time"
+
 	logging "github.com/kubeservice-stack/common/pkg/logger"
 )
 
@@ -31,6 +33,25 @@ const (
 	MediaTypeModelIndexJson = "application/vnd.modelx.model.index.v1.json"
 
 	DefaultMaxBytesRead = int64(1 << 20) // 1MB
+
+	// concurrent stats when checking the blobs of a manifest
+	ManifestBlobCheckConcurrency = 16
+
+	// retries of an index update that lost a conditional write to a concurrent writer
+	IndexUpdateRetries    = 10
+	IndexUpdateBackoff    = 20 * time.Millisecond
+	IndexUpdateMaxBackoff = time.Second
+
+	// temporary files of local writes are named ".<name>.tmp-<random>"
+	LocalTempFileInfix = ".tmp-"
+	// temporary files unmodified for this long belong to interrupted writes
+	LocalTempFileMaxAge = 10 * time.Minute
+
+	// replication tasks queued per rule, events beyond are dropped and left to the next sync
+	ReplicationQueueSize = 1024
+	// backoff between the retries of a failed replication
+	ReplicationRetryBackoff    = time.Second
+	ReplicationMaxRetryBackoff = time.Minute
 )
 
 const (
@@ -24,11 +24,16 @@ import (
 	"time"
 
 	"github.com/opencontainers/go-digest"
+
+	errors "kubegems.io/modelx/pkg/response"
 	"kubegems.io/modelx/pkg/util"
 )
 
 var ErrRegistryStoreNotFound = stderrors.New("not found")
 
+// ErrPreconditionFailed is returned by conditional writes when the object was changed by someone else.
+var ErrPreconditionFailed = stderrors.New("precondition failed")
+
 type BlobLocation util.BlobLocation
 
 var (
@@ -53,9 +58,86 @@ func (s *BlobContent) Read(p []byte) (int, error) {
 	return s.Content.Read(p)
 }
 
+// VerifyReader hashes and counts the blob stream while it is consumed, the stream fails
+// once the expected size is read or at EOF if the content does not match the expected digest or size.
+// A writer reading no more than the expected size still sees the failure, and discards what it wrote.
+type VerifyReader struct {
+	content  io.ReadCloser
+	expected digest.Digest
+	size     int64 // expected size, <= 0 means unknown
+	digester digest.Digester
+	read     int64
+	eof      bool
+	err      error
+}
+
+func NewVerifyReader(content io.ReadCloser, expected digest.Digest, size int64) *VerifyReader {
+	return &VerifyReader{
+		content:  content,
+		expected: expected,
+		size:     size,
+		digester: expected.Algorithm().Digester(),
+	}
+}
+
+func (r *VerifyReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		_, _ = r.digester.Hash().Write(p[:n])
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	if r.eof || (r.size > 0 && r.read >= r.size) {
+		if verr := r.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+func (r *VerifyReader) Close() error {
+	return r.content.Close()
+}
+
+// Verify consumes the rest of the stream and checks the digest and size.
+func (r *VerifyReader) Verify() error {
+	if !r.eof {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+	}
+	return r.verify()
+}
+
+// Err returns the verification error, if any, seen while reading.
+func (r *VerifyReader) Err() error {
+	return r.err
+}
+
+func (r *VerifyReader) verify() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.size > 0 && r.read != r.size {
+		r.err = errors.NewSizeInvalidError(r.size, r.read)
+		return r.err
+	}
+	if got := r.digester.Digest(); got != r.expected {
+		r.err = errors.NewDigestMismatchError(r.expected, got)
+		return r.err
+	}
+	return nil
+}
+
 type BlobMeta struct {
 	ContentType   string
 	ContentLength int64
+	// LastModified is the time the blob was put into the repository.
+	LastModified time.Time
+	// Linked reports the content is stored in the global blob pool.
+	Linked bool
 }
 
 type FsObjectMeta struct {
@@ -63,6 +145,8 @@ type FsObjectMeta struct {
 	Size         int64
 	LastModified time.Time
 	ContentType  string
+	// ETag identifies the current version of the object, it is only set by Stat.
+	ETag string
 }
 
 func BlobDigestPath(repository string, d digest.Digest) string {
@@ -88,3 +172,7 @@ func SplitManifestPath(in string) (string, string) {
 func IsRegistryStoreNotNotFound(err error) bool {
 	return stderrors.Is(err, ErrRegistryStoreNotFound)
 }
+
+func IsPreconditionFailed(err error) bool {
+	return stderrors.Is(err, ErrPreconditionFailed)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/event"
+	"kubegems.io/modelx/pkg/middleware"
+	"kubegems.io/modelx/pkg/util"
+)
+
+// EventPublisher is implemented by stores which publish the changes made through them.
+type EventPublisher interface {
+	Publish(ctx context.Context, e event.Event)
+}
+
+// EventStore publishes the versions pushed and deleted, the repositories deleted and the blobs copied through it.
+type EventStore struct {
+	RegistryInterface
+	Bus *event.Bus
+}
+
+var (
+	_ RegistryInterface = &EventStore{}
+	_ EventPublisher    = &EventStore{}
+)
+
+func NewEventStore(store RegistryInterface, bus *event.Bus) *EventStore {
+	return &EventStore{RegistryInterface: store, Bus: bus}
+}
+
+// Publish publishes the event as the user of the request.
+func (s *EventStore) Publish(ctx context.Context, e event.Event) {
+	if e.Username == "" {
+		e.Username = middleware.UsernameFromContext(ctx)
+	}
+	s.Bus.Publish(e)
+}
+
+func (s *EventStore) PutManifest(ctx context.Context, repository string, reference string, contentType string, manifest util.Manifest) error {
+	if err := s.RegistryInterface.PutManifest(ctx, repository, reference, contentType, manifest); err != nil {
+		return err
+	}
+	s.Publish(ctx, manifestEvent(event.TypeManifestPush, repository, reference, &manifest))
+	return nil
+}
+
+func (s *EventStore) DeleteManifest(ctx context.Context, repository string, reference string) error {
+	// read before it is gone, for the digest and the size
+	manifest, _ := s.RegistryInterface.GetManifest(ctx, repository, reference)
+	if err := s.RegistryInterface.DeleteManifest(ctx, repository, reference); err != nil {
+		return err
+	}
+	s.Publish(ctx, manifestEvent(event.TypeManifestDelete, repository, reference, manifest))
+	return nil
+}
+
+func (s *EventStore) RemoveIndex(ctx context.Context, repository string) error {
+	if err := s.RegistryInterface.RemoveIndex(ctx, repository); err != nil {
+		return err
+	}
+	s.Publish(ctx, event.Event{Type: event.TypeRepositoryDelete, Repository: repository})
+	return nil
+}
+
+func (s *EventStore) CopyBlobs(ctx context.Context, repositoryTo, repositoryFrom string) error {
+	if err := s.RegistryInterface.CopyBlobs(ctx, repositoryTo, repositoryFrom); err != nil {
+		return err
+	}
+	s.Publish(ctx, event.Event{Type: event.TypeBlobsCopy, Repository: repositoryTo, Source: repositoryFrom})
+	return nil
+}
+
+// GCGlobalBlobs forwards to the wrapped store, which may have a global blob pool.
+func (s *EventStore) GCGlobalBlobs(ctx context.Context, options GCOptions) ([]GCBlob, error) {
+	if collector, ok := s.RegistryInterface.(GlobalBlobCollector); ok {
+		return collector.GCGlobalBlobs(ctx, options)
+	}
+	return []GCBlob{}, nil
+}
+
+// GCUploads forwards to the wrapped store, which may expire the abandoned upload sessions.
+func (s *EventStore) GCUploads(ctx context.Context, repository string, options GCOptions) ([]GCUpload, error) {
+	if collector, ok := s.RegistryInterface.(UploadCollector); ok {
+		return collector.GCUploads(ctx, repository, options)
+	}
+	return []GCUpload{}, nil
+}
+
+// LockGC forwards to the wrapped store, which may hold a lock shared by the replicas.
+func (s *EventStore) LockGC(ctx context.Context, ttl time.Duration) (context.Context, func(), error) {
+	if locker, ok := s.RegistryInterface.(GCLocker); ok {
+		return locker.LockGC(ctx, ttl)
+	}
+	return ctx, func() {}, nil
+}
+
+// ListRepositories forwards to the wrapped store, which may list the repositories without an index.
+func (s *EventStore) ListRepositories(ctx context.Context) ([]string, error) {
+	return listRepositories(ctx, s.RegistryInterface)
+}
+
+// ListManifests forwards to the wrapped store, which may list the manifests missing in the index.
+func (s *EventStore) ListManifests(ctx context.Context, repository string) ([]string, error) {
+	return listManifests(ctx, s.RegistryInterface, repository)
+}
+
+// StoredBytes forwards to the wrapped store, which may count the blobs no version references and the upload sessions.
+func (s *EventStore) StoredBytes(ctx context.Context, name string) (int64, error) {
+	return storedBytes(ctx, s.RegistryInterface, name)
+}
+
+// ProjectQuota forwards to the wrapped store, which may enforce quotas.
+func (s *EventStore) ProjectQuota(project string) (config.Quota, bool) {
+	if limiter, ok := s.RegistryInterface.(QuotaLimiter); ok {
+		return limiter.ProjectQuota(project)
+	}
+	return config.Quota{}, false
+}
+
+// RepositoryQuota forwards to the wrapped store, which may enforce quotas.
+func (s *EventStore) RepositoryQuota(repository string) (config.Quota, bool) {
+	if limiter, ok := s.RegistryInterface.(QuotaLimiter); ok {
+		return limiter.RepositoryQuota(repository)
+	}
+	return config.Quota{}, false
+}
+
+// manifestDigest is the digest of the manifest as it is stored, empty if it can not be encoded.
+func manifestDigest(manifest *util.Manifest) digest.Digest {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return ""
+	}
+	return digest.FromBytes(content)
+}
+
+// manifestEvent describes the version by the digest of its stored manifest and the size of its blobs.
+func manifestEvent(typ event.Type, repository, reference string, manifest *util.Manifest) event.Event {
+	e := event.Event{Type: typ, Repository: repository, Reference: reference}
+	if manifest == nil {
+		return e
+	}
+	e.Digest = manifestDigest(manifest)
+	e.Size = manifest.Config.Size
+	for _, blob := range manifest.Blobs {
+		e.Size += blob.Size
+	}
+	return e
+}
+
+// publishGCReport publishes the blobs removed by a garbage collect, if store publishes events.
+func publishGCReport(ctx context.Context, store RegistryInterface, report *GCReport) {
+	publisher, ok := store.(EventPublisher)
+	if !ok {
+		return
+	}
+	publish := func(repository string, blobs []GCBlob) {
+		for _, blob := range blobs {
+			if blob.Status == GCBlobStatusRemoved {
+				publisher.Publish(ctx, event.Event{Type: event.TypeBlobGC, Repository: repository, Digest: blob.Digest, Size: blob.Size})
+			}
+		}
+	}
+	for _, repository := range report.Repositories {
+		publish(repository.Repository, repository.Blobs)
+	}
+	publish("", report.GlobalBlobs)
+}
@@ -17,32 +17,220 @@ limitations under the License.
 package registry
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/opencontainers/go-digest"
+
+	errors "kubegems.io/modelx/pkg/response"
+	"kubegems.io/modelx/pkg/util"
 )
 
-func GCBlobsAll(ctx context.Context, store RegistryInterface) error {
+const (
+	// GCLockPath is shared by all modelxd replicas on the storage,
+	// repository names never start with "_" so it can not collide with one.
+	GCLockPath = "_gc/lock"
+	// a replica which died while collecting stops blocking others after this,
+	// the replica holding the lock renews it every third of it.
+	GCLockTTL = 10 * time.Minute
+
+	GCBlobStatusRemoved = "removed"
+	GCBlobStatusUnused  = "unused" // would be removed, in dry run
+	GCBlobStatusRecent  = "recent" // unused but younger than MinBlobAge
+	GCBlobStatusFailed  = "failed"
+)
+
+type GCOptions struct {
+	// MinBlobAge keeps unreferenced blobs younger than this, their push may not have put its manifest yet.
+	MinBlobAge time.Duration
+	// DryRun only reports the blobs which would be removed.
+	DryRun bool
+	// UploadTTL removes the upload sessions idle for longer than this, 0 keeps them.
+	UploadTTL time.Duration
+}
+
+// GCBlob is an unreferenced blob found by garbage collect.
+type GCBlob struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// GCUpload is an expired upload session found by garbage collect, the size is of the chunks it received.
+type GCUpload struct {
+	ID     string `json:"id"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type GCRepositoryReport struct {
+	Repository     string     `json:"repository"`
+	Blobs          []GCBlob   `json:"blobs"`
+	Uploads        []GCUpload `json:"uploads,omitempty"`
+	ReclaimedBytes int64      `json:"reclaimedBytes"`
+}
+
+// GCReport summarizes a garbage collect, in dry run the reclaimed bytes are the bytes it would reclaim.
+type GCReport struct {
+	DryRun         bool                 `json:"dryRun"`
+	StartedAt      time.Time            `json:"startedAt"`
+	FinishedAt     time.Time            `json:"finishedAt"`
+	Repositories   []GCRepositoryReport `json:"repositories"`
+	GlobalBlobs    []GCBlob             `json:"globalBlobs,omitempty"`
+	RemovedBlobs   int                  `json:"removedBlobs"`
+	RemovedUploads int                  `json:"removedUploads,omitempty"`
+	ReclaimedBytes int64                `json:"reclaimedBytes"`
+}
+
+func (r *GCReport) addRepository(result *GCRepositoryReport) {
+	r.Repositories = append(r.Repositories, *result)
+	for _, upload := range result.Uploads {
+		if upload.Status == GCBlobStatusRemoved || upload.Status == GCBlobStatusUnused {
+			r.RemovedUploads++
+		}
+	}
+	r.add(result.Blobs, result.ReclaimedBytes)
+}
+
+func (r *GCReport) add(blobs []GCBlob, reclaimed int64) {
+	for _, blob := range blobs {
+		if blob.Status == GCBlobStatusRemoved || blob.Status == GCBlobStatusUnused {
+			r.RemovedBlobs++
+		}
+	}
+	r.ReclaimedBytes += reclaimed
+}
+
+// GCLocker is implemented by stores which can hold a lock shared by all modelxd replicas.
+// The lock is renewed until unlock, the returned context is canceled if it is lost.
+type GCLocker interface {
+	LockGC(ctx context.Context, ttl time.Duration) (lockctx context.Context, unlock func(), err error)
+}
+
+// RepositoryLister is implemented by stores which can list every repository holding objects,
+// including the ones whose index was removed with their last version.
+type RepositoryLister interface {
+	ListRepositories(ctx context.Context) ([]string, error)
+}
+
+// ManifestLister is implemented by stores which can list the manifests stored in a repository,
+// including the ones its index misses, such as after a failed index refresh.
+type ManifestLister interface {
+	ListManifests(ctx context.Context, repository string) ([]string, error)
+}
+
+// listManifests lists the references of the manifests of the repository, the index is used if the store can not list them.
+func listManifests(ctx context.Context, store RegistryInterface, repository string) ([]string, error) {
+	if lister, ok := store.(ManifestLister); ok {
+		return lister.ListManifests(ctx, repository)
+	}
+	index, err := store.GetIndex(ctx, repository, "")
+	if err != nil && !IsRegistryStoreNotNotFound(err) {
+		return nil, err
+	}
+	references := make([]string, 0, len(index.Manifests))
+	for _, version := range index.Manifests {
+		references = append(references, version.Name)
+	}
+	return references, nil
+}
+
+// listRepositories lists the repositories of the store, the global index is used if the store can not list them.
+func listRepositories(ctx context.Context, store RegistryInterface) ([]string, error) {
+	if lister, ok := store.(RepositoryLister); ok {
+		return lister.ListRepositories(ctx)
+	}
 	globalindex, err := store.GetGlobalIndex(ctx, "")
-	if err != nil {
-		return err
+	if err != nil && !IsRegistryStoreNotNotFound(err) {
+		return nil, err
 	}
+	repositories := make([]string, 0, len(globalindex.Manifests))
 	for _, repository := range globalindex.Manifests {
-		if _, err := GCBlobs(ctx, store, repository.Name); err != nil {
+		repositories = append(repositories, repository.Name)
+	}
+	return repositories, nil
+}
+
+// GCBlobsAll collects the unreferenced blobs of every repository, then of the global blob pool.
+func GCBlobsAll(ctx context.Context, store RegistryInterface, options GCOptions) (*GCReport, error) {
+	report := &GCReport{DryRun: options.DryRun, StartedAt: time.Now(), Repositories: []GCRepositoryReport{}}
+	err := withGCLock(ctx, store, func(ctx context.Context) error {
+		repositories, err := listRepositories(ctx, store)
+		if err != nil {
 			return err
 		}
+		for _, repository := range repositories {
+			result, err := gcBlobs(ctx, store, repository, options)
+			if err != nil {
+				return err
+			}
+			report.addRepository(result)
+		}
+		if collector, ok := store.(GlobalBlobCollector); ok {
+			blobs, err := collector.GCGlobalBlobs(ctx, options)
+			if err != nil {
+				return err
+			}
+			reclaimed := int64(0)
+			for _, blob := range blobs {
+				if blob.Status == GCBlobStatusRemoved || blob.Status == GCBlobStatusUnused {
+					reclaimed += blob.Size
+				}
+			}
+			report.GlobalBlobs = blobs
+			report.add(blobs, reclaimed)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	report.FinishedAt = time.Now()
+	publishGCReport(ctx, store, report)
+	auditGCReport(ctx, report)
+	return report, nil
 }
 
-func GCBlobs(ctx context.Context, store RegistryInterface, repository string) (map[digest.Digest]string, error) {
+// GCBlobs collects the unreferenced blobs of the repository.
+func GCBlobs(ctx context.Context, store RegistryInterface, repository string, options GCOptions) (*GCReport, error) {
+	report := &GCReport{DryRun: options.DryRun, StartedAt: time.Now(), Repositories: []GCRepositoryReport{}}
+	err := withGCLock(ctx, store, func(ctx context.Context) error {
+		result, err := gcBlobs(ctx, store, repository, options)
+		if err != nil {
+			return err
+		}
+		report.addRepository(result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.FinishedAt = time.Now()
+	publishGCReport(ctx, store, report)
+	auditGCReport(ctx, report)
+	return report, nil
+}
 
-	registryLogger.Info("star blobs garbage collect", zap.Any("repository", repository))
+func gcBlobs(ctx context.Context, store RegistryInterface, repository string, options GCOptions) (*GCRepositoryReport, error) {
+	registryLogger.Info("star blobs garbage collect", zap.Any("repository", repository), zap.Bool("dryRun", options.DryRun))
 	defer registryLogger.Info("stop blobs garbage collect")
 
-	manifests, err := store.GetIndex(ctx, repository, "")
+	// the manifests on the storage, not the index which may miss some
+	references, err := listManifests(ctx, store, repository)
 	if err != nil {
 		return nil, err
 	}
@@ -52,33 +240,296 @@ func GCBlobs(ctx context.Context, store RegistryInterface, repository string) (m
 	}
 
 	inuse := map[digest.Digest]struct{}{}
-	for _, version := range manifests.Manifests {
-		manifest, err := store.GetManifest(ctx, repository, version.Name)
+	for _, reference := range references {
+		manifest, err := store.GetManifest(ctx, repository, reference)
 		if err != nil {
+			// removed since listed
+			if errors.IsErrCode(err, errors.ErrCodeManifestUnknown) {
+				continue
+			}
 			return nil, err
 		}
 		for _, blob := range append(manifest.Blobs, manifest.Config) {
 			inuse[blob.Digest] = struct{}{}
 		}
+		// manifests pushed through the OCI api keep their raw content as a blob.
+		if raw, err := digest.Parse(manifest.Annotations[util.AnnotationOCIManifestDigest]); err == nil {
+			inuse[raw] = struct{}{}
+		}
 	}
 
-	toremove := map[digest.Digest]string{}
+	result := &GCRepositoryReport{Repository: repository, Blobs: []GCBlob{}}
 	for _, blobdigest := range all {
-		if _, ok := inuse[blobdigest]; !ok {
+		if _, ok := inuse[blobdigest]; ok {
+			continue
+		}
+		meta, err := store.GetBlobMeta(ctx, repository, blobdigest)
+		if err != nil {
+			registryLogger.Error("stat unused blob", zap.Any("digest", blobdigest.String()), zap.Error(err))
+			result.Blobs = append(result.Blobs, GCBlob{Digest: blobdigest, Status: GCBlobStatusFailed, Error: err.Error()})
+			continue
+		}
+		blob := GCBlob{Digest: blobdigest, Size: meta.ContentLength}
+		// a link only frees its global blob once no repository links to it, that is counted by the global gc.
+		reclaimed := meta.ContentLength
+		if meta.Linked {
+			reclaimed = 0
+		}
+		switch {
+		case time.Since(meta.LastModified) < options.MinBlobAge:
+			blob.Status = GCBlobStatusRecent
+		case options.DryRun:
 			registryLogger.Info("mark blob unused", zap.Any("digest", blobdigest.String()))
-			toremove[blobdigest] = ""
+			blob.Status = GCBlobStatusUnused
+			result.ReclaimedBytes += reclaimed
+		default:
+			if err := store.DeleteBlob(ctx, repository, blobdigest); err != nil {
+				registryLogger.Error("remove unused blob", zap.Any("digest", blobdigest.String()), zap.Error(err))
+				blob.Status, blob.Error = GCBlobStatusFailed, err.Error()
+			} else {
+				registryLogger.Info("removed unused blob", zap.Any("digest", blobdigest.String()))
+				blob.Status = GCBlobStatusRemoved
+				result.ReclaimedBytes += reclaimed
+			}
 		}
+		result.Blobs = append(result.Blobs, blob)
 	}
 
-	for digest := range toremove {
-		if err := store.DeleteBlob(ctx, repository, digest); err != nil {
-			registryLogger.Error("remove unused blob", zap.Any("digest", digest.String()), zap.Error(err))
-			toremove[digest] = err.Error()
+	if collector, ok := store.(UploadCollector); ok {
+		uploads, err := collector.GCUploads(ctx, repository, options)
+		if err != nil {
 			return nil, err
+		}
+		for _, upload := range uploads {
+			if upload.Status == GCBlobStatusRemoved || upload.Status == GCBlobStatusUnused {
+				result.ReclaimedBytes += upload.Size
+			}
+		}
+		if len(uploads) > 0 {
+			result.Uploads = uploads
+		}
+	}
+	return result, nil
+}
+
+// withGCLock runs fn while holding the gc lock of the store, stores without one run fn directly.
+// The context of fn is canceled if the lock is lost.
+func withGCLock(ctx context.Context, store RegistryInterface, fn func(ctx context.Context) error) error {
+	locker, ok := store.(GCLocker)
+	if !ok {
+		return fn(ctx)
+	}
+	lockctx, unlock, err := locker.LockGC(ctx, GCLockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := fn(lockctx); err != nil {
+		if cause := context.Cause(lockctx); cause != nil && stderrors.Is(cause, errGCLockLost) {
+			return errors.NewConflictError(cause.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+var errGCLockLost = stderrors.New("gc lock lost, garbage collect is running on another replica")
+
+type gcLock struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LockGC takes the gc lock with a conditional write, an expired lock is taken over.
+// The lock is renewed every third of ttl until unlock, the returned context is canceled once it is lost.
+func (m *FSRegistryStore) LockGC(ctx context.Context, ttl time.Duration) (context.Context, func(), error) {
+	current, etag, err := m.readGCLock(ctx)
+	if err != nil {
+		return nil, nil, errors.NewInternalError(err)
+	}
+	if current != nil && time.Now().Before(current.ExpiresAt) {
+		return nil, nil, errors.NewConflictError(fmt.Sprintf("garbage collect is running on %s", current.Holder))
+	}
+	hostname, _ := os.Hostname()
+	lock := gcLock{Holder: hostname + "/" + NewUploadID()}
+	if err := m.writeGCLock(ctx, lock, ttl, etag); err != nil {
+		if IsPreconditionFailed(err) {
+			return nil, nil, errors.NewConflictError("garbage collect is running on another replica")
+		}
+		return nil, nil, errors.NewInternalError(err)
+	}
+
+	lockctx, cancel := context.WithCancelCause(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		m.renewGCLock(lockctx, lock, ttl, cancel)
+	}()
+	unlock := func() {
+		cancel(nil)
+		<-renewed
+		ctx := context.WithoutCancel(ctx)
+		// only remove the lock while it is still ours, it may have expired and been taken over.
+		current, etag, err := m.readGCLock(ctx)
+		if err != nil || current == nil || current.Holder != lock.Holder {
+			return
+		}
+		if err := m.FS.RemoveIf(ctx, GCLockPath, etag); err != nil {
+			registryLogger.Error("release gc lock", zap.Error(err))
+		}
+	}
+	return lockctx, unlock, nil
+}
+
+// renewGCLock extends the lock until ctx is done, lost is called once another replica holds it.
+// A failed renewal is retried on the next tick, the lock is still valid until it expires.
+func (m *FSRegistryStore) renewGCLock(ctx context.Context, lock gcLock, ttl time.Duration, lost context.CancelCauseFunc) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current, etag, err := m.readGCLock(ctx)
+		if err != nil {
+			registryLogger.Warn("renew gc lock", zap.Error(err))
+			continue
+		}
+		if current == nil || current.Holder != lock.Holder {
+			lost(errGCLockLost)
+			return
+		}
+		if err := m.writeGCLock(ctx, lock, ttl, etag); err != nil {
+			if IsPreconditionFailed(err) {
+				lost(errGCLockLost)
+				return
+			}
+			registryLogger.Warn("renew gc lock", zap.Error(err))
+		}
+	}
+}
+
+// writeGCLock writes the lock expiring after ttl if the lock object still has etag.
+func (m *FSRegistryStore) writeGCLock(ctx context.Context, lock gcLock, ttl time.Duration, etag string) error {
+	lock.ExpiresAt = time.Now().Add(ttl)
+	content, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	storageContent := BlobContent{
+		Content:       io.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+		ContentType:   "application/json",
+	}
+	return m.FS.PutIf(ctx, GCLockPath, storageContent, etag)
+}
+
+// ListRepositories returns every repository holding objects, the ones whose index was removed
+// with their last version still have blobs to collect.
+func (m *FSRegistryStore) ListRepositories(ctx context.Context) ([]string, error) {
+	metas, err := m.FS.List(ctx, "", true)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	seen := map[string]struct{}{}
+	for _, meta := range metas {
+		// <project>/<name>/index.json, <project>/<name>/{blobs,manifests,uploads}/...
+		parts := strings.SplitN(meta.Name, "/", 4)
+		if len(parts) < 3 || strings.HasPrefix(parts[0], "_") {
+			continue
+		}
+		switch parts[2] {
+		case RegistryIndexFileName, "blobs", "manifests", "uploads":
+			seen[parts[0]+"/"+parts[1]] = struct{}{}
+		}
+	}
+	repositories := make([]string, 0, len(seen))
+	for repository := range seen {
+		repositories = append(repositories, repository)
+	}
+	slices.Sort(repositories)
+	return repositories, nil
+}
+
+// ListManifests returns the references of the manifests stored in the repository.
+func (m *FSRegistryStore) ListManifests(ctx context.Context, repository string) ([]string, error) {
+	metas, err := m.FS.List(ctx, ManifestPath(repository, ""), false)
+	if err != nil {
+		if os.IsNotExist(err) || IsS3StorageNotFound(err) {
+			return []string{}, nil
+		}
+		return nil, errors.NewInternalError(err)
+	}
+	references := make([]string, 0, len(metas))
+	for _, meta := range metas {
+		references = append(references, path.Base(meta.Name))
+	}
+	return references, nil
+}
+
+func (m *FSRegistryStore) readGCLock(ctx context.Context) (*gcLock, string, error) {
+	etag, err := m.objectETag(ctx, GCLockPath)
+	if err != nil || etag == "" {
+		return nil, "", err
+	}
+	body, err := m.FS.Get(ctx, GCLockPath)
+	if err != nil {
+		if IsS3StorageNotFound(err) || os.IsNotExist(err) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	defer body.Close()
+	lock := &gcLock{}
+	if err := json.NewDecoder(body).Decode(lock); err != nil {
+		// a broken lock does not block, it is overwritten.
+		return nil, etag, nil
+	}
+	return lock, etag, nil
+}
+
+// GCScheduler runs GCBlobsAll every Interval and keeps the last report.
+type GCScheduler struct {
+	Store    RegistryInterface
+	Interval time.Duration
+	Options  GCOptions
+	scheduler
+
+	mu   sync.Mutex
+	last *GCReport
+}
+
+func (s *GCScheduler) Run(ctx context.Context) error {
+	registryLogger.Info("start garbage collect scheduler", zap.Duration("interval", s.Interval), zap.Bool("dryRun", s.Options.DryRun))
+	s.schedule(ctx, s.Interval, s.runOnce)
+	return nil
+}
+
+func (s *GCScheduler) runOnce(ctx context.Context) {
+	report, err := GCBlobsAll(ctx, s.Store, s.Options)
+	if err != nil {
+		if errors.IsErrCode(err, errors.ErrCodeConflict) {
+			registryLogger.Info("skip scheduled garbage collect", zap.Error(err))
 		} else {
-			registryLogger.Error("removed unused blob", zap.Any("digest", digest.String()), zap.Error(err))
-			toremove[digest] = "removed"
+			registryLogger.Error("scheduled garbage collect", zap.Error(err))
 		}
+		return
 	}
-	return toremove, nil
+	registryLogger.Info("scheduled garbage collect finished",
+		zap.Bool("dryRun", report.DryRun),
+		zap.Int("removedBlobs", report.RemovedBlobs),
+		zap.Int64("reclaimedBytes", report.ReclaimedBytes),
+		zap.Duration("duration", report.FinishedAt.Sub(report.StartedAt)))
+	s.mu.Lock()
+	s.last = report
+	s.mu.Unlock()
+}
+
+// LastReport returns the report of the last scheduled garbage collect, nil if none has finished yet.
+func (s *GCScheduler) LastReport() *GCReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
 }
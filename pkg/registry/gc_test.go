@@ -0,0 +1,261 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	errors "kubegems.io/modelx/pkg/response"
+)
+
+func gcStatuses(report *GCReport) map[digest.Digest]string {
+	statuses := map[digest.Digest]string{}
+	for _, repository := range report.Repositories {
+		for _, blob := range repository.Blobs {
+			statuses[blob.Digest] = blob.Status
+		}
+	}
+	return statuses
+}
+
+func sortedGCBlobs(blobs []GCBlob) []GCBlob {
+	slices.SortFunc(blobs, func(a, b GCBlob) int {
+		return strings.Compare(a.Digest.String(), b.Digest.String())
+	})
+	return blobs
+}
+
+func TestGCBlobs(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, false)
+
+	config := putTestBlob(t, store, "library/llama", "config")
+	used := putTestBlob(t, store, "library/llama", "weights")
+	unused := putTestBlob(t, store, "library/llama", "old weights")
+	assert.NoError(store.PutManifest(ctx, "library/llama", "v1", "", testManifest(config, used)))
+
+	// recent blobs are kept
+	report, err := GCBlobs(ctx, store, "library/llama", GCOptions{MinBlobAge: time.Hour})
+	assert.NoError(err)
+	assert.Equal(map[digest.Digest]string{unused.Digest: GCBlobStatusRecent}, gcStatuses(report))
+	assert.Equal(0, report.RemovedBlobs)
+
+	// dry run only marks
+	report, err = GCBlobs(ctx, store, "library/llama", GCOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(map[digest.Digest]string{unused.Digest: GCBlobStatusUnused}, gcStatuses(report))
+	assert.Equal(1, report.RemovedBlobs)
+	assert.Equal(unused.Size, report.ReclaimedBytes)
+	exists, _ := store.ExistsBlob(ctx, "library/llama", unused.Digest)
+	assert.True(exists)
+
+	report, err = GCBlobs(ctx, store, "library/llama", GCOptions{})
+	assert.NoError(err)
+	assert.Equal(map[digest.Digest]string{unused.Digest: GCBlobStatusRemoved}, gcStatuses(report))
+	assert.Equal(unused.Size, report.ReclaimedBytes)
+	for _, blob := range []string{"config", "weights", "old weights"} {
+		exists, _ := store.ExistsBlob(ctx, "library/llama", digest.FromString(blob))
+		assert.Equal(blob != "old weights", exists, blob)
+	}
+}
+
+func TestGCBlobsStaleIndex(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, false)
+
+	config := putTestBlob(t, store, "library/llama", "config")
+	blob := putTestBlob(t, store, "library/llama", "weights")
+	assert.NoError(store.PutManifest(ctx, "library/llama", "v1", "", testManifest(config, blob)))
+	// a failed index refresh leaves the manifest out of the index
+	assert.NoError(store.FS.Remove(ctx, IndexPath("library/llama"), false))
+
+	report, err := GCBlobs(ctx, store, "library/llama", GCOptions{})
+	assert.NoError(err)
+	assert.Empty(gcStatuses(report))
+	for _, blob := range []string{"config", "weights"} {
+		exists, _ := store.ExistsBlob(ctx, "library/llama", digest.FromString(blob))
+		assert.True(exists, blob)
+	}
+}
+
+func TestGCBlobsAllWithoutIndex(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, true)
+
+	config := putTestBlob(t, store, "library/llama", "config")
+	blob := putTestBlob(t, store, "library/llama", "weights")
+	assert.NoError(store.PutManifest(ctx, "library/llama", "v1", "", testManifest(config, blob)))
+	qwenconfig := putTestBlob(t, store, "library/qwen", "qwen config")
+	assert.NoError(store.PutManifest(ctx, "library/qwen", "v1", "", testManifest(qwenconfig, putTestBlob(t, store, "library/qwen", "weights"))))
+	// the index is removed with the last version
+	assert.NoError(store.DeleteManifest(ctx, "library/llama", "v1"))
+
+	repositories, err := store.ListRepositories(ctx)
+	assert.NoError(err)
+	assert.Equal([]string{"library/llama", "library/qwen"}, repositories)
+
+	report, err := GCBlobsAll(ctx, store, GCOptions{})
+	assert.NoError(err)
+	assert.Len(report.Repositories, 2)
+	assert.Equal(sortedGCBlobs([]GCBlob{
+		{Digest: config.Digest, Size: config.Size, Status: GCBlobStatusRemoved},
+		{Digest: blob.Digest, Size: blob.Size, Status: GCBlobStatusRemoved},
+	}), sortedGCBlobs(report.Repositories[0].Blobs))
+	assert.Empty(report.Repositories[1].Blobs)
+	assert.Equal([]GCBlob{{Digest: config.Digest, Size: config.Size, Status: GCBlobStatusRemoved}}, report.GlobalBlobs)
+	// links reclaim nothing until their global blob is removed
+	assert.Equal(config.Size, report.ReclaimedBytes)
+
+	// the blob linked by the other repository is kept
+	exists, err := store.FS.Exists(ctx, GlobalBlobDigestPath(blob.Digest))
+	assert.NoError(err)
+	assert.True(exists)
+}
+
+func TestLockGC(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, false)
+
+	ttl := 300 * time.Millisecond
+	lockctx, unlock, err := store.LockGC(ctx, ttl)
+	if !assert.NoError(err) {
+		return
+	}
+	// renewed past its ttl
+	time.Sleep(2 * ttl)
+	_, _, err = store.LockGC(ctx, ttl)
+	assert.True(errors.IsErrCode(err, errors.ErrCodeConflict), "got %v", err)
+	assert.NoError(lockctx.Err())
+
+	// taken over by another replica
+	assert.NoError(retryOnConflict(ctx, func() error {
+		_, etag, err := store.readGCLock(ctx)
+		if err != nil {
+			return err
+		}
+		return store.writeGCLock(ctx, gcLock{Holder: "other"}, time.Hour, etag)
+	}))
+	select {
+	case <-lockctx.Done():
+		assert.ErrorIs(context.Cause(lockctx), errGCLockLost)
+	case <-time.After(2 * ttl):
+		t.Error("lost lock not detected")
+	}
+	// the lock of the other replica is kept
+	unlock()
+	current, _, err := store.readGCLock(ctx)
+	assert.NoError(err)
+	if assert.NotNil(current) {
+		assert.Equal("other", current.Holder)
+	}
+}
+
+func TestGCUploads(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, false)
+
+	for _, upload := range []struct{ repository, id string }{{"library/llama", "abandoned"}, {"library/llama", "active"}, {"library/qwen", "abandoned"}} {
+		_, err := store.ResumeUpload(ctx, upload.repository, upload.id)
+		assert.NoError(err)
+		_, err = store.PutUploadChunk(ctx, upload.repository, upload.id, 0, BlobContent{
+			Content:       io.NopCloser(strings.NewReader("chunk")),
+			ContentLength: 5,
+		})
+		assert.NoError(err)
+	}
+	// the abandoned sessions received their last chunk two days ago
+	basepath := store.FS.(*LocalFSProvider).basepath
+	idle := time.Now().Add(-48 * time.Hour)
+	for _, dir := range []string{"library/llama/uploads/abandoned", "library/qwen/uploads/abandoned"} {
+		assert.NoError(filepath.WalkDir(filepath.Join(basepath, dir), func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(path, idle, idle)
+		}))
+	}
+
+	// 0 keeps them
+	report, err := GCBlobsAll(ctx, store, GCOptions{})
+	assert.NoError(err)
+	assert.Equal(0, report.RemovedUploads)
+
+	report, err = GCBlobsAll(ctx, store, GCOptions{UploadTTL: 24 * time.Hour, DryRun: true})
+	assert.NoError(err)
+	assert.Equal(2, report.RemovedUploads)
+	_, err = store.GetUpload(ctx, "library/llama", "abandoned")
+	assert.NoError(err)
+
+	report, err = GCBlobsAll(ctx, store, GCOptions{UploadTTL: 24 * time.Hour})
+	assert.NoError(err)
+	assert.Equal(2, report.RemovedUploads)
+	for _, repository := range report.Repositories {
+		assert.Len(repository.Uploads, 1, repository.Repository)
+		assert.Equal("abandoned", repository.Uploads[0].ID)
+		assert.Equal(GCBlobStatusRemoved, repository.Uploads[0].Status)
+		assert.Positive(repository.ReclaimedBytes)
+	}
+	_, err = store.GetUpload(ctx, "library/llama", "abandoned")
+	assert.True(errors.IsErrCode(err, errors.ErrCodeBlobUploadUnknown))
+	_, err = store.GetUpload(ctx, "library/qwen", "abandoned")
+	assert.True(errors.IsErrCode(err, errors.ErrCodeBlobUploadUnknown))
+	status, err := store.GetUpload(ctx, "library/llama", "active")
+	assert.NoError(err)
+	assert.Equal(int64(5), status.Offset)
+}
+
+func TestGCGlobalBlobsRepushed(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, true)
+	basepath := store.FS.(*LocalFSProvider).basepath
+
+	blob := putTestBlob(t, store, "library/llama", "weights")
+	assert.NoError(store.DeleteBlob(ctx, "library/llama", blob.Digest))
+	// unlinked for two days, about to be collected
+	idle := time.Now().Add(-48 * time.Hour)
+	assert.NoError(os.Chtimes(filepath.Join(basepath, GlobalBlobDigestPath(blob.Digest)), idle, idle))
+
+	// pushing it again writes it again, the garbage collect keeps it until it is linked
+	putTestBlob(t, store, "library/qwen", "weights")
+	meta, err := store.FS.Stat(ctx, GlobalBlobDigestPath(blob.Digest))
+	assert.NoError(err)
+	assert.WithinDuration(time.Now(), meta.LastModified, time.Minute)
+
+	blobs, err := store.GCGlobalBlobs(ctx, GCOptions{MinBlobAge: time.Hour})
+	assert.NoError(err)
+	assert.Empty(blobs)
+	exists, err := store.ExistsBlob(ctx, "library/qwen", blob.Digest)
+	assert.NoError(err)
+	assert.True(exists)
+}
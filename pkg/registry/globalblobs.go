@@ -0,0 +1,185 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"go.uber.org/zap"
+
+	errors "kubegems.io/modelx/pkg/response"
+)
+
+const (
+	// GlobalBlobsDir holds the blob pool shared by all repositories,
+	// repository names never start with "_" so it can not collide with one.
+	GlobalBlobsDir = "_blobs"
+
+	// MediaTypeBlobLink marks a repository blob whose content is in the global pool.
+	MediaTypeBlobLink = "application/vnd.modelx.blob.link.v1"
+)
+
+// GlobalBlobCollector is implemented by stores with a global blob pool.
+type GlobalBlobCollector interface {
+	GCGlobalBlobs(ctx context.Context, options GCOptions) ([]GCBlob, error)
+}
+
+func GlobalBlobDigestPath(d digest.Digest) string {
+	return path.Join(GlobalBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// statBlob returns the object holding the content of a repository blob and its path.
+// A link resolves to the global pool, blobs written without the global pool are stored in place.
+func (m *FSRegistryStore) statBlob(ctx context.Context, repository string, d digest.Digest) (FsObjectMeta, string, error) {
+	blobpath := BlobDigestPath(repository, d)
+	meta, err := m.FS.Stat(ctx, blobpath)
+	if err != nil {
+		return FsObjectMeta{}, "", err
+	}
+	if meta.ContentType != MediaTypeBlobLink {
+		return meta, blobpath, nil
+	}
+	globalpath := GlobalBlobDigestPath(d)
+	meta, err = m.FS.Stat(ctx, globalpath)
+	if err != nil {
+		return FsObjectMeta{}, "", err
+	}
+	return meta, globalpath, nil
+}
+
+// putGlobalBlob writes the content into the global pool and links it into the repository.
+// The content is written even if the pool has it: it is verified, knowing a digest must not be enough to link its blob,
+// and the fresh pool blob is kept by the garbage collect until the link is written.
+func (m *FSRegistryStore) putGlobalBlob(ctx context.Context, repository string, d digest.Digest, content BlobContent) error {
+	globalpath := GlobalBlobDigestPath(d)
+	if err := m.putBlob(ctx, repository, globalpath, d, content); err != nil {
+		return err
+	}
+	if err := m.linkBlob(ctx, repository, d); err != nil {
+		return err
+	}
+	// a garbage collect which listed the pool before the write may have removed it since
+	if exist, err := m.FS.Exists(ctx, globalpath); err != nil || !exist {
+		_ = m.FS.Remove(ctx, BlobDigestPath(repository, d), false)
+		if err == nil {
+			err = fmt.Errorf("global blob %s was collected while it was pushed", d)
+		}
+		return errors.NewInternalError(err)
+	}
+	return nil
+}
+
+func (m *FSRegistryStore) linkBlob(ctx context.Context, repository string, d digest.Digest) error {
+	link := []byte(d.String())
+	content := BlobContent{
+		Content:       io.NopCloser(bytes.NewReader(link)),
+		ContentLength: int64(len(link)),
+		ContentType:   MediaTypeBlobLink,
+	}
+	if err := m.FS.Put(ctx, BlobDigestPath(repository, d), content); err != nil {
+		return errors.NewInternalError(err)
+	}
+	return nil
+}
+
+// GCGlobalBlobs removes the blobs of the global pool that no repository links to,
+// blobs younger than MinBlobAge are kept as a push may be about to link them.
+func (m *FSRegistryStore) GCGlobalBlobs(ctx context.Context, options GCOptions) ([]GCBlob, error) {
+	registryLogger.Info("start global blobs garbage collect", zap.Bool("dryRun", options.DryRun))
+	defer registryLogger.Info("stop global blobs garbage collect")
+
+	// list the pool before the links, so a blob linked in between is seen as linked.
+	pool, err := m.FS.List(ctx, GlobalBlobsDir, true)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.NewInternalError(err)
+	}
+	result := []GCBlob{}
+	if len(pool) == 0 {
+		return result, nil
+	}
+	all, err := m.FS.List(ctx, "", true)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	linked := map[digest.Digest]struct{}{}
+	for _, meta := range all {
+		if strings.HasPrefix(meta.Name, GlobalBlobsDir+"/") || path.Base(path.Dir(path.Dir(meta.Name))) != "blobs" {
+			continue
+		}
+		if d, ok := parseBlobDigestPath(meta.Name); ok {
+			linked[d] = struct{}{}
+		}
+	}
+
+	for _, meta := range pool {
+		d, ok := parseBlobDigestPath(meta.Name)
+		if !ok {
+			continue
+		}
+		if _, ok := linked[d]; ok {
+			continue
+		}
+		blob := GCBlob{Digest: d, Size: meta.Size}
+		switch {
+		case time.Since(meta.LastModified) < options.MinBlobAge:
+			blob.Status = GCBlobStatusRecent
+		case options.DryRun:
+			blob.Status = GCBlobStatusUnused
+		case m.globalBlobRecent(ctx, d, options.MinBlobAge):
+			// the push which wrote it again is about to link it
+			blob.Status = GCBlobStatusRecent
+		default:
+			if err := m.FS.Remove(ctx, GlobalBlobDigestPath(d), false); err != nil {
+				registryLogger.Error("remove unlinked global blob", zap.Any("digest", d.String()), zap.Error(err))
+				blob.Status, blob.Error = GCBlobStatusFailed, err.Error()
+			} else {
+				registryLogger.Info("removed unlinked global blob", zap.Any("digest", d.String()))
+				blob.Status = GCBlobStatusRemoved
+			}
+		}
+		result = append(result, blob)
+	}
+	return result, nil
+}
+
+// globalBlobRecent stats the pool blob again and reports whether it is younger than minAge,
+// a push may have written it again since the pool was listed.
+func (m *FSRegistryStore) globalBlobRecent(ctx context.Context, d digest.Digest, minAge time.Duration) bool {
+	meta, err := m.FS.Stat(ctx, GlobalBlobDigestPath(d))
+	if err != nil {
+		// gone already, or left for the next garbage collect
+		return true
+	}
+	return time.Since(meta.LastModified) < minAge
+}
+
+// parseBlobDigestPath returns the digest of a blob object named <algorithm>/<encoded>.
+func parseBlobDigestPath(name string) (digest.Digest, bool) {
+	d := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(name))), path.Base(name))
+	if err := d.Validate(); err != nil {
+		return "", false
+	}
+	return d, true
+}
@@ -26,10 +26,16 @@ import (
 
 type FSProvider interface {
 	Put(ctx context.Context, path string, content BlobContent) error
+	// PutIf writes content only if the object still has etag, an empty etag requires the object to not exist.
+	// ErrPreconditionFailed is returned when the condition does not hold.
+	PutIf(ctx context.Context, path string, content BlobContent, etag string) error
 	Get(ctx context.Context, path string) (*BlobContent, error)
+	GetRange(ctx context.Context, path string, offset, length int64) (*BlobContent, error)
 	Copy(ctx context.Context, pathTo, pathFrom string) error
 	Stat(ctx context.Context, path string) (FsObjectMeta, error)
 	Remove(ctx context.Context, path string, recursive bool) error
+	// RemoveIf removes the object only if it still has etag.
+	RemoveIf(ctx context.Context, path string, etag string) error
 	Exists(ctx context.Context, path string) (bool, error)
 	List(ctx context.Context, path string, recursive bool) ([]FsObjectMeta, error)
 }
@@ -47,6 +53,7 @@ type RegistryInterface interface {
 
 	ListBlobs(ctx context.Context, repository string) ([]digest.Digest, error)
 	GetBlob(ctx context.Context, repository string, digest digest.Digest) (*BlobContent, error)
+	GetBlobRange(ctx context.Context, repository string, digest digest.Digest, offset, length int64) (*BlobContent, error)
 	CopyBlob(ctx context.Context, repositoryTo, repositoryFrom string, digest digest.Digest) error
 	CopyBlobs(ctx context.Context, repositoryTo, repositoryFrom string) error
 	DeleteBlob(ctx context.Context, repository string, digest digest.Digest) error
@@ -56,4 +63,11 @@ type RegistryInterface interface {
 
 	GetBlobLocation(ctx context.Context, repository string, digest digest.Digest,
 		purpose string, properties map[string]string) (*BlobLocation, error)
+
+	CreateUpload(ctx context.Context, repository string) (*UploadStatus, error)
+	ResumeUpload(ctx context.Context, repository string, id string) (*UploadStatus, error)
+	GetUpload(ctx context.Context, repository string, id string) (*UploadStatus, error)
+	PutUploadChunk(ctx context.Context, repository string, id string, offset int64, content BlobContent) (*UploadStatus, error)
+	CommitUpload(ctx context.Context, repository string, id string, digest digest.Digest) error
+	CancelUpload(ctx context.Context, repository string, id string) error
 }
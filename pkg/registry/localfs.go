@@ -17,6 +17,7 @@ limitations under the License.
 package registry
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"io"
@@ -24,6 +25,9 @@ import (
 	iopath "path"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"go.uber.org/zap"
 
 	"kubegems.io/modelx/pkg/config"
 )
@@ -38,7 +42,11 @@ func NewLocalFSProvider(options *config.LocalFSOptions) (*LocalFSProvider, error
 	if err := os.MkdirAll(options.Basepath, DefaultDirMode); err != nil {
 		return nil, err
 	}
-	return &LocalFSProvider{basepath: options.Basepath}, nil
+	f := &LocalFSProvider{basepath: options.Basepath}
+	if err := f.cleanTempFiles(); err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
 type localFileMeta struct {
@@ -46,11 +54,79 @@ type localFileMeta struct {
 	ContentLength int64  `json:"contentLength,omitempty"`
 }
 
+// Put writes the meta file first, then the data to a temporary file renamed into place.
+// An interrupted write never leaves data without its meta, a link read without its content type
+// would be served as the blob. A failed write restores the previous meta of the data it leaves in place,
+// it leaves a temporary file removed at startup, or a meta file ignored without its data.
 func (f *LocalFSProvider) Put(ctx context.Context, path string, content BlobContent) error {
+	datafile := iopath.Join(f.basepath, path)
+	if err := os.MkdirAll(iopath.Dir(datafile), DefaultDirMode); err != nil {
+		return err
+	}
+	previous, err := os.ReadFile(datafile + ".meta")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hadmeta := err == nil
 	if err := f.writemeta(path, content); err != nil {
 		return err
 	}
-	return f.writedata(path, content)
+	if err := renamefile(datafile, content.Content); err != nil {
+		if _, serr := os.Stat(datafile); os.IsNotExist(serr) || !hadmeta {
+			_ = os.Remove(datafile + ".meta")
+		} else {
+			_ = renamefile(datafile+".meta", bytes.NewReader(previous))
+		}
+		return err
+	}
+	return nil
+}
+
+// PutIf writes content while holding the lock of path.
+func (f *LocalFSProvider) PutIf(ctx context.Context, path string, content BlobContent, etag string) error {
+	unlock, err := lockFile(iopath.Join(f.basepath, path+".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := f.checkETag(path, etag); err != nil {
+		return err
+	}
+	return f.Put(ctx, path, content)
+}
+
+func (f *LocalFSProvider) RemoveIf(ctx context.Context, path string, etag string) error {
+	if etag == "" {
+		return ErrPreconditionFailed
+	}
+	unlock, err := lockFile(iopath.Join(f.basepath, path+".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := f.checkETag(path, etag); err != nil {
+		return err
+	}
+	return f.Remove(ctx, path, false)
+}
+
+func (f *LocalFSProvider) checkETag(path string, etag string) error {
+	fi, err := os.Stat(iopath.Join(f.basepath, path))
+	if os.IsNotExist(err) {
+		if etag == "" {
+			return nil
+		}
+		return ErrPreconditionFailed
+	}
+	if err != nil {
+		return err
+	}
+	if etag == "" || fileETag(fi) != etag {
+		return ErrPreconditionFailed
+	}
+	return nil
 }
 
 func (f *LocalFSProvider) Get(ctx context.Context, path string) (*BlobContent, error) {
@@ -63,12 +139,41 @@ func (f *LocalFSProvider) Get(ctx context.Context, path string) (*BlobContent, e
 		return nil, err
 	}
 	return &BlobContent{
-		ContentType: meta.ContentType,
+		ContentType:   meta.ContentType,
+		ContentLength: meta.ContentLength,
+		Content:       stream,
+	}, nil
+}
 
-		Content: stream,
+// GetRange reads length bytes from offset, a negative length reads to the end.
+func (f *LocalFSProvider) GetRange(ctx context.Context, path string, offset, length int64) (*BlobContent, error) {
+	meta, err := f.readmeta(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Open(iopath.Join(f.basepath, path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fi.Seek(offset, io.SeekStart); err != nil {
+		fi.Close()
+		return nil, err
+	}
+	if length < 0 || offset+length > meta.ContentLength {
+		length = max(meta.ContentLength-offset, 0)
+	}
+	return &BlobContent{
+		ContentType:   meta.ContentType,
+		ContentLength: length,
+		Content:       sectionReadCloser{Reader: io.LimitReader(fi, length), Closer: fi},
 	}, nil
 }
 
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func (f *LocalFSProvider) Copy(ctx context.Context, pathTo, pathFrom string) error {
 	blobcontnt, err := f.Get(ctx, pathFrom)
 	if err != nil {
@@ -82,7 +187,17 @@ func (f *LocalFSProvider) Remove(ctx context.Context, path string, recursive boo
 	if recursive {
 		return os.RemoveAll(iopath.Join(f.basepath, path))
 	}
-	return os.Remove(iopath.Join(f.basepath, path))
+	if err := os.Remove(iopath.Join(f.basepath, path)); err != nil {
+		if os.IsNotExist(err) {
+			// a meta file left by an interrupted write
+			_ = os.Remove(iopath.Join(f.basepath, path+".meta"))
+		}
+		return err
+	}
+	if err := os.Remove(iopath.Join(f.basepath, path+".meta")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func (f *LocalFSProvider) Exists(ctx context.Context, path string) (bool, error) {
@@ -101,12 +216,16 @@ func (f *LocalFSProvider) Stat(ctx context.Context, path string) (FsObjectMeta,
 	if err != nil {
 		return FsObjectMeta{}, err
 	}
-	meta, _ := f.readmeta(path)
+	contentType := ""
+	if meta, err := f.readmeta(path); err == nil {
+		contentType = meta.ContentType
+	}
 	return FsObjectMeta{
 		Name:         path,
 		Size:         fi.Size(),
 		LastModified: fi.ModTime(),
-		ContentType:  meta.ContentType,
+		ContentType:  contentType,
+		ETag:         fileETag(fi),
 	}, nil
 }
 
@@ -117,7 +236,7 @@ func (f *LocalFSProvider) List(ctx context.Context, path string, recursive bool)
 			if err != nil {
 				return err
 			}
-			if strings.HasSuffix(path, ".meta") {
+			if isInternalFile(path) {
 				return nil
 			}
 			if d.IsDir() {
@@ -144,7 +263,7 @@ func (f *LocalFSProvider) List(ctx context.Context, path string, recursive bool)
 			return nil, err
 		}
 		for _, fi := range files {
-			if strings.HasSuffix(fi.Name(), ".meta") {
+			if isInternalFile(fi.Name()) {
 				continue
 			}
 			if fi.IsDir() {
@@ -173,24 +292,80 @@ func (f *LocalFSProvider) writemeta(path string, content BlobContent) error {
 	if err != nil {
 		return err
 	}
-	metafile := iopath.Join(f.basepath, path+".meta")
-	if err := os.MkdirAll(iopath.Dir(metafile), DefaultDirMode); err != nil {
-		return err
-	}
-	return os.WriteFile(metafile, jsonData, DefaultFileMode)
+	return renamefile(iopath.Join(f.basepath, path+".meta"), bytes.NewReader(jsonData))
 }
 
-func (f *LocalFSProvider) writedata(path string, content BlobContent) error {
-	datafile := iopath.Join(f.basepath, path)
-	fi, err := os.OpenFile(datafile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, DefaultFileMode)
+// renamefile writes to a temporary file next to name, syncs it and renames it into place,
+// readers see either the old or the new content.
+func renamefile(name string, r io.Reader) error {
+	fi, err := os.CreateTemp(iopath.Dir(name), "."+iopath.Base(name)+LocalTempFileInfix+"*")
 	if err != nil {
 		return err
 	}
-	defer fi.Close()
-	_, err = io.Copy(fi, content.Content)
+	defer os.Remove(fi.Name())
+	if _, err := io.Copy(fi, r); err != nil {
+		fi.Close()
+		return err
+	}
+	if err := fi.Chmod(DefaultFileMode); err != nil {
+		fi.Close()
+		return err
+	}
+	if err := fi.Sync(); err != nil {
+		fi.Close()
+		return err
+	}
+	if err := fi.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(fi.Name(), name); err != nil {
+		return err
+	}
+	return syncDir(iopath.Dir(name))
+}
+
+// cleanTempFiles removes temporary files left by interrupted writes. A file still being written
+// is modified continuously, so only files untouched for LocalTempFileMaxAge are removed.
+func (f *LocalFSProvider) cleanTempFiles() error {
+	removed := 0
+	err := filepath.WalkDir(f.basepath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if time.Since(fi.ModTime()) < LocalTempFileMaxAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		registryLogger.Info("removed temporary files of interrupted writes", zap.Int("count", removed))
+	}
 	return err
 }
 
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, LocalTempFileInfix)
+}
+
+// isInternalFile reports the files kept next to objects which are not objects themselves.
+func isInternalFile(name string) bool {
+	return strings.HasSuffix(name, ".meta") || strings.HasSuffix(name, ".lock") || isTempFile(iopath.Base(name))
+}
+
 func (f *LocalFSProvider) getdata(path string) (io.ReadCloser, error) {
 	datafile := iopath.Join(f.basepath, path)
 	return os.Open(datafile)
@@ -204,14 +379,17 @@ func (f *LocalFSProvider) readmeta(path string) (*localFileMeta, error) {
 	if fi.IsDir() {
 		return nil, os.ErrNotExist
 	}
+	var meta localFileMeta
 	metafile := iopath.Join(f.basepath, path+".meta")
 	raw, err := os.ReadFile(metafile)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-	var meta localFileMeta
-	if err := json.Unmarshal(raw, &meta); err != nil {
-		return nil, err
+	// the meta is written before the data, it is only missing for data written without one.
+	if err == nil {
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, err
+		}
 	}
 	meta.ContentLength = fi.Size()
 	return &meta, nil
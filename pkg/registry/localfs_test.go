@@ -0,0 +1,84 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"kubegems.io/modelx/pkg/config"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestLocalFSPut(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	basepath := t.TempDir()
+	fs, err := NewLocalFSProvider(&config.LocalFSOptions{Basepath: basepath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := BlobContent{Content: io.NopCloser(strings.NewReader("sha256:abc")), ContentLength: 10, ContentType: MediaTypeBlobLink}
+	assert.NoError(fs.Put(ctx, "library/llama/blobs/sha256/abc", link))
+	meta, err := fs.Stat(ctx, "library/llama/blobs/sha256/abc")
+	assert.NoError(err)
+	assert.Equal(MediaTypeBlobLink, meta.ContentType)
+	assert.Equal(int64(10), meta.Size)
+
+	// a failed write leaves neither the data nor its meta
+	failed := BlobContent{Content: io.NopCloser(failingReader{}), ContentLength: 10, ContentType: MediaTypeBlobLink}
+	assert.Error(fs.Put(ctx, "library/llama/blobs/sha256/def", failed))
+	_, err = os.Stat(filepath.Join(basepath, "library/llama/blobs/sha256/def.meta"))
+	assert.True(os.IsNotExist(err))
+	exists, err := fs.Exists(ctx, "library/llama/blobs/sha256/def")
+	assert.NoError(err)
+	assert.False(exists)
+
+	// a failed overwrite keeps the object and its meta, even of another content type
+	assert.Error(fs.Put(ctx, "library/llama/blobs/sha256/abc", failed))
+	overwrite := BlobContent{Content: io.NopCloser(failingReader{}), ContentLength: 7, ContentType: "application/octet-stream"}
+	assert.Error(fs.Put(ctx, "library/llama/blobs/sha256/abc", overwrite))
+	meta, err = fs.Stat(ctx, "library/llama/blobs/sha256/abc")
+	assert.NoError(err)
+	assert.Equal(MediaTypeBlobLink, meta.ContentType)
+	assert.Equal(int64(10), meta.Size)
+
+	// data written without a meta stays without one
+	assert.NoError(os.WriteFile(filepath.Join(basepath, "library/llama/blobs/sha256/ghi"), []byte("weights"), DefaultFileMode))
+	assert.Error(fs.Put(ctx, "library/llama/blobs/sha256/ghi", failed))
+	_, err = os.Stat(filepath.Join(basepath, "library/llama/blobs/sha256/ghi.meta"))
+	assert.True(os.IsNotExist(err))
+
+	// a meta left by an interrupted write is removed with the object
+	assert.NoError(os.WriteFile(filepath.Join(basepath, "library/llama/blobs/sha256/def.meta"), []byte("{}"), DefaultFileMode))
+	assert.Error(fs.Remove(ctx, "library/llama/blobs/sha256/def", false))
+	_, err = os.Stat(filepath.Join(basepath, "library/llama/blobs/sha256/def.meta"))
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on name, it also serializes writers in other processes sharing the basepath.
+func lockFile(name string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(name), DefaultDirMode); err != nil {
+		return nil, err
+	}
+	fi, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, DefaultFileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(fi.Fd()), syscall.LOCK_EX); err != nil {
+		fi.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(fi.Fd()), syscall.LOCK_UN)
+		_ = fi.Close()
+	}, nil
+}
+
+// fileETag changes whenever the file is replaced or rewritten.
+func fileETag(fi os.FileInfo) string {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%x-%x-%x", st.Ino, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// syncDir persists a rename in the directory.
+func syncDir(dir string) error {
+	fi, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	return fi.Sync()
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"go.uber.org/zap"
+
+	"kubegems.io/modelx/pkg/client"
+	"kubegems.io/modelx/pkg/config"
+	errors "kubegems.io/modelx/pkg/response"
+	"kubegems.io/modelx/pkg/util"
+)
+
+var errProxyReadIncomplete = stderrors.New("upstream blob was not read to the end")
+
+// ProxyStore is a pull-through cache of an upstream modelxd.
+// Manifests and blobs missing in the store it wraps are fetched from the upstream, served and stored at the same time.
+// Cached manifests are fetched again after ManifestTTL so moving tags like latest refresh,
+// blobs are addressed by digest and never expire. Writes only go to the wrapped store.
+// The fetched manifests and blobs are written to Cache, the store under the events and the quotas,
+// so caching does not publish pushes, replicate or count against the quotas.
+type ProxyStore struct {
+	RegistryInterface
+	Cache       RegistryInterface
+	Upstream    *client.RegistryClient
+	ManifestTTL time.Duration
+
+	// filling holds the digests being cached in the background
+	filling sync.Map
+}
+
+var _ RegistryInterface = &ProxyStore{}
+
+func NewProxyStore(store RegistryInterface, cache RegistryInterface, upstream *client.RegistryClient, manifestTTL time.Duration) *ProxyStore {
+	return &ProxyStore{RegistryInterface: store, Cache: cache, Upstream: upstream, ManifestTTL: manifestTTL}
+}
+
+// GetGlobalIndex lists the upstream repositories, the cached ones are listed if the upstream is unreachable.
+func (s *ProxyStore) GetGlobalIndex(ctx context.Context, search string) (util.Index, error) {
+	index, err := s.Upstream.GetGlobalIndex(ctx, search)
+	if err != nil {
+		registryLogger.Warn("get upstream global index, list the cached one", zap.Error(err))
+		return s.RegistryInterface.GetGlobalIndex(ctx, search)
+	}
+	return *index, nil
+}
+
+// GetIndex lists the upstream versions, the cached ones are listed if the upstream is unreachable.
+func (s *ProxyStore) GetIndex(ctx context.Context, repository string, search string) (util.Index, error) {
+	index, err := s.Upstream.GetIndex(ctx, repository, search)
+	if err != nil {
+		registryLogger.Warn("get upstream index, list the cached one", zap.Any("repository", repository), zap.Error(err))
+		return s.RegistryInterface.GetIndex(ctx, repository, search)
+	}
+	return *index, nil
+}
+
+func (s *ProxyStore) ExistsManifest(ctx context.Context, repository string, reference string) (bool, error) {
+	if s.manifestFresh(ctx, repository, reference) {
+		return true, nil
+	}
+	if _, err := s.GetManifest(ctx, repository, reference); err != nil {
+		if errors.IsErrCode(err, errors.ErrCodeManifestUnknown) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// GetManifest serves the cached manifest while it is younger than ManifestTTL, or fetches and caches the upstream one.
+// A stale manifest is still served when the upstream is unreachable.
+func (s *ProxyStore) GetManifest(ctx context.Context, repository string, reference string) (*util.Manifest, error) {
+	if s.manifestFresh(ctx, repository, reference) {
+		return s.RegistryInterface.GetManifest(ctx, repository, reference)
+	}
+	manifest, err := s.Upstream.GetManifest(ctx, repository, reference)
+	if err != nil {
+		if isRemoteNotFound(err) {
+			return nil, errors.NewManifestUnknownError(reference)
+		}
+		if cached, cerr := s.RegistryInterface.GetManifest(ctx, repository, reference); cerr == nil {
+			registryLogger.Warn("get upstream manifest, serve the stale one", zap.Any("repository", repository), zap.Any("reference", reference), zap.Error(err))
+			return cached, nil
+		}
+		return nil, errors.NewInternalError(err)
+	}
+	contentType := manifest.MediaType
+	if contentType == "" {
+		contentType = client.MediaTypeModelManifestJson
+	}
+	// the blobs are cached when they are pulled
+	if err := s.Cache.PutManifest(WithoutManifestBlobCheck(ctx), repository, reference, contentType, *manifest); err != nil {
+		registryLogger.Error("cache upstream manifest", zap.Any("repository", repository), zap.Any("reference", reference), zap.Error(err))
+	}
+	return manifest, nil
+}
+
+// manifestFresh reports whether the manifest is cached and younger than ManifestTTL.
+func (s *ProxyStore) manifestFresh(ctx context.Context, repository string, reference string) bool {
+	index, err := s.RegistryInterface.GetIndex(ctx, repository, "")
+	if err != nil {
+		return false
+	}
+	for _, version := range index.Manifests {
+		if version.Name == reference {
+			return time.Since(version.Modified) < s.ManifestTTL
+		}
+	}
+	return false
+}
+
+func (s *ProxyStore) ExistsBlob(ctx context.Context, repository string, digest digest.Digest) (bool, error) {
+	if exists, err := s.RegistryInterface.ExistsBlob(ctx, repository, digest); err != nil || exists {
+		return exists, err
+	}
+	if _, err := s.Upstream.StatBlob(ctx, repository, digest); err != nil {
+		if isRemoteNotFound(err) {
+			return false, nil
+		}
+		return false, errors.NewInternalError(err)
+	}
+	return true, nil
+}
+
+func (s *ProxyStore) GetBlobMeta(ctx context.Context, repository string, digest digest.Digest) (BlobMeta, error) {
+	cached, err := s.cached(ctx, repository, digest)
+	if err != nil {
+		return BlobMeta{}, err
+	}
+	if cached {
+		return s.RegistryInterface.GetBlobMeta(ctx, repository, digest)
+	}
+	size, err := s.Upstream.StatBlob(ctx, repository, digest)
+	if err != nil {
+		if isRemoteNotFound(err) {
+			return BlobMeta{}, errors.NewBlobUnknownError(digest)
+		}
+		return BlobMeta{}, errors.NewInternalError(err)
+	}
+	return BlobMeta{ContentType: "application/octet-stream", ContentLength: size}, nil
+}
+
+// GetBlob serves the cached blob, or streams the upstream one while caching it.
+func (s *ProxyStore) GetBlob(ctx context.Context, repository string, digest digest.Digest) (*BlobContent, error) {
+	cached, err := s.cached(ctx, repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		return s.RegistryInterface.GetBlob(ctx, repository, digest)
+	}
+	return s.fetchBlob(ctx, repository, digest)
+}
+
+// GetBlobRange serves the range of the cached blob, or of the upstream one while the whole blob is cached in the background.
+func (s *ProxyStore) GetBlobRange(ctx context.Context, repository string, digest digest.Digest, offset, length int64) (*BlobContent, error) {
+	cached, err := s.cached(ctx, repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		return s.RegistryInterface.GetBlobRange(ctx, repository, digest, offset, length)
+	}
+	content, err := s.Upstream.GetBlobRangeReader(ctx, repository, digest, offset, length)
+	if err != nil {
+		if isRemoteNotFound(err) {
+			return nil, errors.NewBlobUnknownError(digest)
+		}
+		return nil, errors.NewInternalError(err)
+	}
+	s.fillBlob(repository, digest)
+	return &BlobContent{Content: content, ContentLength: length, ContentType: "application/octet-stream"}, nil
+}
+
+// GetBlobLocation makes the clients download a blob that is not cached yet through the proxy.
+func (s *ProxyStore) GetBlobLocation(ctx context.Context, repository string, digest digest.Digest,
+	purpose string, properties map[string]string,
+) (*BlobLocation, error) {
+	if purpose == BlobLocationPurposeDownload {
+		cached, err := s.cached(ctx, repository, digest)
+		if err != nil {
+			return nil, err
+		}
+		if !cached {
+			return nil, errors.NewUnsupportedError("blob is not cached yet, download it through the proxy")
+		}
+	}
+	return s.RegistryInterface.GetBlobLocation(ctx, repository, digest, purpose, properties)
+}
+
+func (s *ProxyStore) cached(ctx context.Context, repository string, digest digest.Digest) (bool, error) {
+	return s.RegistryInterface.ExistsBlob(ctx, repository, digest)
+}
+
+// fetchBlob streams the upstream blob, it is stored in the wrapped store once the caller has read it to the end.
+// The store verifies the digest, a blob read partially or with a wrong digest is not kept.
+func (s *ProxyStore) fetchBlob(ctx context.Context, repository string, digest digest.Digest) (*BlobContent, error) {
+	upstream, size, err := s.Upstream.GetBlobReader(ctx, repository, digest)
+	if err != nil {
+		if isRemoteNotFound(err) {
+			return nil, errors.NewBlobUnknownError(digest)
+		}
+		return nil, errors.NewInternalError(err)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		content := BlobContent{Content: pr, ContentLength: size, ContentType: "application/octet-stream"}
+		// the caller may be done before the store is
+		err := s.Cache.PutBlob(context.WithoutCancel(ctx), repository, digest, content)
+		if err != nil {
+			registryLogger.Warn("cache upstream blob", zap.Any("repository", repository), zap.Any("digest", digest.String()), zap.Error(err))
+		}
+		// unblock the writes if the store stopped early
+		pr.CloseWithError(err)
+	}()
+	reader := &proxyBlobReader{upstream: upstream, cache: pw, done: done}
+	return &BlobContent{Content: reader, ContentLength: size, ContentType: "application/octet-stream"}, nil
+}
+
+// fillBlob caches the upstream blob in the background, once at a time per digest.
+func (s *ProxyStore) fillBlob(repository string, digest digest.Digest) {
+	if _, loaded := s.filling.LoadOrStore(digest, struct{}{}); loaded {
+		return
+	}
+	go func() {
+		defer s.filling.Delete(digest)
+		content, err := s.fetchBlob(context.Background(), repository, digest)
+		if err != nil {
+			registryLogger.Warn("fetch upstream blob", zap.Any("repository", repository), zap.Any("digest", digest.String()), zap.Error(err))
+			return
+		}
+		_, _ = io.Copy(io.Discard, content.Content)
+		_ = content.Close()
+	}()
+}
+
+// GCGlobalBlobs forwards to the wrapped store, which may have a global blob pool.
+func (s *ProxyStore) GCGlobalBlobs(ctx context.Context, options GCOptions) ([]GCBlob, error) {
+	if collector, ok := s.RegistryInterface.(GlobalBlobCollector); ok {
+		return collector.GCGlobalBlobs(ctx, options)
+	}
+	return []GCBlob{}, nil
+}
+
+// GCUploads forwards to the wrapped store, which may expire the abandoned upload sessions.
+func (s *ProxyStore) GCUploads(ctx context.Context, repository string, options GCOptions) ([]GCUpload, error) {
+	if collector, ok := s.RegistryInterface.(UploadCollector); ok {
+		return collector.GCUploads(ctx, repository, options)
+	}
+	return []GCUpload{}, nil
+}
+
+// LockGC forwards to the wrapped store, which may hold a lock shared by the replicas.
+func (s *ProxyStore) LockGC(ctx context.Context, ttl time.Duration) (context.Context, func(), error) {
+	if locker, ok := s.RegistryInterface.(GCLocker); ok {
+		return locker.LockGC(ctx, ttl)
+	}
+	return ctx, func() {}, nil
+}
+
+// ListRepositories forwards to the wrapped store, which may list the repositories without an index.
+func (s *ProxyStore) ListRepositories(ctx context.Context) ([]string, error) {
+	return listRepositories(ctx, s.RegistryInterface)
+}
+
+// ListManifests forwards to the wrapped store, which may list the manifests missing in the index.
+func (s *ProxyStore) ListManifests(ctx context.Context, repository string) ([]string, error) {
+	return listManifests(ctx, s.RegistryInterface, repository)
+}
+
+// StoredBytes forwards to the wrapped store, which may count the blobs no version references and the upload sessions.
+func (s *ProxyStore) StoredBytes(ctx context.Context, name string) (int64, error) {
+	return storedBytes(ctx, s.RegistryInterface, name)
+}
+
+// ProjectQuota forwards to the wrapped store, which may enforce quotas.
+func (s *ProxyStore) ProjectQuota(project string) (config.Quota, bool) {
+	if limiter, ok := s.RegistryInterface.(QuotaLimiter); ok {
+		return limiter.ProjectQuota(project)
+	}
+	return config.Quota{}, false
+}
+
+// RepositoryQuota forwards to the wrapped store, which may enforce quotas.
+func (s *ProxyStore) RepositoryQuota(repository string) (config.Quota, bool) {
+	if limiter, ok := s.RegistryInterface.(QuotaLimiter); ok {
+		return limiter.RepositoryQuota(repository)
+	}
+	return config.Quota{}, false
+}
+
+func isRemoteNotFound(err error) bool {
+	info := errors.ErrorInfo{}
+	return stderrors.As(err, &info) && info.HttpStatus == http.StatusNotFound
+}
+
+// proxyBlobReader passes the upstream blob to the caller and to the cache,
+// the cache is dropped if it fails so the caller is still served.
+type proxyBlobReader struct {
+	upstream io.ReadCloser
+	cache    *io.PipeWriter
+	done     chan struct{}
+	eof      bool
+}
+
+func (r *proxyBlobReader) Read(p []byte) (int, error) {
+	n, err := r.upstream.Read(p)
+	if n > 0 && r.cache != nil {
+		if _, werr := r.cache.Write(p[:n]); werr != nil {
+			r.cache = nil
+		}
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close completes the cache if the blob was read to the end and waits for it to be stored.
+func (r *proxyBlobReader) Close() error {
+	if r.cache != nil {
+		if r.eof {
+			_ = r.cache.Close()
+		} else {
+			_ = r.cache.CloseWithError(errProxyReadIncomplete)
+		}
+	}
+	<-r.done
+	return r.upstream.Close()
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	"kubegems.io/modelx/pkg/config"
+	errors "kubegems.io/modelx/pkg/response"
+	"kubegems.io/modelx/pkg/util"
+)
+
+// QuotaStore enforces the byte and version quotas of projects and repositories before writing to the store it wraps.
+// Bytes are the blobs stored, referenced by a version or not, and the open upload sessions; versions are counted in the indexes.
+// Usage is checked before each write, so concurrent pushes may exceed a quota by what they are writing at the same time.
+type QuotaStore struct {
+	RegistryInterface
+	Quotas *config.QuotaConfig
+}
+
+var _ RegistryInterface = &QuotaStore{}
+
+func NewQuotaStore(store RegistryInterface, quotas *config.QuotaConfig) *QuotaStore {
+	return &QuotaStore{RegistryInterface: store, Quotas: quotas}
+}
+
+// QuotaLimiter is implemented by stores which enforce the quotas of projects and repositories.
+type QuotaLimiter interface {
+	ProjectQuota(project string) (config.Quota, bool)
+	RepositoryQuota(repository string) (config.Quota, bool)
+}
+
+// ProjectQuota returns the quota of the project, ok is false if it is not limited.
+func (s *QuotaStore) ProjectQuota(project string) (config.Quota, bool) {
+	return s.Quotas.ProjectQuota(project)
+}
+
+// RepositoryQuota returns the quota of the repository, ok is false if it is not limited.
+func (s *QuotaStore) RepositoryQuota(repository string) (config.Quota, bool) {
+	return s.Quotas.RepositoryQuota(repository)
+}
+
+// StoredBytesCounter is implemented by stores which can count the bytes stored under a project or a repository,
+// the blobs no version references and the open upload sessions included.
+type StoredBytesCounter interface {
+	StoredBytes(ctx context.Context, name string) (int64, error)
+}
+
+// QuotaUsage is the usage of a project or a repository, the limits are zero if it has no quota.
+type QuotaUsage struct {
+	Name        string `json:"name"`
+	Bytes       int64  `json:"bytes"`
+	Versions    int    `json:"versions"`
+	MaxBytes    int64  `json:"maxBytes,omitempty"`
+	MaxVersions int    `json:"maxVersions,omitempty"`
+}
+
+// GetRepositoryUsage returns the usage of the repository, with its quota if store enforces quotas.
+func GetRepositoryUsage(ctx context.Context, store RegistryInterface, repository string) (QuotaUsage, error) {
+	usage, err := repositoryUsage(ctx, store, repository)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	if limiter, ok := store.(QuotaLimiter); ok {
+		quota, _ := limiter.RepositoryQuota(repository)
+		usage.MaxBytes, usage.MaxVersions = int64(quota.MaxBytes), quota.MaxVersions
+	}
+	return usage, nil
+}
+
+// GetProjectUsage returns the usage of the project, with its quota if store enforces quotas.
+func GetProjectUsage(ctx context.Context, store RegistryInterface, project string) (QuotaUsage, error) {
+	usage, err := projectUsage(ctx, store, project)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	if limiter, ok := store.(QuotaLimiter); ok {
+		quota, _ := limiter.ProjectQuota(project)
+		usage.MaxBytes, usage.MaxVersions = int64(quota.MaxBytes), quota.MaxVersions
+	}
+	return usage, nil
+}
+
+func repositoryUsage(ctx context.Context, store RegistryInterface, repository string) (QuotaUsage, error) {
+	usage := QuotaUsage{Name: repository}
+	index, err := store.GetIndex(ctx, repository, "")
+	if err != nil && !IsRegistryStoreNotNotFound(err) {
+		return QuotaUsage{}, err
+	}
+	usage.Versions = len(index.Manifests)
+	if usage.Bytes, err = storedBytes(ctx, store, repository); err != nil {
+		return QuotaUsage{}, err
+	}
+	return usage, nil
+}
+
+func projectUsage(ctx context.Context, store RegistryInterface, project string) (QuotaUsage, error) {
+	usage := QuotaUsage{Name: project}
+	globalindex, err := store.GetGlobalIndex(ctx, "")
+	if err != nil && !IsRegistryStoreNotNotFound(err) {
+		return QuotaUsage{}, err
+	}
+	for _, repository := range globalindex.Manifests {
+		if !strings.HasPrefix(repository.Name, project+"/") {
+			continue
+		}
+		index, err := store.GetIndex(ctx, repository.Name, "")
+		if err != nil {
+			if IsRegistryStoreNotNotFound(err) {
+				continue
+			}
+			return QuotaUsage{}, err
+		}
+		usage.Versions += len(index.Manifests)
+	}
+	if usage.Bytes, err = storedBytes(ctx, store, project); err != nil {
+		return QuotaUsage{}, err
+	}
+	return usage, nil
+}
+
+// storedBytes counts the bytes stored under the project or repository name, a store which can not count them
+// is counted by the blobs of the repositories in its global index, without its upload sessions.
+func storedBytes(ctx context.Context, store RegistryInterface, name string) (int64, error) {
+	if counter, ok := store.(StoredBytesCounter); ok {
+		return counter.StoredBytes(ctx, name)
+	}
+	repositories := []string{name}
+	if !strings.Contains(name, "/") {
+		globalindex, err := store.GetGlobalIndex(ctx, "")
+		if err != nil && !IsRegistryStoreNotNotFound(err) {
+			return 0, err
+		}
+		repositories = []string{}
+		for _, repository := range globalindex.Manifests {
+			if strings.HasPrefix(repository.Name, name+"/") {
+				repositories = append(repositories, repository.Name)
+			}
+		}
+	}
+	var bytes int64
+	for _, repository := range repositories {
+		blobs, err := store.ListBlobs(ctx, repository)
+		if err != nil {
+			if IsRegistryStoreNotNotFound(err) {
+				continue
+			}
+			return 0, err
+		}
+		for _, blob := range blobs {
+			meta, err := store.GetBlobMeta(ctx, repository, blob)
+			if err != nil {
+				return 0, err
+			}
+			bytes += meta.ContentLength
+		}
+	}
+	return bytes, nil
+}
+
+// checkQuota fails with DENIED if adding bytes and versions exceeds the quota of the project or of the repository.
+// A negative bytes is a shrink and always allowed.
+func (s *QuotaStore) checkQuota(ctx context.Context, repository string, bytes int64, versions int) error {
+	project, _, _ := strings.Cut(repository, "/")
+	if quota, ok := s.ProjectQuota(project); ok {
+		usage, err := projectUsage(ctx, s.RegistryInterface, project)
+		if err != nil {
+			return errors.NewInternalError(err)
+		}
+		if err := exceedsQuota("project "+project, usage, quota, bytes, versions); err != nil {
+			return err
+		}
+	}
+	if quota, ok := s.RepositoryQuota(repository); ok {
+		usage, err := repositoryUsage(ctx, s.RegistryInterface, repository)
+		if err != nil {
+			return errors.NewInternalError(err)
+		}
+		if err := exceedsQuota("repository "+repository, usage, quota, bytes, versions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exceedsQuota(name string, usage QuotaUsage, quota config.Quota, bytes int64, versions int) error {
+	if quota.MaxBytes > 0 && bytes >= 0 && usage.Bytes+bytes > int64(quota.MaxBytes) {
+		return errors.NewDeniedError(fmt.Sprintf("quota exceeded: %s uses %d of %d bytes, %d more bytes requested",
+			name, usage.Bytes, quota.MaxBytes, bytes))
+	}
+	if quota.MaxVersions > 0 && versions > 0 && usage.Versions+versions > quota.MaxVersions {
+		return errors.NewDeniedError(fmt.Sprintf("quota exceeded: %s has %d of %d versions",
+			name, usage.Versions, quota.MaxVersions))
+	}
+	return nil
+}
+
+func (s *QuotaStore) PutManifest(ctx context.Context, repository string, reference string, contentType string, manifest util.Manifest) error {
+	// the blobs of the version are stored and counted already, overwriting a version adds none
+	versions := 1
+	if index, err := s.RegistryInterface.GetIndex(ctx, repository, ""); err == nil {
+		for _, version := range index.Manifests {
+			if version.Name == reference {
+				versions = 0
+				break
+			}
+		}
+	}
+	if err := s.checkQuota(ctx, repository, 0, versions); err != nil {
+		return err
+	}
+	return s.RegistryInterface.PutManifest(ctx, repository, reference, contentType, manifest)
+}
+
+func (s *QuotaStore) PutBlob(ctx context.Context, repository string, digest digest.Digest, content BlobContent) error {
+	if err := s.checkQuota(ctx, repository, max(content.ContentLength, 0), 0); err != nil {
+		return err
+	}
+	return s.RegistryInterface.PutBlob(ctx, repository, digest, content)
+}
+
+// PutUploadChunk only counts the chunk, the chunks received before are counted in the upload session.
+func (s *QuotaStore) PutUploadChunk(ctx context.Context, repository string, id string, offset int64, content BlobContent) (*UploadStatus, error) {
+	if err := s.checkQuota(ctx, repository, max(content.ContentLength, 0), 0); err != nil {
+		return nil, err
+	}
+	return s.RegistryInterface.PutUploadChunk(ctx, repository, id, offset, content)
+}
+
+func (s *QuotaStore) GetBlobLocation(ctx context.Context, repository string, digest digest.Digest,
+	purpose string, properties map[string]string,
+) (*BlobLocation, error) {
+	if purpose == BlobLocationPurposeUpload {
+		size, _ := strconv.ParseInt(properties["size"], 10, 64)
+		if err := s.checkQuota(ctx, repository, max(size, 0), 0); err != nil {
+			return nil, err
+		}
+	}
+	return s.RegistryInterface.GetBlobLocation(ctx, repository, digest, purpose, properties)
+}
+
+// GCGlobalBlobs forwards to the wrapped store, which may have a global blob pool.
+func (s *QuotaStore) GCGlobalBlobs(ctx context.Context, options GCOptions) ([]GCBlob, error) {
+	if collector, ok := s.RegistryInterface.(GlobalBlobCollector); ok {
+		return collector.GCGlobalBlobs(ctx, options)
+	}
+	return []GCBlob{}, nil
+}
+
+// GCUploads forwards to the wrapped store, which may expire the abandoned upload sessions.
+func (s *QuotaStore) GCUploads(ctx context.Context, repository string, options GCOptions) ([]GCUpload, error) {
+	if collector, ok := s.RegistryInterface.(UploadCollector); ok {
+		return collector.GCUploads(ctx, repository, options)
+	}
+	return []GCUpload{}, nil
+}
+
+// LockGC forwards to the wrapped store, which may hold a lock shared by the replicas.
+func (s *QuotaStore) LockGC(ctx context.Context, ttl time.Duration) (context.Context, func(), error) {
+	if locker, ok := s.RegistryInterface.(GCLocker); ok {
+		return locker.LockGC(ctx, ttl)
+	}
+	return ctx, func() {}, nil
+}
+
+// ListRepositories forwards to the wrapped store, which may list the repositories without an index.
+func (s *QuotaStore) ListRepositories(ctx context.Context) ([]string, error) {
+	return listRepositories(ctx, s.RegistryInterface)
+}
+
+// ListManifests forwards to the wrapped store, which may list the manifests missing in the index.
+func (s *QuotaStore) ListManifests(ctx context.Context, repository string) ([]string, error) {
+	return listManifests(ctx, s.RegistryInterface, repository)
+}
+
+// StoredBytes forwards to the wrapped store, which may count the blobs no version references and the upload sessions.
+func (s *QuotaStore) StoredBytes(ctx context.Context, name string) (int64, error) {
+	return storedBytes(ctx, s.RegistryInterface, name)
+}
+
+// StoredBytes counts the blobs and the upload chunks stored under the project or repository name,
+// a blob linked to the global pool counts the size of its content.
+func (m *FSRegistryStore) StoredBytes(ctx context.Context, name string) (int64, error) {
+	metas, err := m.FS.List(ctx, name, true)
+	if err != nil {
+		if os.IsNotExist(err) || IsS3StorageNotFound(err) {
+			return 0, nil
+		}
+		return 0, errors.NewInternalError(err)
+	}
+	var bytes int64
+	for _, meta := range metas {
+		// .../blobs/<algorithm>/<encoded>, .../uploads/<id>/{startedat,<offset>}
+		switch path.Base(path.Dir(path.Dir(meta.Name))) {
+		case "blobs":
+			d, ok := parseBlobDigestPath(meta.Name)
+			if !ok {
+				continue
+			}
+			size := meta.Size
+			if m.GlobalBlobs {
+				global, err := m.FS.Stat(ctx, GlobalBlobDigestPath(d))
+				if err != nil && !os.IsNotExist(err) && !IsS3StorageNotFound(err) {
+					return 0, errors.NewInternalError(err)
+				}
+				// blobs stored before the pool was enabled are not linked
+				if err == nil {
+					size = global.Size
+				}
+			}
+			bytes += size
+		case "uploads":
+			if path.Base(meta.Name) != UploadStartedAtFileName {
+				bytes += meta.Size
+			}
+		}
+	}
+	return bytes, nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/stretchr/testify/assert"
+
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/event"
+	errors "kubegems.io/modelx/pkg/response"
+)
+
+func TestUsageThroughWrappers(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	fs := newTestStore(t, false)
+
+	blob := putTestBlob(t, fs, "library/llama", "weights")
+	assert.NoError(fs.PutManifest(ctx, "library/llama", "v1", "", testManifest(blob)))
+
+	quotas := &config.QuotaConfig{
+		Projects:     map[string]config.Quota{"library": {MaxBytes: 1024}},
+		Repositories: map[string]config.Quota{"library/llama": {MaxVersions: 3}},
+	}
+	store := NewEventStore(NewQuotaStore(fs, quotas), event.NewBus())
+
+	usage, err := GetRepositoryUsage(ctx, store, "library/llama")
+	assert.NoError(err)
+	assert.Equal(QuotaUsage{Name: "library/llama", Bytes: blob.Size, Versions: 1, MaxVersions: 3}, usage)
+
+	usage, err = GetProjectUsage(ctx, store, "library")
+	assert.NoError(err)
+	assert.Equal(QuotaUsage{Name: "library", Bytes: blob.Size, Versions: 1, MaxBytes: 1024}, usage)
+
+	usage, err = GetProjectUsage(ctx, NewEventStore(fs, event.NewBus()), "library")
+	assert.NoError(err)
+	assert.Equal(QuotaUsage{Name: "library", Bytes: blob.Size, Versions: 1}, usage)
+}
+
+func TestUsageCountsStoredBytes(t *testing.T) {
+	for _, globalBlobs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("globalBlobs=%t", globalBlobs), func(t *testing.T) {
+			assert := assert.New(t)
+			ctx := context.Background()
+			fs := newTestStore(t, globalBlobs)
+
+			// a blob no version references and an upload never committed
+			putTestBlob(t, fs, "library/llama", "weights")
+			_, err := fs.ResumeUpload(ctx, "library/qwen", "open")
+			assert.NoError(err)
+			_, err = fs.PutUploadChunk(ctx, "library/qwen", "open", 0, BlobContent{
+				Content:       io.NopCloser(strings.NewReader("chunk")),
+				ContentLength: 5,
+			})
+			assert.NoError(err)
+
+			store := NewQuotaStore(fs, &config.QuotaConfig{Projects: map[string]config.Quota{"library": {MaxBytes: 16}}})
+			usage, err := GetRepositoryUsage(ctx, store, "library/llama")
+			assert.NoError(err)
+			assert.Equal(int64(7), usage.Bytes)
+			usage, err = GetProjectUsage(ctx, store, "library")
+			assert.NoError(err)
+			assert.Equal(QuotaUsage{Name: "library", Bytes: 12, MaxBytes: 16}, usage)
+
+			data := []byte("more weights")
+			err = store.PutBlob(ctx, "library/llama", digest.FromBytes(data), BlobContent{
+				Content:       io.NopCloser(bytes.NewReader(data)),
+				ContentLength: int64(len(data)),
+			})
+			assert.True(errors.IsErrCode(err, errors.ErrCodeDenied), err)
+			_, err = store.PutUploadChunk(ctx, "library/qwen", "open", 5, BlobContent{
+				Content:       io.NopCloser(strings.NewReader("four")),
+				ContentLength: 4,
+			})
+			assert.NoError(err)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// ReadinessProbeDir holds the objects written by the storage write checks,
+// repository names never start with "_" so it can not collide with one.
+const ReadinessProbeDir = "_readyz"
+
+// StorageStatCheck stats the global index, a registry nothing was pushed to yet has none.
+func StorageStatCheck(fs FSProvider) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if _, err := fs.Stat(ctx, IndexPath("")); err != nil && !IsS3StorageNotFound(err) && !os.IsNotExist(err) {
+			return fmt.Errorf("stat global index: %w", err)
+		}
+		return nil
+	}
+}
+
+// StorageWriteCheck writes a probe object then removes it. Each server sharing the storage
+// must use its own name, such as its hostname, as their checks may run at the same time.
+func StorageWriteCheck(fs FSProvider, name string) func(ctx context.Context) error {
+	probepath := path.Join(ReadinessProbeDir, name)
+	return func(ctx context.Context) error {
+		content := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+		probe := BlobContent{
+			Content:       io.NopCloser(bytes.NewReader(content)),
+			ContentLength: int64(len(content)),
+			ContentType:   "text/plain",
+		}
+		if err := fs.Put(ctx, probepath, probe); err != nil {
+			return fmt.Errorf("write probe object: %w", err)
+		}
+		if err := fs.Remove(ctx, probepath, false); err != nil {
+			return fmt.Errorf("remove probe object: %w", err)
+		}
+		return nil
+	}
+}
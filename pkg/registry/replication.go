@@ -0,0 +1,426 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"go.uber.org/zap"
+
+	"kubegems.io/modelx/pkg/audit"
+	"kubegems.io/modelx/pkg/client"
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/event"
+	errors "kubegems.io/modelx/pkg/response"
+	"kubegems.io/modelx/pkg/util"
+)
+
+// ReplicationStatus is the state of a replication rule since modelxd started.
+type ReplicationStatus struct {
+	Name       string `json:"name"`
+	Repository string `json:"repository"`
+	Target     string `json:"target"`
+	Trigger    string `json:"trigger"`
+	Deletion   bool   `json:"deletion"`
+	// Pending is the number of queued events.
+	Pending          int       `json:"pending"`
+	Replicated       int       `json:"replicated"`
+	Deleted          int       `json:"deleted"`
+	Failed           int       `json:"failed"`
+	LastReplicatedAt time.Time `json:"lastReplicatedAt"`
+	LastSyncAt       time.Time `json:"lastSyncAt"`
+	LastError        string    `json:"lastError,omitempty"`
+	LastErrorAt      time.Time `json:"lastErrorAt"`
+}
+
+type replicationTask struct {
+	repository string
+	// reference is empty when the whole repository is deleted
+	reference string
+	delete    bool
+}
+
+type replication struct {
+	rule   config.ReplicationRule
+	target *client.Client
+	queue  chan replicationTask
+	status ReplicationStatus
+}
+
+// Replicator copies the versions of the store to other registries by the replication rules.
+// Event rules replicate the versions queued by Notify or HandleEvent, scheduled rules sync the matching repositories every interval.
+// Blobs the target already has are skipped, failures are retried with backoff.
+type Replicator struct {
+	Store RegistryInterface
+	Rules []config.ReplicationRule
+
+	mu           sync.Mutex
+	replications []*replication
+}
+
+func NewReplicator(store RegistryInterface, rules []config.ReplicationRule) *Replicator {
+	replicator := &Replicator{Store: store, Rules: rules}
+	for _, rule := range rules {
+		replicator.replications = append(replicator.replications, &replication{
+			rule:   rule,
+			target: client.NewClient(rule.Target, client.Authorization(rule.Token, rule.Username, rule.Password)),
+			queue:  make(chan replicationTask, ReplicationQueueSize),
+			status: ReplicationStatus{
+				Name:       rule.Name,
+				Repository: rule.Repository,
+				Target:     rule.Target,
+				Trigger:    rule.Trigger,
+				Deletion:   rule.Deletion,
+			},
+		})
+	}
+	return replicator
+}
+
+func (r *Replicator) Run(ctx context.Context) error {
+	registryLogger.Info("start replication", zap.Int("rules", len(r.replications)))
+	wg := sync.WaitGroup{}
+	for _, rep := range r.replications {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.runReplication(ctx, rep)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// Status returns the state of every replication rule.
+func (r *Replicator) Status() []ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]ReplicationStatus, 0, len(r.replications))
+	for _, rep := range r.replications {
+		statuses = append(statuses, rep.status)
+	}
+	return statuses
+}
+
+// Notify queues a pushed or deleted version to the event rules matching the repository,
+// an empty reference is the deletion of the whole repository.
+func (r *Replicator) Notify(repository, reference string, deleted bool) {
+	task := replicationTask{repository: repository, reference: reference, delete: deleted}
+	for _, rep := range r.replications {
+		if rep.rule.Trigger != config.ReplicationTriggerEvent || (deleted && !rep.rule.Deletion) {
+			continue
+		}
+		if ok, _ := path.Match(rep.rule.Repository, repository); !ok {
+			continue
+		}
+		select {
+		case rep.queue <- task:
+			r.update(rep, func(status *ReplicationStatus) { status.Pending++ })
+		default:
+			registryLogger.Warn("replication queue is full, drop the event", zap.String("rule", rep.rule.Name),
+				zap.String("repository", repository), zap.String("reference", reference))
+			r.record(rep, task, fmt.Errorf("replication queue is full"))
+		}
+	}
+}
+
+// HandleEvent queues the versions and the repositories pushed or deleted, it subscribes the replicator to the event bus.
+func (r *Replicator) HandleEvent(e event.Event) {
+	switch e.Type {
+	case event.TypeManifestPush:
+		r.Notify(e.Repository, e.Reference, false)
+	case event.TypeManifestDelete:
+		r.Notify(e.Repository, e.Reference, true)
+	case event.TypeRepositoryDelete:
+		r.Notify(e.Repository, "", true)
+	}
+}
+
+func (r *Replicator) runReplication(ctx context.Context, rep *replication) {
+	var tick <-chan time.Time
+	if rep.rule.Trigger == config.ReplicationTriggerSchedule {
+		ticker := time.NewTicker(rep.rule.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-rep.queue:
+			r.update(rep, func(status *ReplicationStatus) { status.Pending-- })
+			r.replicate(ctx, rep, task)
+		case <-tick:
+			r.sync(ctx, rep)
+		}
+	}
+}
+
+func (r *Replicator) replicate(ctx context.Context, rep *replication, task replicationTask) {
+	copied := false
+	err := retryReplication(ctx, rep.rule.Retries, func() error {
+		if task.delete {
+			return deleteReplica(ctx, rep.target, task.repository, task.reference)
+		}
+		var err error
+		copied, err = replicateVersion(ctx, r.Store, rep.target, task.repository, task.reference)
+		return err
+	})
+	if err != nil {
+		registryLogger.Error("replicate", zap.String("rule", rep.rule.Name), zap.String("repository", task.repository),
+			zap.String("reference", task.reference), zap.Bool("delete", task.delete), zap.Error(err))
+	}
+	if task.delete {
+		errmsg := ""
+		if err != nil {
+			errmsg = err.Error()
+		}
+		record := audit.Record{Operation: "DeleteReplica", Repository: task.repository, Reference: task.reference, Target: rep.rule.Target}
+		auditDeletion(ctx, audit.UsernameReplication, record, errmsg)
+	}
+	// the target has it already, such as the version it replicated here
+	if err == nil && !task.delete && !copied {
+		return
+	}
+	r.record(rep, task, err)
+}
+
+// sync replicates the versions of the matching repositories which the target is missing or has an older copy of,
+// with Deletion the versions and repositories the store does not have are deleted from the target.
+func (r *Replicator) sync(ctx context.Context, rep *replication) {
+	registryLogger.Info("start replication sync", zap.String("rule", rep.rule.Name))
+	local, err := r.Store.GetGlobalIndex(ctx, "")
+	if err != nil && !IsRegistryStoreNotNotFound(err) {
+		r.record(rep, replicationTask{}, err)
+		return
+	}
+	repositories := map[string]struct{}{}
+	for _, repository := range local.Manifests {
+		if ok, _ := path.Match(rep.rule.Repository, repository.Name); !ok {
+			continue
+		}
+		repositories[repository.Name] = struct{}{}
+		if err := r.syncRepository(ctx, rep, repository.Name); err != nil {
+			r.record(rep, replicationTask{repository: repository.Name}, err)
+		}
+	}
+	if rep.rule.Deletion {
+		remote, err := rep.target.GetGlobalIndex(ctx, "")
+		if err != nil {
+			r.record(rep, replicationTask{}, err)
+			return
+		}
+		for _, repository := range remote.Manifests {
+			if _, ok := repositories[repository.Name]; ok {
+				continue
+			}
+			if ok, _ := path.Match(rep.rule.Repository, repository.Name); ok {
+				r.replicate(ctx, rep, replicationTask{repository: repository.Name, delete: true})
+			}
+		}
+	}
+	r.update(rep, func(status *ReplicationStatus) { status.LastSyncAt = time.Now() })
+}
+
+func (r *Replicator) syncRepository(ctx context.Context, rep *replication, repository string) error {
+	local, err := r.Store.GetIndex(ctx, repository, "")
+	if err != nil && !IsRegistryStoreNotNotFound(err) {
+		return err
+	}
+	remote := map[string]util.Descriptor{}
+	remoteindex, err := rep.target.GetIndex(ctx, repository, "")
+	if err != nil && !isRemoteNotFound(err) {
+		return err
+	}
+	if remoteindex != nil {
+		for _, version := range remoteindex.Manifests {
+			remote[version.Name] = version
+		}
+	}
+	for _, version := range local.Manifests {
+		// the versions the target has the same manifest of are skipped by replicateVersion
+		r.replicate(ctx, rep, replicationTask{repository: repository, reference: version.Name})
+		delete(remote, version.Name)
+	}
+	if rep.rule.Deletion {
+		for name := range remote {
+			r.replicate(ctx, rep, replicationTask{repository: repository, reference: name, delete: true})
+		}
+	}
+	return nil
+}
+
+func (r *Replicator) update(rep *replication, fn func(status *ReplicationStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&rep.status)
+}
+
+func (r *Replicator) record(rep *replication, task replicationTask, err error) {
+	r.update(rep, func(status *ReplicationStatus) {
+		switch {
+		case err != nil:
+			status.Failed++
+			status.LastError = err.Error()
+			if task.repository != "" {
+				status.LastError = task.repository + "@" + task.reference + ": " + status.LastError
+			}
+			status.LastErrorAt = time.Now()
+		case task.delete:
+			status.Deleted++
+			status.LastReplicatedAt = time.Now()
+		default:
+			status.Replicated++
+			status.LastReplicatedAt = time.Now()
+		}
+	})
+}
+
+// replicateVersion uploads the blobs the target is missing, then the manifest, and reports whether it did.
+// Nothing is copied if the target has the same manifest, so the registries replicating to each other stop there.
+func replicateVersion(ctx context.Context, store RegistryInterface, target *client.Client, repository, reference string) (bool, error) {
+	manifest, err := store.GetManifest(ctx, repository, reference)
+	if err != nil {
+		// deleted since it was queued
+		if errors.IsErrCode(err, errors.ErrCodeManifestUnknown) {
+			return false, nil
+		}
+		return false, err
+	}
+	replica, err := target.GetManifest(ctx, repository, reference)
+	if err != nil && !isRemoteNotFound(err) {
+		return false, err
+	}
+	if replica != nil && manifestDigest(replica) == manifestDigest(manifest) {
+		return false, nil
+	}
+	for _, desc := range append([]util.Descriptor{manifest.Config}, manifest.Blobs...) {
+		if desc.Digest == client.EmptyFileDigiest {
+			continue
+		}
+		exists, err := target.Remote.HeadBlob(ctx, repository, desc.Digest)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			continue
+		}
+		blob := client.DescriptorWithContent{
+			Descriptor: desc,
+			GetContent: func() (io.ReadSeekCloser, error) {
+				return &storeBlobReader{ctx: ctx, store: store, repository: repository, digest: desc.Digest, size: desc.Size}, nil
+			},
+		}
+		if err := target.UploadBlob(ctx, repository, blob); err != nil {
+			return false, fmt.Errorf("upload blob %s: %w", desc.Digest, err)
+		}
+	}
+	if err := target.PutManifest(ctx, repository, reference, *manifest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteReplica deletes the version from the target, or the repository if reference is empty.
+func deleteReplica(ctx context.Context, target *client.Client, repository, reference string) error {
+	var err error
+	if reference == "" {
+		err = target.Remote.RemoveIndex(ctx, repository)
+	} else {
+		err = target.Remote.DeleteManifest(ctx, repository, reference)
+	}
+	// already gone
+	if err != nil && isRemoteNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func retryReplication(ctx context.Context, retries int, fn func() error) error {
+	backoff := ReplicationRetryBackoff
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, ReplicationMaxRetryBackoff)
+	}
+}
+
+// storeBlobReader reads a blob of the store from any offset, the blob is opened again with a range read after a seek.
+type storeBlobReader struct {
+	ctx        context.Context
+	store      RegistryInterface
+	repository string
+	digest     digest.Digest
+	size       int64
+	offset     int64
+	current    io.ReadCloser
+}
+
+func (r *storeBlobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.current == nil {
+		content, err := r.store.GetBlobRange(r.ctx, r.repository, r.digest, r.offset, r.size-r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.current = content.Content
+	}
+	n, err := r.current.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *storeBlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	if offset != r.offset {
+		_ = r.Close()
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *storeBlobReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
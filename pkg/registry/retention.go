@@ -0,0 +1,250 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"cmp"
+	"context"
+	"path"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"kubegems.io/modelx/pkg/config"
+	errors "kubegems.io/modelx/pkg/response"
+	"kubegems.io/modelx/pkg/util"
+)
+
+const (
+	RetentionStatusPruned = "pruned"
+	RetentionStatusPrune  = "prune" // would be pruned, in dry run
+	RetentionStatusFailed = "failed"
+)
+
+type RetentionOptions struct {
+	// DryRun only reports the versions which would be pruned, blobs are not collected.
+	DryRun bool
+	// GC is used for the blob garbage collect after versions were pruned.
+	GC GCOptions
+}
+
+type RetentionVersion struct {
+	Name     string    `json:"name"`
+	Modified time.Time `json:"modified"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type RetentionRepositoryReport struct {
+	Repository string             `json:"repository"`
+	Rule       string             `json:"rule"`
+	Versions   []RetentionVersion `json:"versions"`
+}
+
+// RetentionReport lists the versions pruned by the retention rules, in dry run those which would be pruned.
+type RetentionReport struct {
+	DryRun         bool                        `json:"dryRun"`
+	StartedAt      time.Time                   `json:"startedAt"`
+	FinishedAt     time.Time                   `json:"finishedAt"`
+	Repositories   []RetentionRepositoryReport `json:"repositories"`
+	PrunedVersions int                         `json:"prunedVersions"`
+	GC             *GCReport                   `json:"gc,omitempty"`
+}
+
+type retentionRule struct {
+	config.RetentionRule
+	keep *regexp.Regexp
+}
+
+func compileRetentionRules(rules []config.RetentionRule) ([]retentionRule, error) {
+	compiled := make([]retentionRule, 0, len(rules))
+	for _, rule := range rules {
+		var keep *regexp.Regexp
+		if rule.KeepRegexp != "" {
+			re, err := regexp.Compile(rule.KeepRegexp)
+			if err != nil {
+				return nil, errors.NewConfigInvalidError(err.Error())
+			}
+			keep = re
+		}
+		compiled = append(compiled, retentionRule{RetentionRule: rule, keep: keep})
+	}
+	return compiled, nil
+}
+
+// ApplyRetention prunes the versions of every repository by the first rule matching it,
+// then collects the blobs no longer referenced.
+func ApplyRetention(ctx context.Context, store RegistryInterface, rules []config.RetentionRule, options RetentionOptions) (*RetentionReport, error) {
+	compiled, err := compileRetentionRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	report := &RetentionReport{DryRun: options.DryRun, StartedAt: time.Now(), Repositories: []RetentionRepositoryReport{}}
+
+	globalindex, err := store.GetGlobalIndex(ctx, "")
+	if err != nil && !IsRegistryStoreNotNotFound(err) {
+		return nil, err
+	}
+	for _, repository := range globalindex.Manifests {
+		idx := slices.IndexFunc(compiled, func(rule retentionRule) bool {
+			ok, _ := path.Match(rule.Repository, repository.Name)
+			return ok
+		})
+		if idx < 0 {
+			continue
+		}
+		result, err := applyRetentionRule(ctx, store, repository.Name, compiled[idx], options.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Versions) == 0 {
+			continue
+		}
+		report.Repositories = append(report.Repositories, *result)
+		for _, version := range result.Versions {
+			if version.Status != RetentionStatusFailed {
+				report.PrunedVersions++
+			}
+		}
+	}
+
+	auditRetentionReport(ctx, report)
+
+	if !options.DryRun && report.PrunedVersions > 0 {
+		gcreport, err := GCBlobsAll(ctx, store, options.GC)
+		if err != nil {
+			// the versions are pruned already, the blobs are left for the next garbage collect.
+			registryLogger.Error("garbage collect after retention", zap.Error(err))
+		}
+		report.GC = gcreport
+	}
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+func applyRetentionRule(ctx context.Context, store RegistryInterface, repository string, rule retentionRule, dryRun bool) (*RetentionRepositoryReport, error) {
+	index, err := store.GetIndex(ctx, repository, "")
+	if err != nil {
+		if IsRegistryStoreNotNotFound(err) {
+			return &RetentionRepositoryReport{Repository: repository, Rule: rule.Repository}, nil
+		}
+		return nil, err
+	}
+	result := &RetentionRepositoryReport{Repository: repository, Rule: rule.Repository, Versions: []RetentionVersion{}}
+	for _, version := range selectRetentionPrune(index.Manifests, rule, time.Now()) {
+		pruned := RetentionVersion{Name: version.Name, Modified: version.Modified}
+		if dryRun {
+			pruned.Status = RetentionStatusPrune
+		} else if err := store.DeleteManifest(ctx, repository, version.Name); err != nil && !IsRegistryStoreNotNotFound(err) {
+			registryLogger.Error("prune version", zap.String("repository", repository), zap.String("version", version.Name), zap.Error(err))
+			pruned.Status, pruned.Error = RetentionStatusFailed, err.Error()
+		} else {
+			registryLogger.Info("pruned version", zap.String("repository", repository), zap.String("version", version.Name), zap.String("rule", rule.Repository))
+			pruned.Status = RetentionStatusPruned
+		}
+		result.Versions = append(result.Versions, pruned)
+	}
+	return result, nil
+}
+
+// selectRetentionPrune returns the versions the rule prunes. Versions matching the keep regexp
+// are always kept and do not count toward KeepLast.
+func selectRetentionPrune(versions []util.Descriptor, rule retentionRule, now time.Time) []util.Descriptor {
+	candidates := make([]util.Descriptor, 0, len(versions))
+	for _, version := range versions {
+		if rule.keep != nil && rule.keep.MatchString(version.Name) {
+			continue
+		}
+		candidates = append(candidates, version)
+	}
+	// newest first
+	slices.SortFunc(candidates, func(a, b util.Descriptor) int {
+		return cmp.Or(b.Modified.Compare(a.Modified), cmp.Compare(b.Name, a.Name))
+	})
+	prune := []util.Descriptor{}
+	for i, version := range candidates {
+		if i < rule.KeepLast {
+			continue
+		}
+		if rule.MaxAge > 0 && now.Sub(version.Modified) < rule.MaxAge {
+			continue
+		}
+		prune = append(prune, version)
+	}
+	return prune
+}
+
+// RetentionScheduler applies the retention rules every Interval and keeps the last report.
+type RetentionScheduler struct {
+	Store    RegistryInterface
+	Interval time.Duration
+	Options  RetentionOptions
+	scheduler
+
+	mu    sync.Mutex
+	rules []config.RetentionRule
+	last  *RetentionReport
+}
+
+// Rules returns the retention rules in effect.
+func (s *RetentionScheduler) Rules() []config.RetentionRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rules
+}
+
+// SetRules replaces the retention rules, the runs in progress keep the rules they started with.
+func (s *RetentionScheduler) SetRules(rules []config.RetentionRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = rules
+}
+
+func (s *RetentionScheduler) Run(ctx context.Context) error {
+	registryLogger.Info("start retention scheduler", zap.Duration("interval", s.Interval), zap.Int("rules", len(s.Rules())), zap.Bool("dryRun", s.Options.DryRun))
+	s.schedule(ctx, s.Interval, s.runOnce)
+	return nil
+}
+
+func (s *RetentionScheduler) runOnce(ctx context.Context) {
+	rules := s.Rules()
+	if len(rules) == 0 {
+		return
+	}
+	report, err := ApplyRetention(ctx, s.Store, rules, s.Options)
+	if err != nil {
+		registryLogger.Error("scheduled retention", zap.Error(err))
+		return
+	}
+	registryLogger.Info("scheduled retention finished",
+		zap.Bool("dryRun", report.DryRun),
+		zap.Int("prunedVersions", report.PrunedVersions),
+		zap.Duration("duration", report.FinishedAt.Sub(report.StartedAt)))
+	s.mu.Lock()
+	s.last = report
+	s.mu.Unlock()
+}
+
+// LastReport returns the report of the last scheduled retention run, nil if none has finished yet.
+func (s *RetentionScheduler) LastReport() *RetentionReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
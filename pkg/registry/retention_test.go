@@ -0,0 +1,72 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kubegems.io/modelx/pkg/config"
+	"kubegems.io/modelx/pkg/util"
+)
+
+func TestSelectRetentionPrune(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	versions := []util.Descriptor{
+		{Name: "v1", Modified: now.Add(-30 * 24 * time.Hour)},
+		{Name: "v2", Modified: now.Add(-20 * 24 * time.Hour)},
+		{Name: "stable", Modified: now.Add(-40 * 24 * time.Hour)},
+		{Name: "v3", Modified: now.Add(-2 * 24 * time.Hour)},
+		{Name: "v4", Modified: now.Add(-time.Hour)},
+	}
+	tests := []struct {
+		name string
+		rule config.RetentionRule
+		want []string
+	}{
+		{name: "keep last", rule: config.RetentionRule{KeepLast: 2}, want: []string{"v2", "v1", "stable"}},
+		{name: "keep all", rule: config.RetentionRule{KeepLast: 10}, want: []string{}},
+		{name: "max age", rule: config.RetentionRule{MaxAge: 7 * 24 * time.Hour}, want: []string{"v2", "v1", "stable"}},
+		{name: "keep last and max age", rule: config.RetentionRule{KeepLast: 1, MaxAge: 25 * 24 * time.Hour}, want: []string{"v1", "stable"}},
+		{name: "keep regexp does not count", rule: config.RetentionRule{KeepLast: 2, KeepRegexp: "^stable$"}, want: []string{"v2", "v1"}},
+		{name: "keep regexp with max age", rule: config.RetentionRule{MaxAge: time.Hour / 2, KeepRegexp: "^v[34]$"}, want: []string{"v2", "v1", "stable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRetentionRules([]config.RetentionRule{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, version := range selectRetentionPrune(versions, rules[0], now) {
+				names = append(names, version.Name)
+			}
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
+
+func TestSelectRetentionPruneSameModified(t *testing.T) {
+	now := time.Now()
+	versions := []util.Descriptor{{Name: "a", Modified: now}, {Name: "c", Modified: now}, {Name: "b", Modified: now}}
+	rules, _ := compileRetentionRules([]config.RetentionRule{{KeepLast: 1}})
+	// the order is stable by name
+	pruned := selectRetentionPrune(versions, rules[0], now)
+	assert.Equal(t, []util.Descriptor{{Name: "b", Modified: now}, {Name: "a", Modified: now}}, pruned)
+}
@@ -17,8 +17,11 @@ limitations under the License.
 package registry
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
 	"strings"
@@ -79,11 +82,14 @@ func NewS3FSProvider(ctx context.Context, options *modelxconfig.S3Options) (*S3S
 
 func (m *S3StorageProvider) Put(ctx context.Context, path string, content BlobContent) error {
 	uploadobj := &s3.PutObjectInput{
-		Bucket:        aws.String(m.Bucket),
-		Key:           m.prefixedKey(path),
-		Body:          content.Content,
-		ContentLength: ptr.To(content.ContentLength),
-		ContentType:   aws.String(content.ContentType),
+		Bucket:      aws.String(m.Bucket),
+		Key:         m.prefixedKey(path),
+		Body:        content.Content,
+		ContentType: aws.String(content.ContentType),
+	}
+	// chunked uploads have no content length, let the uploader split the stream.
+	if content.ContentLength >= 0 {
+		uploadobj.ContentLength = ptr.To(content.ContentLength)
 	}
 	if _, err := manager.NewUploader(m.Client).Upload(ctx, uploadobj); err != nil {
 		return modelxerrors.NewInternalError(err)
@@ -130,6 +136,52 @@ func (m *S3StorageProvider) Remove(ctx context.Context, path string, recursive b
 	}
 }
 
+// PutIf writes the object with If-Match, or If-None-Match when etag is empty.
+// The content is buffered, conditional writes are only used for small objects like indexes.
+func (m *S3StorageProvider) PutIf(ctx context.Context, path string, content BlobContent, etag string) error {
+	data, err := io.ReadAll(content.Content)
+	if err != nil {
+		return err
+	}
+	uploadobj := &s3.PutObjectInput{
+		Bucket:        aws.String(m.Bucket),
+		Key:           m.prefixedKey(path),
+		Body:          bytes.NewReader(data),
+		ContentLength: ptr.To(int64(len(data))),
+		ContentType:   aws.String(content.ContentType),
+	}
+	if etag == "" {
+		uploadobj.IfNoneMatch = aws.String("*")
+	} else {
+		uploadobj.IfMatch = aws.String(etag)
+	}
+	if _, err := m.Client.PutObject(ctx, uploadobj); err != nil {
+		if IsS3PreconditionFailed(err) {
+			return ErrPreconditionFailed
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *S3StorageProvider) RemoveIf(ctx context.Context, path string, etag string) error {
+	if etag == "" {
+		return ErrPreconditionFailed
+	}
+	_, err := m.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(m.Bucket),
+		Key:     m.prefixedKey(path),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		if IsS3PreconditionFailed(err) {
+			return ErrPreconditionFailed
+		}
+		return err
+	}
+	return nil
+}
+
 func (m *S3StorageProvider) Get(ctx context.Context, path string) (*BlobContent, error) {
 	getobjout, err := m.Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(m.Bucket),
@@ -145,6 +197,27 @@ func (m *S3StorageProvider) Get(ctx context.Context, path string) (*BlobContent,
 	}, nil
 }
 
+// GetRange reads length bytes from offset, a negative length reads to the end.
+func (m *S3StorageProvider) GetRange(ctx context.Context, path string, offset, length int64) (*BlobContent, error) {
+	byterange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byterange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+	getobjout, err := m.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(m.Bucket),
+		Key:    m.prefixedKey(path),
+		Range:  aws.String(byterange),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BlobContent{
+		Content:       getobjout.Body,
+		ContentType:   StringDeref(getobjout.ContentType, ""),
+		ContentLength: *getobjout.ContentLength,
+	}, nil
+}
+
 func (f *S3StorageProvider) Copy(ctx context.Context, pathTo, pathFrom string) error {
 	blobcontnt, err := f.Get(ctx, pathFrom)
 	if err != nil {
@@ -184,6 +257,7 @@ func (m *S3StorageProvider) Stat(ctx context.Context, path string) (FsObjectMeta
 		Size:         *headobjout.ContentLength,
 		LastModified: TimeDeref(headobjout.LastModified, time.Time{}),
 		ContentType:  StringDeref(headobjout.ContentType, ""),
+		ETag:         StringDeref(headobjout.ETag, ""),
 	}, nil
 }
 
@@ -236,6 +310,16 @@ func IsS3StorageNotFound(err error) bool {
 	return false
 }
 
+// IsS3PreconditionFailed reports a failed If-Match/If-None-Match, 409 is returned
+// when a conflicting conditional write is in progress.
+func IsS3PreconditionFailed(err error) bool {
+	var apie *http.ResponseError
+	if errors.As(err, &apie) {
+		return apie.HTTPStatusCode() == 412 || apie.HTTPStatusCode() == 409
+	}
+	return false
+}
+
 func (m *S3StorageProvider) prefixedKey(key string) *string {
 	return aws.String(path.Join(m.Prefix, key))
 }
@@ -0,0 +1,68 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// scheduler runs a job every interval, it may be stopped between two runs by Shutdown.
+type scheduler struct {
+	once     sync.Once
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (s *scheduler) init() {
+	s.once.Do(func() {
+		s.stop, s.done = make(chan struct{}), make(chan struct{})
+	})
+}
+
+// Shutdown stops scheduling new runs and waits for the run in progress to finish, or for ctx to be done.
+// The run is only interrupted by cancelling the context it was started with.
+func (s *scheduler) Shutdown(ctx context.Context) error {
+	s.init()
+	s.stopOnce.Do(func() { close(s.stop) })
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// schedule calls run every interval until ctx is done or Shutdown is called.
+func (s *scheduler) schedule(ctx context.Context, interval time.Duration, run func(ctx context.Context)) {
+	s.init()
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			run(ctx)
+		}
+	}
+}
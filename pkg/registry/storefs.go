@@ -22,6 +22,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"os"
 	"path"
 	"regexp"
 	"slices"
@@ -30,6 +32,7 @@ import (
 	"time"
 
 	"github.com/opencontainers/go-digest"
+	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 
 	"kubegems.io/modelx/pkg/config"
@@ -40,6 +43,8 @@ import (
 type FSRegistryStore struct {
 	FS             FSProvider
 	EnableRedirect bool
+	// GlobalBlobs stores blob content once in a global pool, repositories hold links to it.
+	GlobalBlobs bool
 }
 
 var _ RegistryInterface = &FSRegistryStore{}
@@ -69,6 +74,7 @@ func NewFSRegistryStore(ctx context.Context, options *config.Options) (*FSRegist
 	store := &FSRegistryStore{
 		FS:             fs,
 		EnableRedirect: options.EnableRedirect,
+		GlobalBlobs:    options.EnableGlobalBlobs,
 	}
 	if err := store.RefreshGlobalIndex(ctx); err != nil {
 		return nil, err
@@ -87,7 +93,7 @@ func (m *FSRegistryStore) ExistsManifest(ctx context.Context, repository string,
 func (m *FSRegistryStore) GetManifest(ctx context.Context, repository string, reference string) (*types.Manifest, error) {
 	body, err := m.FS.Get(ctx, ManifestPath(repository, reference))
 	if err != nil {
-		if IsS3StorageNotFound(err) {
+		if IsS3StorageNotFound(err) || os.IsNotExist(err) {
 			return nil, errors.NewManifestUnknownError(reference)
 		}
 		return nil, errors.NewInternalError(err)
@@ -102,6 +108,9 @@ func (m *FSRegistryStore) GetManifest(ctx context.Context, repository string, re
 }
 
 func (m *FSRegistryStore) PutManifest(ctx context.Context, repository string, reference string, contentType string, manifest types.Manifest) error {
+	if err := m.checkManifestBlobs(ctx, repository, manifest); err != nil {
+		return err
+	}
 	content, err := json.Marshal(manifest)
 	if err != nil {
 		return errors.NewManifestInvalidError(err)
@@ -120,8 +129,83 @@ func (m *FSRegistryStore) PutManifest(ctx context.Context, repository string, re
 	return nil
 }
 
+type skipManifestBlobCheckKey struct{}
+
+// WithoutManifestBlobCheck makes PutManifest accept a manifest whose blobs are not stored yet,
+// a pull-through cache stores the manifest before it fetches the blobs.
+func WithoutManifestBlobCheck(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipManifestBlobCheckKey{}, true)
+}
+
+// checkManifestBlobs makes sure the config and blobs of the manifest exist in the repository with the declared size.
+// Stored blobs are never removed here, other versions may reference them, garbage collect cleans up after.
+func (m *FSRegistryStore) checkManifestBlobs(ctx context.Context, repository string, manifest types.Manifest) error {
+	if skip, _ := ctx.Value(skipManifestBlobCheckKey{}).(bool); skip {
+		return nil
+	}
+	emptyDigest := digest.Canonical.FromBytes(nil)
+
+	mu := sync.Mutex{}
+	missing := []digest.Digest{}
+	mismatched := []string{}
+	checked := map[digest.Digest]struct{}{}
+
+	eg := errgroup.Group{}
+	eg.SetLimit(ManifestBlobCheckConcurrency)
+	for _, desc := range append([]types.Descriptor{manifest.Config}, manifest.Blobs...) {
+		if desc.Digest == emptyDigest {
+			// empty files are never uploaded
+			continue
+		}
+		if err := desc.Digest.Validate(); err != nil {
+			return errors.NewManifestInvalidError(fmt.Errorf("blob %s: %w", desc.Name, err))
+		}
+		if _, ok := checked[desc.Digest]; ok {
+			continue
+		}
+		checked[desc.Digest] = struct{}{}
+		eg.Go(func() error {
+			meta, _, err := m.statBlob(ctx, repository, desc.Digest)
+			switch {
+			case err == nil && meta.Size == desc.Size:
+				return nil
+			case err == nil:
+				mu.Lock()
+				mismatched = append(mismatched, fmt.Sprintf("blob %s has size %d, not %d", desc.Digest, meta.Size, desc.Size))
+				mu.Unlock()
+			case os.IsNotExist(err) || IsS3StorageNotFound(err):
+				// a link left without its global blob is missing too, uploading the blob again fixes it
+				mu.Lock()
+				missing = append(missing, desc.Digest)
+				mu.Unlock()
+			default:
+				return errors.NewInternalError(err)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return errors.NewManifestBlobUnknownError(missing)
+	}
+	if len(mismatched) > 0 {
+		slices.Sort(mismatched)
+		return errors.NewManifestInvalidError(fmt.Errorf("%s", strings.Join(mismatched, "; ")))
+	}
+	return nil
+}
+
 func (m *FSRegistryStore) DeleteManifest(ctx context.Context, repository string, reference string) error {
 	if err := m.FS.Remove(ctx, ManifestPath(repository, reference), false); err != nil {
+		if os.IsNotExist(err) || IsS3StorageNotFound(err) {
+			return ErrRegistryStoreNotFound
+		}
+		return errors.NewInternalError(err)
+	}
+	if err := m.RefreshIndex(ctx, repository); err != nil {
 		return errors.NewInternalError(err)
 	}
 	return nil
@@ -131,7 +215,7 @@ func (m *FSRegistryStore) DeleteManifest(ctx context.Context, repository string,
 func (m *FSRegistryStore) GetIndex(ctx context.Context, repository string, search string) (types.Index, error) {
 	body, err := m.FS.Get(ctx, IndexPath(repository))
 	if err != nil {
-		if IsS3StorageNotFound(err) {
+		if IsS3StorageNotFound(err) || os.IsNotExist(err) {
 			return types.Index{}, ErrRegistryStoreNotFound
 		}
 		return types.Index{}, err
@@ -159,7 +243,8 @@ func (m *FSRegistryStore) GetIndex(ctx context.Context, repository string, searc
 	return index, nil
 }
 
-func (m *FSRegistryStore) PutIndex(ctx context.Context, repository string, index types.Index) error {
+// PutIndex writes the index only if the stored one still has etag, see FSProvider.PutIf.
+func (m *FSRegistryStore) PutIndex(ctx context.Context, repository string, index types.Index, etag string) error {
 	slices.SortFunc(index.Manifests, func(a, b types.Descriptor) int {
 		return strings.Compare(a.Name, b.Name)
 	})
@@ -179,17 +264,14 @@ func (m *FSRegistryStore) PutIndex(ctx context.Context, repository string, index
 
 	content, err := json.Marshal(index)
 	if err != nil {
-		return errors.NewInternalError(err)
+		return err
 	}
 	storageContent := BlobContent{
 		Content:       io.NopCloser(bytes.NewReader(content)),
 		ContentLength: int64(len(content)),
 		ContentType:   MediaTypeModelIndexJson,
 	}
-	if err := m.FS.Put(ctx, IndexPath(repository), storageContent); err != nil {
-		return errors.NewInternalError(err)
-	}
-	return nil
+	return m.FS.PutIf(ctx, IndexPath(repository), storageContent, etag)
 }
 
 func (m *FSRegistryStore) RemoveIndex(ctx context.Context, repository string) error {
@@ -203,11 +285,28 @@ func (m *FSRegistryStore) RemoveIndex(ctx context.Context, repository string) er
 	return nil
 }
 
+// RefreshIndex rebuilds the index of the repository from its manifests, then the global index.
+// Concurrent refreshes are resolved by conditional writes, a refresh that loses starts over,
+// so the last successful write always reflects every manifest on the storage.
 func (m *FSRegistryStore) RefreshIndex(ctx context.Context, repository string) error {
-	filemetas, err := m.FS.List(ctx, ManifestPath(repository, ""), false)
-	if err != nil {
+	if err := retryOnConflict(ctx, func() error {
+		return m.refreshIndex(ctx, repository)
+	}); err != nil {
 		return errors.NewInternalError(err)
 	}
+	return m.RefreshGlobalIndex(ctx)
+}
+
+func (m *FSRegistryStore) refreshIndex(ctx context.Context, repository string) error {
+	// read the version before listing, a manifest written after that makes the write fail.
+	etag, err := m.objectETag(ctx, IndexPath(repository))
+	if err != nil {
+		return err
+	}
+	filemetas, err := m.FS.List(ctx, ManifestPath(repository, ""), false)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
 	eg := errgroup.Group{}
 	manifests := sync.Map{}
@@ -216,6 +315,10 @@ func (m *FSRegistryStore) RefreshIndex(ctx context.Context, repository string) e
 		eg.Go(func() error {
 			manifest, err := m.GetManifest(ctx, repository, meta.Name)
 			if err != nil {
+				// removed since listed
+				if errors.IsErrCode(err, errors.ErrCodeManifestUnknown) {
+					return nil
+				}
 				return err
 			}
 			desc := types.Descriptor{
@@ -235,7 +338,7 @@ func (m *FSRegistryStore) RefreshIndex(ctx context.Context, repository string) e
 		})
 	}
 	if err := eg.Wait(); err != nil {
-		return errors.NewInternalError(err)
+		return err
 	}
 
 	index := types.Index{
@@ -247,23 +350,21 @@ func (m *FSRegistryStore) RefreshIndex(ctx context.Context, repository string) e
 		return true
 	})
 
-	// save the index
-	if len(index.Manifests) != 0 {
-		if err := m.PutIndex(ctx, repository, index); err != nil {
-			return errors.NewInternalError(err)
+	if len(index.Manifests) == 0 {
+		// the last manifest is gone, drop the index so the repository disappears from the global index
+		if etag == "" {
+			return nil
 		}
+		return m.FS.RemoveIf(ctx, IndexPath(repository), etag)
 	}
-	// refresh global index
-	if err := m.RefreshGlobalIndex(ctx); err != nil {
-		return errors.NewInternalError(err)
-	}
-	return nil
+	// save the index
+	return m.PutIndex(ctx, repository, index, etag)
 }
 
 func (m *FSRegistryStore) GetGlobalIndex(ctx context.Context, search string) (types.Index, error) {
 	body, err := m.FS.Get(ctx, IndexPath(""))
 	if err != nil {
-		if IsS3StorageNotFound(err) {
+		if IsS3StorageNotFound(err) || os.IsNotExist(err) {
 			return types.Index{}, ErrRegistryStoreNotFound
 		}
 		return types.Index{}, err
@@ -290,27 +391,40 @@ func (m *FSRegistryStore) GetGlobalIndex(ctx context.Context, search string) (ty
 	return globalindex, nil
 }
 
-func (m *FSRegistryStore) PutGlobalIndex(ctx context.Context, index types.Index) error {
+// PutGlobalIndex writes the global index only if the stored one still has etag, see FSProvider.PutIf.
+func (m *FSRegistryStore) PutGlobalIndex(ctx context.Context, index types.Index, etag string) error {
 	slices.SortFunc(index.Manifests, types.SortDescriptorName)
 	content, err := json.Marshal(index)
 	if err != nil {
-		return errors.NewInternalError(err)
+		return err
 	}
 	storageContent := BlobContent{
 		Content:       io.NopCloser(bytes.NewReader(content)),
 		ContentLength: int64(len(content)),
 		ContentType:   MediaTypeModelIndexJson,
 	}
-	if err := m.FS.Put(ctx, IndexPath(""), storageContent); err != nil {
+	return m.FS.PutIf(ctx, IndexPath(""), storageContent, etag)
+}
+
+// RefreshGlobalIndex rebuilds the global index from the repository indexes, with the same
+// conditional write and retry as RefreshIndex.
+func (m *FSRegistryStore) RefreshGlobalIndex(ctx context.Context) error {
+	if err := retryOnConflict(ctx, func() error {
+		return m.refreshGlobalIndex(ctx)
+	}); err != nil {
 		return errors.NewInternalError(err)
 	}
 	return nil
 }
 
-func (m *FSRegistryStore) RefreshGlobalIndex(ctx context.Context) error {
+func (m *FSRegistryStore) refreshGlobalIndex(ctx context.Context) error {
+	etag, err := m.objectETag(ctx, IndexPath(""))
+	if err != nil {
+		return err
+	}
 	filemetas, err := m.FS.List(ctx, "", true)
 	if err != nil {
-		return errors.NewInternalError(err)
+		return err
 	}
 
 	eg := errgroup.Group{}
@@ -325,6 +439,10 @@ func (m *FSRegistryStore) RefreshGlobalIndex(ctx context.Context) error {
 		eg.Go(func() error {
 			index, err := m.GetIndex(ctx, repository, "")
 			if err != nil {
+				// removed since listed
+				if IsRegistryStoreNotNotFound(err) {
+					return nil
+				}
 				return err
 			}
 
@@ -341,7 +459,7 @@ func (m *FSRegistryStore) RefreshGlobalIndex(ctx context.Context) error {
 	}
 
 	if err := eg.Wait(); err != nil {
-		return errors.NewInternalError(err)
+		return err
 	}
 
 	index := types.Index{}
@@ -351,28 +469,73 @@ func (m *FSRegistryStore) RefreshGlobalIndex(ctx context.Context) error {
 		return true
 	})
 	// save the index
-	return m.PutGlobalIndex(ctx, index)
+	return m.PutGlobalIndex(ctx, index, etag)
 }
 
+// objectETag returns the current etag of the object at path, or empty if it does not exist.
+func (m *FSRegistryStore) objectETag(ctx context.Context, path string) (string, error) {
+	meta, err := m.FS.Stat(ctx, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return meta.ETag, nil
+}
+
+// retryOnConflict runs fn again while it fails with ErrPreconditionFailed,
+// waiting a growing and jittered backoff between the attempts.
+func retryOnConflict(ctx context.Context, fn func() error) error {
+	backoff := IndexUpdateBackoff
+	for i := 0; ; i++ {
+		err := fn()
+		if !IsPreconditionFailed(err) || i >= IndexUpdateRetries {
+			return err
+		}
+		registryLogger.Debug("index changed concurrently, retrying", zap.Int("attempt", i+1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff + time.Duration(rand.Int64N(int64(backoff)))):
+		}
+		backoff = min(backoff*2, IndexUpdateMaxBackoff)
+	}
+}
+
+// ExistsBlob reports whether the content of the blob is stored, a link whose global blob is gone does not count.
 func (m *FSRegistryStore) ExistsBlob(ctx context.Context, repository string, digest digest.Digest) (bool, error) {
-	if exists, err := m.FS.Exists(ctx, BlobDigestPath(repository, digest)); err != nil {
+	if _, _, err := m.statBlob(ctx, repository, digest); err != nil {
+		if os.IsNotExist(err) || IsS3StorageNotFound(err) {
+			return false, nil
+		}
 		return false, errors.NewInternalError(err)
-	} else {
-		return exists, nil
 	}
+	return true, nil
 }
 
 func (m *FSRegistryStore) GetBlobMeta(ctx context.Context, repository string, digest digest.Digest) (BlobMeta, error) {
-	path := BlobDigestPath(repository, digest)
-	meta, err := m.FS.Stat(ctx, path)
+	// the repository object is kept for the time, a link may point to an older global blob.
+	meta, err := m.FS.Stat(ctx, BlobDigestPath(repository, digest))
 	if err != nil {
 		return BlobMeta{}, errors.NewInternalError(err)
 	}
-	return BlobMeta{ContentType: meta.ContentType, ContentLength: meta.Size}, nil
+	blobmeta := BlobMeta{ContentType: meta.ContentType, ContentLength: meta.Size, LastModified: meta.LastModified}
+	if meta.ContentType == MediaTypeBlobLink {
+		global, err := m.FS.Stat(ctx, GlobalBlobDigestPath(digest))
+		if err != nil {
+			return BlobMeta{}, errors.NewInternalError(err)
+		}
+		blobmeta.ContentType, blobmeta.ContentLength, blobmeta.Linked = global.ContentType, global.Size, true
+	}
+	return blobmeta, nil
 }
 
 func (m *FSRegistryStore) GetBlob(ctx context.Context, repository string, digest digest.Digest) (*BlobContent, error) {
-	path := BlobDigestPath(repository, digest)
+	_, path, err := m.statBlob(ctx, repository, digest)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
 	content, err := m.FS.Get(ctx, path)
 	if err != nil {
 		return nil, errors.NewInternalError(err)
@@ -380,21 +543,62 @@ func (m *FSRegistryStore) GetBlob(ctx context.Context, repository string, digest
 	return content, nil
 }
 
+// GetBlobRange returns length bytes of the blob from offset, a negative length reads to the end.
+func (m *FSRegistryStore) GetBlobRange(ctx context.Context, repository string, digest digest.Digest, offset, length int64) (*BlobContent, error) {
+	_, path, err := m.statBlob(ctx, repository, digest)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	content, err := m.FS.GetRange(ctx, path, offset, length)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	return content, nil
+}
+
+// CopyBlob links a blob of the global pool into the other repository, blobs stored in place are copied.
 func (m *FSRegistryStore) CopyBlob(ctx context.Context, repositoryTo, repositoryFrom string, digest digest.Digest) error {
-	pathTo := BlobDigestPath(repositoryTo, digest)
-	pathFrom := BlobDigestPath(repositoryFrom, digest)
-	err := m.FS.Copy(ctx, pathTo, pathFrom)
+	_, pathFrom, err := m.statBlob(ctx, repositoryFrom, digest)
 	if err != nil {
 		return errors.NewInternalError(err)
 	}
+	if pathFrom == GlobalBlobDigestPath(digest) {
+		return m.linkBlob(ctx, repositoryTo, digest)
+	}
+	if err := m.FS.Copy(ctx, BlobDigestPath(repositoryTo, digest), pathFrom); err != nil {
+		return errors.NewInternalError(err)
+	}
 	return nil
 }
 
+// PutBlob hashes the content while writing it, the write fails if the content does not match
+// the digest or the declared size, and the blob already stored at the digest is kept.
 func (m *FSRegistryStore) PutBlob(ctx context.Context, repository string, digest digest.Digest, content BlobContent) error {
-	path := BlobDigestPath(repository, digest)
+	if err := digest.Validate(); err != nil {
+		return errors.NewDigestInvalidError(digest.String())
+	}
+	if m.GlobalBlobs {
+		return m.putGlobalBlob(ctx, repository, digest, content)
+	}
+	return m.putBlob(ctx, repository, BlobDigestPath(repository, digest), digest, content)
+}
+
+func (m *FSRegistryStore) putBlob(ctx context.Context, repository string, path string, digest digest.Digest, content BlobContent) error {
+	verifier := NewVerifyReader(content.Content, digest, content.ContentLength)
+	content.Content = verifier
+	// the provider discards a failed write, the path keeps what it had
 	if err := m.FS.Put(ctx, path, content); err != nil {
+		if verr := verifier.Err(); verr != nil {
+			registryLogger.Warn("blob content verify failed", zap.Any("repository", repository), zap.Any("digest", digest.String()), zap.Error(verr))
+			return verr
+		}
 		return errors.NewInternalError(err)
 	}
+	// what was written matches, the client sent more than it declared
+	if err := verifier.Verify(); err != nil {
+		registryLogger.Warn("blob content verify failed", zap.Any("repository", repository), zap.Any("digest", digest.String()), zap.Error(err))
+		return err
+	}
 	return nil
 }
 
@@ -426,10 +630,11 @@ func (m *FSRegistryStore) ListBlobs(ctx context.Context, repository string) ([]d
 	if err != nil {
 		return nil, err
 	}
-	digests := make([]digest.Digest, len(metas))
+	digests := make([]digest.Digest, 0, len(metas))
 	for _, meta := range metas {
-		algo, hash := path.Split(meta.Name)
-		digests = append(digests, digest.FromString(algo+":"+hash))
+		if blobdigest, ok := parseBlobDigestPath(meta.Name); ok {
+			digests = append(digests, blobdigest)
+		}
 	}
 	return digests, nil
 }
@@ -0,0 +1,207 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+
+	"kubegems.io/modelx/pkg/config"
+	errors "kubegems.io/modelx/pkg/response"
+	types "kubegems.io/modelx/pkg/util"
+)
+
+func newTestStore(t *testing.T, globalBlobs bool) *FSRegistryStore {
+	fs, err := NewLocalFSProvider(&config.LocalFSOptions{Basepath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FSRegistryStore{FS: fs, GlobalBlobs: globalBlobs}
+}
+
+func putTestBlob(t *testing.T, store *FSRegistryStore, repository string, data string) types.Descriptor {
+	d := digest.FromString(data)
+	content := BlobContent{
+		Content:       io.NopCloser(bytes.NewReader([]byte(data))),
+		ContentLength: int64(len(data)),
+		ContentType:   "application/octet-stream",
+	}
+	if err := store.PutBlob(context.Background(), repository, d, content); err != nil {
+		t.Fatal(err)
+	}
+	return types.Descriptor{Name: data, Digest: d, Size: int64(len(data))}
+}
+
+func testManifest(config types.Descriptor, blobs ...types.Descriptor) types.Manifest {
+	return types.Manifest{SchemaVersion: 2, MediaType: MediaTypeModelIndexJson, Config: config, Blobs: blobs}
+}
+
+func TestPutBlobRejected(t *testing.T) {
+	for _, globalBlobs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("globalBlobs=%t", globalBlobs), func(t *testing.T) {
+			assert := assert.New(t)
+			ctx := context.Background()
+			store := newTestStore(t, globalBlobs)
+			blob := putTestBlob(t, store, "library/llama", "weights")
+
+			tests := []struct {
+				name    string
+				content string
+				size    int64
+				code    errors.ErrCode
+			}{
+				{name: "other content", content: "poisons", size: 7, code: errors.ErrCodeDigestInvalid},
+				{name: "unknown size", content: "poisoned", size: -1, code: errors.ErrCodeDigestInvalid},
+				{name: "short", content: "weigh", size: 7, code: errors.ErrCodeSizeInvalid},
+				{name: "long", content: "weights and more", size: 7, code: errors.ErrCodeSizeInvalid},
+			}
+			for _, tt := range tests {
+				for _, repository := range []string{"library/llama", "library/qwen"} {
+					content := BlobContent{
+						Content:       io.NopCloser(bytes.NewReader([]byte(tt.content))),
+						ContentLength: tt.size,
+						ContentType:   "application/octet-stream",
+					}
+					err := store.PutBlob(ctx, repository, blob.Digest, content)
+					assert.True(errors.IsErrCode(err, tt.code), "%s to %s: %v", tt.name, repository, err)
+				}
+			}
+
+			// the stored blob is untouched
+			stored, err := store.GetBlob(ctx, "library/llama", blob.Digest)
+			assert.NoError(err)
+			data, _ := io.ReadAll(stored.Content)
+			stored.Close()
+			assert.Equal("weights", string(data))
+			exists, err := store.ExistsBlob(ctx, "library/qwen", blob.Digest)
+			assert.NoError(err)
+			assert.False(exists)
+		})
+	}
+}
+
+func TestPutManifestMismatchedBlobSize(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, false)
+
+	config := putTestBlob(t, store, "library/llama", "config")
+	blob := putTestBlob(t, store, "library/llama", "weights")
+	assert.NoError(store.PutManifest(ctx, "library/llama", "v1", "", testManifest(config, blob)))
+
+	wrong := blob
+	wrong.Size = 999
+	err := store.PutManifest(ctx, "library/llama", "v2", "", testManifest(config, wrong))
+	assert.True(errors.IsErrCode(err, errors.ErrCodeManifestInvalid), "got %v", err)
+
+	// the blob of v1 is kept
+	exists, err := store.ExistsManifest(ctx, "library/llama", "v2")
+	assert.NoError(err)
+	assert.False(exists)
+	content, err := store.GetBlob(ctx, "library/llama", blob.Digest)
+	if assert.NoError(err) {
+		data, _ := io.ReadAll(content.Content)
+		content.Close()
+		assert.Equal("weights", string(data))
+	}
+}
+
+func TestPutManifestDanglingLink(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, true)
+
+	config := putTestBlob(t, store, "library/llama", "config")
+	blob := putTestBlob(t, store, "library/llama", "weights")
+	assert.NoError(store.FS.Remove(ctx, GlobalBlobDigestPath(blob.Digest), false))
+
+	err := store.PutManifest(ctx, "library/llama", "v1", "", testManifest(config, blob))
+	assert.True(errors.IsErrCode(err, errors.ErrCodeManifestBlobUnknown), "got %v", err)
+	exists, err := store.ExistsBlob(ctx, "library/llama", blob.Digest)
+	assert.NoError(err)
+	assert.False(exists)
+
+	// uploading the blob again fixes the link
+	putTestBlob(t, store, "library/llama", "weights")
+	assert.NoError(store.PutManifest(ctx, "library/llama", "v1", "", testManifest(config, blob)))
+}
+
+func TestRetryOnConflict(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	attempts := 0
+	err := retryOnConflict(ctx, func() error {
+		attempts++
+		if attempts < 3 {
+			return ErrPreconditionFailed
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(3, attempts)
+
+	// other errors are not retried
+	attempts = 0
+	failed := stderrors.New("disk full")
+	err = retryOnConflict(ctx, func() error {
+		attempts++
+		return failed
+	})
+	assert.ErrorIs(err, failed)
+	assert.Equal(1, attempts)
+
+	// stops with the context
+	cancelctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = retryOnConflict(cancelctx, func() error {
+		return ErrPreconditionFailed
+	})
+	assert.ErrorIs(err, context.Canceled)
+}
+
+func TestConcurrentPutManifest(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newTestStore(t, false)
+
+	config := putTestBlob(t, store, "library/llama", "config")
+	blob := putTestBlob(t, store, "library/llama", "weights")
+	eg := errgroup.Group{}
+	for i := range 8 {
+		eg.Go(func() error {
+			return store.PutManifest(ctx, "library/llama", fmt.Sprintf("v%d", i), "", testManifest(config, blob))
+		})
+	}
+	assert.NoError(eg.Wait())
+
+	// no version is lost by the concurrent index updates
+	index, err := store.GetIndex(ctx, "library/llama", "")
+	assert.NoError(err)
+	assert.Len(index.Manifests, 8)
+	globalindex, err := store.GetGlobalIndex(ctx, "")
+	assert.NoError(err)
+	assert.Len(globalindex.Manifests, 1)
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"time"
 
@@ -42,7 +43,7 @@ const (
 var ErrUploadNotFound = modelxerrors.NewInternalError(errors.New("upload not found"))
 
 type S3RegistryStore struct {
-	fs       RegistryInterface
+	fs       *FSRegistryStore
 	provider *S3StorageProvider
 }
 
@@ -56,6 +57,7 @@ func NewS3RegistryStore(ctx context.Context, options *config.Options) (*S3Regist
 	store := &FSRegistryStore{
 		FS:             fs,
 		EnableRedirect: options.EnableRedirect,
+		GlobalBlobs:    options.EnableGlobalBlobs,
 	}
 	if err := store.RefreshGlobalIndex(ctx); err != nil {
 		return nil, err
@@ -63,6 +65,11 @@ func NewS3RegistryStore(ctx context.Context, options *config.Options) (*S3Regist
 	return &S3RegistryStore{fs: store, provider: fs}, nil
 }
 
+// FS returns the storage of the store.
+func (s *S3RegistryStore) FS() FSProvider {
+	return s.provider
+}
+
 func (s *S3RegistryStore) GetGlobalIndex(ctx context.Context, search string) (types.Index, error) {
 	return s.fs.GetGlobalIndex(ctx, search)
 }
@@ -84,26 +91,12 @@ func (s *S3RegistryStore) GetManifest(ctx context.Context, repository string, re
 }
 
 func (s *S3RegistryStore) PutManifest(ctx context.Context, repository string, reference string, contentType string, manifest types.Manifest) error {
-	// complete multipart upload
+	// complete multipart upload, the blobs are checked by the fs store after
 	for _, blob := range manifest.Blobs {
-		path := BlobDigestPath(repository, blob.Digest)
 		if blob.Size > MultiPartUploadThreshold {
-			if err := s.completeMultipartUpload(ctx, path, blob.Size); err != nil {
+			if err := s.completeMultipartUpload(ctx, BlobDigestPath(repository, blob.Digest), blob.Size); err != nil {
 				return err
 			}
-		} else {
-			// check if uploadid exists and match size
-			meta, err := s.fs.GetBlobMeta(ctx, repository, blob.Digest)
-			if err != nil {
-				return err
-			}
-			if meta.ContentLength != blob.Size {
-				// remove this blob
-				if err := s.fs.DeleteBlob(ctx, repository, blob.Digest); err != nil {
-					return err
-				}
-				return fmt.Errorf("size mismatch: %d != %d", meta.ContentLength, blob.Size)
-			}
 		}
 	}
 	return s.fs.PutManifest(ctx, repository, reference, contentType, manifest)
@@ -125,10 +118,38 @@ func (s *S3RegistryStore) CopyBlob(ctx context.Context, repositoryTo, repository
 	return s.fs.CopyBlob(ctx, repositoryTo, repositoryFrom, digest)
 }
 
+func (s *S3RegistryStore) GCGlobalBlobs(ctx context.Context, options GCOptions) ([]GCBlob, error) {
+	return s.fs.GCGlobalBlobs(ctx, options)
+}
+
+func (s *S3RegistryStore) GCUploads(ctx context.Context, repository string, options GCOptions) ([]GCUpload, error) {
+	return s.fs.GCUploads(ctx, repository, options)
+}
+
+func (s *S3RegistryStore) LockGC(ctx context.Context, ttl time.Duration) (context.Context, func(), error) {
+	return s.fs.LockGC(ctx, ttl)
+}
+
+func (s *S3RegistryStore) ListRepositories(ctx context.Context) ([]string, error) {
+	return s.fs.ListRepositories(ctx)
+}
+
+func (s *S3RegistryStore) ListManifests(ctx context.Context, repository string) ([]string, error) {
+	return s.fs.ListManifests(ctx, repository)
+}
+
+func (s *S3RegistryStore) StoredBytes(ctx context.Context, name string) (int64, error) {
+	return s.fs.StoredBytes(ctx, name)
+}
+
 func (s *S3RegistryStore) GetBlob(ctx context.Context, repository string, digest digest.Digest) (*BlobContent, error) {
 	return s.fs.GetBlob(ctx, repository, digest)
 }
 
+func (s *S3RegistryStore) GetBlobRange(ctx context.Context, repository string, digest digest.Digest, offset, length int64) (*BlobContent, error) {
+	return s.fs.GetBlobRange(ctx, repository, digest, offset, length)
+}
+
 func (s *S3RegistryStore) DeleteBlob(ctx context.Context, repository string, digest digest.Digest) error {
 	return s.fs.DeleteBlob(ctx, repository, digest)
 }
@@ -145,15 +166,46 @@ func (s *S3RegistryStore) GetBlobMeta(ctx context.Context, repository string, di
 	return s.fs.GetBlobMeta(ctx, repository, digest)
 }
 
+func (s *S3RegistryStore) CreateUpload(ctx context.Context, repository string) (*UploadStatus, error) {
+	return s.fs.CreateUpload(ctx, repository)
+}
+
+func (s *S3RegistryStore) ResumeUpload(ctx context.Context, repository string, id string) (*UploadStatus, error) {
+	return s.fs.ResumeUpload(ctx, repository, id)
+}
+
+func (s *S3RegistryStore) GetUpload(ctx context.Context, repository string, id string) (*UploadStatus, error) {
+	return s.fs.GetUpload(ctx, repository, id)
+}
+
+func (s *S3RegistryStore) PutUploadChunk(ctx context.Context, repository string, id string, offset int64, content BlobContent) (*UploadStatus, error) {
+	return s.fs.PutUploadChunk(ctx, repository, id, offset, content)
+}
+
+func (s *S3RegistryStore) CommitUpload(ctx context.Context, repository string, id string, digest digest.Digest) error {
+	return s.fs.CommitUpload(ctx, repository, id, digest)
+}
+
+func (s *S3RegistryStore) CancelUpload(ctx context.Context, repository string, id string) error {
+	return s.fs.CancelUpload(ctx, repository, id)
+}
+
 func (s *S3RegistryStore) GetBlobLocation(ctx context.Context, repository string, digest digest.Digest,
 	purpose string, properties map[string]string,
 ) (*BlobLocation, error) {
-	path := BlobDigestPath(repository, digest)
 	switch purpose {
 	case BlobLocationPurposeDownload:
+		_, path, err := s.fs.statBlob(ctx, repository, digest)
+		if err != nil {
+			if os.IsNotExist(err) || IsS3StorageNotFound(err) {
+				return nil, ErrRegistryStoreNotFound
+			}
+			return nil, modelxerrors.NewInternalError(err)
+		}
 		return s.downloadLocation(ctx, path, properties)
 	case BlobLocationPurposeUpload:
-		return s.uploadLocation(ctx, path, properties)
+		// presigned uploads are not verified by modelxd, they stay in the repository and never enter the global pool
+		return s.uploadLocation(ctx, BlobDigestPath(repository, digest), properties)
 	default:
 		return nil, modelxerrors.NewUnsupportedError("purpose: " + purpose)
 	}
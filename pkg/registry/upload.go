@@ -0,0 +1,294 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+
+	errors "kubegems.io/modelx/pkg/response"
+	"kubegems.io/modelx/pkg/util"
+)
+
+const (
+	UploadStartedAtFileName = "startedat"
+
+	// chunk objects are named by their zero padded offset, so they list in order.
+	uploadChunkNameFormat = "%020d"
+)
+
+var uploadIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+type UploadStatus util.UploadStatus
+
+// UploadCollector is implemented by stores which can expire the upload sessions abandoned by their clients.
+type UploadCollector interface {
+	GCUploads(ctx context.Context, repository string, options GCOptions) ([]GCUpload, error)
+}
+
+type uploadChunk struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+func UploadPath(repository string, id string) string {
+	return path.Join(repository, "uploads", id)
+}
+
+func NewUploadID() string {
+	return uuid.NewV4().String()
+}
+
+// CreateUpload starts a new upload session in the repository.
+func (m *FSRegistryStore) CreateUpload(ctx context.Context, repository string) (*UploadStatus, error) {
+	return m.createUpload(ctx, repository, NewUploadID())
+}
+
+func (m *FSRegistryStore) createUpload(ctx context.Context, repository string, id string) (*UploadStatus, error) {
+	if !uploadIDRegexp.MatchString(id) {
+		return nil, errors.NewBlobUploadUnknownError(id)
+	}
+	now := time.Now().UTC()
+	content := []byte(now.Format(time.RFC3339Nano))
+	marker := BlobContent{
+		Content:       io.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+		ContentType:   "text/plain",
+	}
+	if err := m.FS.Put(ctx, path.Join(UploadPath(repository, id), UploadStartedAtFileName), marker); err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	return &UploadStatus{ID: id, Repository: repository, StartedAt: now}, nil
+}
+
+// ResumeUpload returns the upload session with id, it is created if it does not exist yet.
+func (m *FSRegistryStore) ResumeUpload(ctx context.Context, repository string, id string) (*UploadStatus, error) {
+	status, err := m.GetUpload(ctx, repository, id)
+	if err == nil {
+		return status, nil
+	}
+	if !errors.IsErrCode(err, errors.ErrCodeBlobUploadUnknown) {
+		return nil, err
+	}
+	return m.createUpload(ctx, repository, id)
+}
+
+// GetUpload returns the state of the upload session, the offset is the end of the
+// contiguous chunks received so far.
+func (m *FSRegistryStore) GetUpload(ctx context.Context, repository string, id string) (*UploadStatus, error) {
+	status, _, err := m.listUpload(ctx, repository, id)
+	return status, err
+}
+
+// PutUploadChunk appends content to the upload session at offset,
+// a negative offset appends at the current end of the session.
+func (m *FSRegistryStore) PutUploadChunk(ctx context.Context, repository string, id string, offset int64, content BlobContent) (*UploadStatus, error) {
+	status, _, err := m.listUpload(ctx, repository, id)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		offset = status.Offset
+	}
+	if offset != status.Offset {
+		return nil, errors.NewBlobUploadInvalidError(fmt.Sprintf("chunk offset %d does not match upload offset %d", offset, status.Offset))
+	}
+	chunkpath := path.Join(UploadPath(repository, id), fmt.Sprintf(uploadChunkNameFormat, offset))
+	if err := m.FS.Put(ctx, chunkpath, content); err != nil {
+		_ = m.FS.Remove(ctx, chunkpath, false)
+		return nil, errors.NewInternalError(err)
+	}
+	return m.GetUpload(ctx, repository, id)
+}
+
+// CommitUpload concatenates the chunks of the session into the blob and removes the session.
+// The blob is verified against digest, on mismatch the session is kept so the client may retry.
+func (m *FSRegistryStore) CommitUpload(ctx context.Context, repository string, id string, digest digest.Digest) error {
+	status, chunks, err := m.listUpload(ctx, repository, id)
+	if err != nil {
+		return err
+	}
+	content := BlobContent{
+		ContentType:   "application/octet-stream",
+		ContentLength: status.Offset,
+		Content:       &chunksReader{ctx: ctx, fs: m.FS, chunks: chunks},
+	}
+	if err := m.PutBlob(ctx, repository, digest, content); err != nil {
+		return err
+	}
+	return m.CancelUpload(ctx, repository, id)
+}
+
+// CancelUpload removes the upload session and all received chunks.
+func (m *FSRegistryStore) CancelUpload(ctx context.Context, repository string, id string) error {
+	if !uploadIDRegexp.MatchString(id) {
+		return errors.NewBlobUploadUnknownError(id)
+	}
+	if err := m.FS.Remove(ctx, UploadPath(repository, id), true); err != nil {
+		return errors.NewInternalError(err)
+	}
+	return nil
+}
+
+// GCUploads removes the upload sessions of the repository idle for longer than UploadTTL,
+// a session is idle since it started or received its last chunk.
+func (m *FSRegistryStore) GCUploads(ctx context.Context, repository string, options GCOptions) ([]GCUpload, error) {
+	result := []GCUpload{}
+	if options.UploadTTL <= 0 {
+		return result, nil
+	}
+	dir := path.Join(repository, "uploads")
+	metas, err := m.FS.List(ctx, dir, true)
+	if err != nil {
+		if IsS3StorageNotFound(err) || os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, errors.NewInternalError(err)
+	}
+	sizes, lastModified := map[string]int64{}, map[string]time.Time{}
+	for _, meta := range metas {
+		// <repository>/uploads/<id>/{startedat,<offset>}
+		id, _, ok := strings.Cut(strings.TrimPrefix(meta.Name, dir+"/"), "/")
+		if !ok {
+			continue
+		}
+		sizes[id] += meta.Size
+		if meta.LastModified.After(lastModified[id]) {
+			lastModified[id] = meta.LastModified
+		}
+	}
+	ids := slices.Sorted(maps.Keys(sizes))
+	for _, id := range ids {
+		if time.Since(lastModified[id]) < options.UploadTTL {
+			continue
+		}
+		upload := GCUpload{ID: id, Size: sizes[id]}
+		if options.DryRun {
+			upload.Status = GCBlobStatusUnused
+		} else if err := m.FS.Remove(ctx, UploadPath(repository, id), true); err != nil {
+			registryLogger.Error("remove expired upload", zap.Any("repository", repository), zap.Any("id", id), zap.Error(err))
+			upload.Status, upload.Error = GCBlobStatusFailed, err.Error()
+		} else {
+			registryLogger.Info("removed expired upload", zap.Any("repository", repository), zap.Any("id", id))
+			upload.Status = GCBlobStatusRemoved
+		}
+		result = append(result, upload)
+	}
+	return result, nil
+}
+
+func (m *FSRegistryStore) listUpload(ctx context.Context, repository string, id string) (*UploadStatus, []uploadChunk, error) {
+	if !uploadIDRegexp.MatchString(id) {
+		return nil, nil, errors.NewBlobUploadUnknownError(id)
+	}
+	dir := UploadPath(repository, id)
+	metas, err := m.FS.List(ctx, dir, false)
+	if err != nil {
+		if IsS3StorageNotFound(err) || os.IsNotExist(err) {
+			return nil, nil, errors.NewBlobUploadUnknownError(id)
+		}
+		return nil, nil, errors.NewInternalError(err)
+	}
+	status := &UploadStatus{ID: id, Repository: repository}
+	found := false
+	chunks := []uploadChunk{}
+	for _, meta := range metas {
+		name := path.Base(meta.Name)
+		if name == UploadStartedAtFileName {
+			found = true
+			status.StartedAt = meta.LastModified
+			continue
+		}
+		offset, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, uploadChunk{path: path.Join(dir, name), offset: offset, size: meta.Size})
+	}
+	if !found {
+		return nil, nil, errors.NewBlobUploadUnknownError(id)
+	}
+	slices.SortFunc(chunks, func(a, b uploadChunk) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+	// only contiguous chunks count, a chunk at an unexpected offset is left over from a failed write.
+	contiguous := chunks[:0]
+	for _, chunk := range chunks {
+		if chunk.offset != status.Offset {
+			break
+		}
+		contiguous = append(contiguous, chunk)
+		status.Offset += chunk.size
+	}
+	return status, contiguous, nil
+}
+
+// chunksReader reads the upload chunks in order, opening each one only when it is reached.
+type chunksReader struct {
+	ctx     context.Context
+	fs      FSProvider
+	chunks  []uploadChunk
+	current io.ReadCloser
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			content, err := r.fs.Get(r.ctx, r.chunks[0].path)
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.chunks = content.Content, r.chunks[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			_ = r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunksReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
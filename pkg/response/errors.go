@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/opencontainers/go-digest"
 )
@@ -40,6 +41,7 @@ const (
 	ErrCodeDenied              ErrCode = "DENIED"
 	ErrCodeUnsupported         ErrCode = "UNSUPPORTED"
 	ErrCodeTooManyRequests     ErrCode = "TOOMANYREQUESTS"
+	ErrCodeConflict            ErrCode = "CONFLICT"
 	ErrCodeConfigInvalid       ErrCode = "CONFIG_INVALID"
 	ErrCodeInvalidParameter    ErrCode = "INVALID_PARAMETER"
 	ErrCodeIndexUnknown        ErrCode = "INDEX_UNKNOWN"
@@ -87,18 +89,46 @@ func NewDigestInvalidError(got string) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeDigestInvalid, Message: fmt.Sprintf("digest invalid: %s", got)}
 }
 
+func NewDigestMismatchError(expected, got digest.Digest) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeDigestInvalid, Message: fmt.Sprintf("digest mismatch: expected %s, got %s", expected.String(), got.String())}
+}
+
+func NewSizeInvalidError(expected, got int64) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeSizeInvalid, Message: fmt.Sprintf("size invalid: expected %d, got %d", expected, got)}
+}
+
 func NewIndexUnknownError(repository string) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusNotFound, Code: ErrCodeIndexUnknown, Message: fmt.Sprintf("index: %s not found", repository)}
 }
 
+func NewNameUnknownError(repository string) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusNotFound, Code: ErrCodeNameUnknown, Message: fmt.Sprintf("repository: %s not found", repository)}
+}
+
 func NewBlobUnknownError(digest digest.Digest) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusNotFound, Code: ErrCodeBlobUnknown, Message: fmt.Sprintf("blob: %s not found", digest.String())}
 }
 
+func NewBlobUploadUnknownError(id string) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusNotFound, Code: ErrCodeBlobUploadUnknown, Message: fmt.Sprintf("blob upload: %s not found", id)}
+}
+
+func NewBlobUploadInvalidError(msg string) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusRequestedRangeNotSatisfiable, Code: ErrCodeBlobUploadInvalid, Message: msg}
+}
+
 func NewManifestUnknownError(reference string) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusNotFound, Code: ErrCodeManifestUnknown, Message: fmt.Sprintf("manifest: %s not found", reference)}
 }
 
+func NewManifestBlobUnknownError(digests []digest.Digest) ErrorInfo {
+	list := make([]string, 0, len(digests))
+	for _, d := range digests {
+		list = append(list, d.String())
+	}
+	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeManifestBlobUnknown, Message: fmt.Sprintf("manifest blob unknown: %s", strings.Join(list, ", "))}
+}
+
 func NewManifestInvalidError(err error) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeManifestInvalid, Message: err.Error()}
 }
@@ -111,6 +141,10 @@ func NewContentRangeInvalidError(msg string) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeSizeInvalid, Message: fmt.Sprintf("content range: %s", msg)}
 }
 
+func NewRangeNotSatisfiableError(size int64) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusRequestedRangeNotSatisfiable, Code: ErrCodeInvalidParameter, Message: fmt.Sprintf("range not satisfiable, size %d", size)}
+}
+
 func NewContentLengthInvalidError(msg string) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeSizeInvalid, Message: fmt.Sprintf("content length: %s", msg)}
 }
@@ -119,6 +153,18 @@ func NewConfigInvalidError(msg string) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeConfigInvalid, Message: msg}
 }
 
+func NewDeniedError(msg string) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusForbidden, Code: ErrCodeDenied, Message: msg}
+}
+
+func NewConflictError(msg string) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusConflict, Code: ErrCodeConflict, Message: msg}
+}
+
+func NewTooManyRequestsError(msg string) ErrorInfo {
+	return ErrorInfo{HttpStatus: http.StatusTooManyRequests, Code: ErrCodeTooManyRequests, Message: msg}
+}
+
 func NewParameterInvalidError(msg string) ErrorInfo {
 	return ErrorInfo{HttpStatus: http.StatusBadRequest, Code: ErrCodeInvalidParameter, Message: msg}
 }
@@ -138,6 +184,22 @@ func ResponseError(w http.ResponseWriter, err error) {
 	_ = json.NewEncoder(w).Encode(info)
 }
 
+// ResponseOCIError writes err in the OCI distribution spec error format.
+func ResponseOCIError(w http.ResponseWriter, err error) {
+	info := ErrorInfo{}
+	if !errors.As(err, &info) {
+		info = ErrorInfo{
+			HttpStatus: http.StatusBadRequest,
+			Code:       ErrCodeUnknow,
+			Message:    err.Error(),
+			Detail:     err.Error(),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(info.HttpStatus)
+	_ = json.NewEncoder(w).Encode(map[string][]ErrorInfo{"errors": {info}})
+}
+
 func ResponseOK(w http.ResponseWriter, data any) {
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(data)
@@ -19,6 +19,7 @@ package response
 import (
 	"testing"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,3 +40,40 @@ func TestNewUnauthorizedError(t *testing.T) {
 	e := NewUnauthorizedError("this is error")
 	assert.Equal("UNAUTHORIZED: this is error", e.Error())
 }
+
+func TestNewDigestMismatchError(t *testing.T) {
+	assert := assert.New(t)
+	e := NewDigestMismatchError("sha256:aaa", "sha256:bbb")
+	assert.Equal(400, e.HttpStatus)
+	assert.True(IsErrCode(e, ErrCodeDigestInvalid))
+	assert.Equal("DIGEST_INVALID: digest mismatch: expected sha256:aaa, got sha256:bbb", e.Error())
+}
+
+func TestNewSizeInvalidError(t *testing.T) {
+	assert := assert.New(t)
+	e := NewSizeInvalidError(10, 5)
+	assert.True(IsErrCode(e, ErrCodeSizeInvalid))
+	assert.Equal("SIZE_INVALID: size invalid: expected 10, got 5", e.Error())
+}
+
+func TestNewManifestBlobUnknownError(t *testing.T) {
+	assert := assert.New(t)
+	e := NewManifestBlobUnknownError([]digest.Digest{"sha256:aa", "sha256:bb"})
+	assert.True(IsErrCode(e, ErrCodeManifestBlobUnknown))
+	assert.Equal(400, e.HttpStatus)
+	assert.Equal("MANIFEST_BLOB_UNKNOWN: manifest blob unknown: sha256:aa, sha256:bb", e.Error())
+}
+
+func TestNewConflictError(t *testing.T) {
+	assert := assert.New(t)
+	e := NewConflictError("garbage collect is running")
+	assert.True(IsErrCode(e, ErrCodeConflict))
+	assert.Equal(409, e.HttpStatus)
+}
+
+func TestNewDeniedError(t *testing.T) {
+	assert := assert.New(t)
+	e := NewDeniedError("quota exceeded")
+	assert.True(IsErrCode(e, ErrCodeDenied))
+	assert.Equal(403, e.HttpStatus)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	AnnotationOCITitle = "org.opencontainers.image.title"
+	// AnnotationOCIManifestDigest records the digest of the raw manifest pushed through the OCI api.
+	AnnotationOCIManifestDigest = "modelx.kubegems.io/oci-manifest-digest"
+)
+
+// OCIDescriptor is the descriptor defined by the OCI image spec.
+type OCIDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       digest.Digest     `json:"digest"`
+	Size         int64             `json:"size"`
+	URLs         []string          `json:"urls,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+}
+
+// OCIManifest is the image manifest defined by the OCI image spec.
+type OCIManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        OCIDescriptor     `json:"config"`
+	Layers        []OCIDescriptor   `json:"layers"`
+	Subject       *OCIDescriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// OCICatalog is the response of the OCI distribution catalog api.
+type OCICatalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// OCITagList is the response of the OCI distribution tags list api.
+type OCITagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// ManifestFromOCI converts an OCI image manifest into a modelx manifest,
+// layers are named by their title annotation, or by digest if missing.
+func ManifestFromOCI(in OCIManifest) Manifest {
+	mediaType := in.MediaType
+	if mediaType == "" {
+		mediaType = MediaTypeOCIManifest
+	}
+	out := Manifest{
+		SchemaVersion: in.SchemaVersion,
+		MediaType:     mediaType,
+		Config:        descriptorFromOCI(in.Config),
+		Blobs:         make([]Descriptor, 0, len(in.Layers)),
+		Annotations:   copyAnnotations(in.Annotations),
+	}
+	for _, layer := range in.Layers {
+		out.Blobs = append(out.Blobs, descriptorFromOCI(layer))
+	}
+	return out
+}
+
+// ManifestToOCI converts a modelx manifest into an OCI image manifest,
+// blob names are kept in the title annotation.
+func ManifestToOCI(in Manifest) OCIManifest {
+	out := OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        descriptorToOCI(in.Config),
+		Layers:        make([]OCIDescriptor, 0, len(in.Blobs)),
+		Annotations:   copyAnnotations(in.Annotations),
+	}
+	delete(out.Annotations, AnnotationOCIManifestDigest)
+	if len(out.Annotations) == 0 {
+		out.Annotations = nil
+	}
+	for _, blob := range in.Blobs {
+		out.Layers = append(out.Layers, descriptorToOCI(blob))
+	}
+	return out
+}
+
+func descriptorFromOCI(in OCIDescriptor) Descriptor {
+	out := Descriptor{
+		MediaType:   in.MediaType,
+		Digest:      in.Digest,
+		Size:        in.Size,
+		URLs:        in.URLs,
+		Annotations: copyAnnotations(in.Annotations),
+	}
+	if title, ok := out.Annotations[AnnotationOCITitle]; ok && title != "" {
+		out.Name = title
+		delete(out.Annotations, AnnotationOCITitle)
+	} else {
+		out.Name = in.Digest.Encoded()
+	}
+	if len(out.Annotations) == 0 {
+		out.Annotations = nil
+	}
+	return out
+}
+
+func descriptorToOCI(in Descriptor) OCIDescriptor {
+	out := OCIDescriptor{
+		MediaType:   in.MediaType,
+		Digest:      in.Digest,
+		Size:        in.Size,
+		URLs:        in.URLs,
+		Annotations: copyAnnotations(in.Annotations),
+	}
+	if in.Name != "" {
+		if out.Annotations == nil {
+			out.Annotations = map[string]string{}
+		}
+		out.Annotations[AnnotationOCITitle] = in.Name
+	}
+	return out
+}
+
+func copyAnnotations(in map[string]string) map[string]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
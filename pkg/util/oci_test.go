@@ -0,0 +1,61 @@
+/*
+Copyright 2024 The KubeService-Stack Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestFromOCI(t *testing.T) {
+	assert := assert.New(t)
+	layer := digest.FromString("layer")
+	oci := OCIManifest{
+		SchemaVersion: 2,
+		Config:        OCIDescriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: digest.FromString("{}"), Size: 2},
+		Layers: []OCIDescriptor{
+			{MediaType: "application/octet-stream", Digest: layer, Size: 5, Annotations: map[string]string{AnnotationOCITitle: "model.bin"}},
+			{MediaType: "application/octet-stream", Digest: layer, Size: 5},
+		},
+	}
+	manifest := ManifestFromOCI(oci)
+	assert.Equal(MediaTypeOCIManifest, manifest.MediaType)
+	assert.Len(manifest.Blobs, 2)
+	assert.Equal("model.bin", manifest.Blobs[0].Name)
+	assert.Nil(manifest.Blobs[0].Annotations)
+	assert.Equal(layer.Encoded(), manifest.Blobs[1].Name)
+}
+
+func TestManifestToOCI(t *testing.T) {
+	assert := assert.New(t)
+	manifest := Manifest{
+		Config: Descriptor{Name: "modelx.yaml", Digest: digest.FromString("config"), Size: 6},
+		Blobs: []Descriptor{
+			{Name: "model.bin", Digest: digest.FromString("layer"), Size: 5},
+		},
+		Annotations: map[string]string{AnnotationOCIManifestDigest: digest.FromString("raw").String()},
+	}
+	oci := ManifestToOCI(manifest)
+	assert.Equal(2, oci.SchemaVersion)
+	assert.Equal(MediaTypeOCIManifest, oci.MediaType)
+	assert.Equal("modelx.yaml", oci.Config.Annotations[AnnotationOCITitle])
+	assert.Equal("model.bin", oci.Layers[0].Annotations[AnnotationOCITitle])
+	assert.Nil(oci.Annotations)
+	assert.Equal(manifest.Blobs, ManifestFromOCI(oci).Blobs)
+}
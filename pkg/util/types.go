@@ -43,6 +43,14 @@ type BlobLocation struct {
 
 type Properties map[string]any
 
+// UploadStatus is the state of an in-progress blob upload session.
+type UploadStatus struct {
+	ID         string    `json:"id"`
+	Repository string    `json:"repository"`
+	Offset     int64     `json:"offset"` // bytes received so far
+	StartedAt  time.Time `json:"startedAt"`
+}
+
 type Descriptor struct {
 	Name        string        `json:"name"`
 	MediaType   string        `json:"mediaType,omitempty"`